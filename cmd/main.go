@@ -2,24 +2,74 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/newrelic/newrelic-pixie-integration/internal/config"
+	"github.com/newrelic/newrelic-pixie-integration/internal/health"
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
 	"github.com/newrelic/newrelic-pixie-integration/internal/pixie"
+	"github.com/newrelic/newrelic-pixie-integration/internal/reconciler"
 	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+	"github.com/newrelic/newrelic-pixie-integration/internal/telemetry"
 )
 
 const (
-	defaultRetries   = 100
-	defaultSleepTime = 15 * time.Second
+	programName = "newrelic-pixie-integration"
 )
 
+const (
+	commandApply       = "apply"
+	commandPlan        = "plan"
+	commandStatus      = "status"
+	commandListScripts = "list-scripts"
+	commandRender      = "render"
+	commandRenderFile  = "render-file"
+	commandCleanup     = "cleanup"
+	commandVersion     = "version"
+)
+
+// commands are the subcommands of the integration. Without a subcommand the integration
+// applies or cleans up as configured by the env and the config file.
+var commands = []struct {
+	name  string
+	args  string
+	usage string
+}{
+	{commandApply, "", "enable the New Relic plugin and reconcile the scripts, once or every reconcile interval"},
+	{commandPlan, "", "print the changes apply would make without mutating Pixie"},
+	{commandStatus, "", "print the New Relic plugin status and the pending changes of every cluster"},
+	{commandListScripts, "", "list the nri- scripts registered for every cluster"},
+	{commandRender, "<script>", "print the PxL of a preset or custom script as registered for every cluster"},
+	{commandRenderFile, "<file>", "print the PxL of a script definition file for every cluster, without connecting to Pixie"},
+	{commandCleanup, "", "delete the scripts of the configured clusters"},
+	{commandVersion, "", "print the version of the integration"},
+}
+
 func main() {
-	ctx := context.Background()
+	command, args := parseArgs(os.Args[1:])
+	if command == commandVersion {
+		settings := config.BuildSettings()
+		fmt.Printf("%s %s (commit %s, built %s)\n", programName, settings.Version(), settings.Commit(), settings.BuildDate())
+		os.Exit(0)
+	}
+	if command == commandRenderFile {
+		if err := renderFile(args[0]); err != nil {
+			log.WithError(err).Error("rendering the script failed")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	ctx, signalExitCode := handleSignals()
 
 	log.Info("Starting the setup of the New Relic Pixie plugin")
 	cfg, err := config.GetConfig()
@@ -28,123 +78,358 @@ func main() {
 		os.Exit(1)
 	}
 
-	clusterId := cfg.Pixie().ClusterID()
-	clusterName := cfg.Worker().ClusterName()
+	settings := cfg.Settings()
+	metrics.BuildInfo.Set(1, settings.Version(), settings.Commit(), settings.BuildDate())
 
-	log.Debugf("Setting up Pixie plugin for cluster-id %s", clusterId)
-	client, err := setupPixie(ctx, cfg.Pixie(), defaultRetries, defaultSleepTime)
+	dryRun := command == commandPlan || cfg.Worker().DryRun()
+	cleanup := command == commandCleanup || (command == "" && cfg.Worker().Cleanup())
+	mutating := !dryRun && (command == "" || command == commandApply || command == commandCleanup)
+
+	var selfTelemetry *telemetry.Telemetry
+	if cfg.Exporter().SelfTelemetry() && mutating {
+		selfTelemetry = newTelemetry(cfg)
+		log.AddHook(selfTelemetry)
+		// Send the buffered logs before exiting, including the error of log.Fatal.
+		log.RegisterExitHandler(func() {
+			if err := selfTelemetry.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "sending self-telemetry failed: %v\n", err)
+			}
+		})
+	}
+
+	status := health.NewStatus()
+	if addr := cfg.Worker().HTTPAddress(); addr != "" && mutating {
+		go serveHTTP(addr, status)
+	}
+
+	for _, cluster := range cfg.Worker().Clusters() {
+		log.Debugf("Setting up Pixie plugin for cluster %s (cluster-id %s)", cluster.Name(), cluster.ID())
+	}
+	client, err := pixie.NewClient(cfg.Pixie().APIKey, cfg.Pixie().Host(), pixie.Options{
+		Concurrency: cfg.Worker().Concurrency(),
+		Retry: pixie.RetryPolicy{
+			MaxAttempts:    cfg.Worker().RetryMaxAttempts(),
+			InitialBackoff: cfg.Worker().RetryInitialBackoff(),
+			MaxBackoff:     cfg.Worker().RetryMaxBackoff(),
+		},
+		RequestTimeout: cfg.Worker().RequestTimeout(),
+	})
 	if err != nil {
 		log.WithError(err).Fatal("setting up Pixie client failed")
 	}
+	status.SetPixieConnected()
 
-	log.Debug("Checking the current New Relic plugin configuration")
-	plugin, err := client.GetNewRelicPlugin()
-	if err != nil {
-		log.WithError(err).Fatal("getting data retention plugins failed")
+	r := reconciler.New(cfg, client)
+
+	runTimeout := cfg.Worker().RunTimeout()
+	switch command {
+	case commandStatus:
+		runCtx, cancel := runContext(ctx, runTimeout)
+		err := printStatus(runCtx, r)
+		cancel()
+		exit(ctx, client, signalExitCode, err, "getting the status failed")
+	case commandListScripts:
+		runCtx, cancel := runContext(ctx, runTimeout)
+		err := listScripts(runCtx, client, cfg.Worker().Clusters())
+		cancel()
+		exit(ctx, client, signalExitCode, err, "listing the scripts failed")
+	case commandRender:
+		runCtx, cancel := runContext(ctx, runTimeout)
+		err := render(runCtx, r, cfg.Worker(), args[0])
+		cancel()
+		exit(ctx, client, signalExitCode, err, "rendering the script failed")
 	}
 
-	enablePlugin := true
-	if plugin.RetentionEnabled {
-		enablePlugin = false
-		config, err := client.GetNewRelicPluginConfig()
-		if err != nil {
-			log.WithError(err).Fatal("getting New Relic plugin config failed")
+	if dryRun {
+		plan := r.Plan
+		if cleanup {
+			plan = func(ctx context.Context) (*reconciler.Plan, error) {
+				return r.CleanupPlan(ctx, cfg.Worker().CleanupDisablePlugin())
+			}
 		}
-		if config.ExportUrl != cfg.Exporter().Endpoint() {
-			log.Fatal("the New Relic plugin is already installed with a different export URL")
+		runCtx, cancel := runContext(ctx, runTimeout)
+		err := printPlan(runCtx, plan, cfg.Worker().PlanOutput())
+		cancel()
+		exit(ctx, client, signalExitCode, err, "computing the plan failed")
+	}
+
+	if cleanup {
+		runCtx, cancel := runContext(ctx, runTimeout)
+		summary, err := r.Cleanup(runCtx, cfg.Worker().CleanupDisablePlugin())
+		cancel()
+		if err == nil {
+			log.Infof("Cleanup finished: %s", summary)
 		}
-		if config.LicenseKey != cfg.Exporter().LicenseKey() {
-			log.Info("New Relic plugin is configured with another license key... Overwriting")
-			enablePlugin = true
+		exit(ctx, client, signalExitCode, err, "cleaning up the New Relic plugin failed")
+	}
+
+	interval := cfg.Worker().ReconcileInterval()
+	if interval == 0 {
+		summary, err := reconcile(ctx, runTimeout, r, status, selfTelemetry)
+		if err == nil {
+			log.Infof("Reconcile finished: %s", summary)
+			log.Info("All done! The New Relic plugin is now configured.")
 		}
+		exit(ctx, client, signalExitCode, err, "reconciling the New Relic plugin failed")
 	}
 
-	if enablePlugin {
-		log.Info("Enabling New Relic plugin")
-		err := client.EnableNewRelicPlugin(&pixie.NewRelicPluginConfig{
-			LicenseKey: cfg.Exporter().LicenseKey(),
-			ExportUrl:  cfg.Exporter().Endpoint(),
-		}, plugin.LatestVersion)
+	log.Infof("Reconciling the New Relic plugin every %d seconds", interval)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		summary, err := reconcile(ctx, runTimeout, r, status, selfTelemetry)
 		if err != nil {
-			log.WithError(err).Fatal("failed to enabled New Relic plugin")
+			log.WithError(err).Errorf("Reconcile pass failed: %s", summary)
+		} else {
+			log.Infof("Reconcile pass finished: %s", summary)
+		}
+		select {
+		case <-ctx.Done():
+			exit(ctx, client, signalExitCode, nil, "")
+		case <-ticker.C:
 		}
 	}
+}
 
-	log.Info("Setting up the data retention scripts")
+// parseArgs returns the subcommand, if any, and its positional arguments. The flags set the
+// env variables they mirror. Invalid arguments print the usage and exit with status 2.
+func parseArgs(args []string) (string, []string) {
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet(programName, flag.ExitOnError)
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [command] [flags] [args]\n\nCommands:\n", programName)
+		for _, c := range commands {
+			fmt.Fprintf(out, "  %-24s %s\n", strings.TrimSpace(c.name+" "+c.args), c.usage)
+		}
+		fmt.Fprintf(out, "\nWithout a command, the integration applies or cleans up as configured by the env.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
 
-	log.Debug("Getting preset script from the Pixie plugin")
-	defsFromPixie, err := client.GetPresetScripts()
-	if err != nil {
-		log.WithError(err).Fatal("failed to get preset scripts")
+	wantArgs := -1
+	for _, c := range commands {
+		if c.name == command {
+			wantArgs = len(strings.Fields(c.args))
+		}
+	}
+	if command == "" {
+		wantArgs = 0
+	}
+	if wantArgs < 0 {
+		fmt.Fprintf(fs.Output(), "unknown command %q\n\n", command)
+		fs.Usage()
+		os.Exit(2)
 	}
+	_ = fs.Parse(args)
+	if fs.NArg() != wantArgs {
+		fmt.Fprintf(fs.Output(), "%s expects %d argument(s), got %d\n\n", command, wantArgs, fs.NArg())
+		fs.Usage()
+		os.Exit(2)
+	}
+	return command, fs.Args()
+}
 
-	log.Debugf("Getting script definitions from %s", cfg.Worker().ScriptDir())
-	defsFromDisk, err := config.ReadScriptDefinitions(cfg.Worker().ScriptDir())
+// printStatus prints the New Relic plugin status and the scripts of every cluster.
+func printStatus(ctx context.Context, r *reconciler.Reconciler) error {
+	plan, err := r.Plan(ctx)
 	if err != nil {
-		log.WithError(err).Fatalf("failed to read script definitions from %s", cfg.Worker().ScriptDir())
+		return err
 	}
+	if plan.EnablePlugin {
+		fmt.Printf("New Relic plugin (version %s): needs to be enabled, %s\n", plan.PluginVersion, plan.EnablePluginReason)
+	} else {
+		fmt.Printf("New Relic plugin (version %s): enabled\n", plan.PluginVersion)
+	}
+	for _, cp := range plan.Clusters {
+		if cp.Error != "" {
+			fmt.Printf("Cluster %s (%s): %s\n", cp.ClusterName, cp.ClusterId, cp.Error)
+			continue
+		}
+		fmt.Printf("Cluster %s (%s): %d scripts, %d to create, %d to update, %d to delete, %d failing\n",
+			cp.ClusterName, cp.ClusterId, cp.Managed(), len(cp.ToCreate), len(cp.ToUpdate), len(cp.ToDelete), len(cp.Failed))
+		for _, s := range cp.Failed {
+			fmt.Printf("  %s: %s\n", s.Name, s.Error)
+		}
+	}
+	return nil
+}
 
-	definitions := append(defsFromPixie, defsFromDisk...)
-
-	log.Debugf("Getting current scripts for cluster")
-	currentScripts, err := client.GetClusterScripts(clusterId, clusterName)
+// listScripts prints the nri- scripts registered for every cluster.
+func listScripts(ctx context.Context, client *pixie.Client, clusters []config.Cluster) error {
+	scripts, err := client.GetRetentionScripts(ctx)
 	if err != nil {
-		log.WithError(err).Fatal("failed to get data retention scripts")
+		return err
+	}
+	for _, cluster := range clusters {
+		current, err := client.GetClusterScripts(ctx, scripts, cluster.ID(), cluster.Name())
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", cluster.Name(), err)
+		}
+		fmt.Printf("Cluster %s (%s): %d scripts\n", cluster.Name(), cluster.ID(), len(current))
+		for _, s := range current {
+			fmt.Printf("  %s [%s] (every %ds)\n", s.Name, s.ScriptId, s.FrequencyS)
+		}
 	}
+	return nil
+}
 
-	actions := script.GetActions(definitions, currentScripts, script.ScriptConfig{
-		ClusterName:       clusterName,
-		ClusterId:         clusterId,
-		HttpSpanLimit:     cfg.Worker().HttpSpanLimit(),
-		DbSpanLimit:       cfg.Worker().DbSpanLimit(),
-		CollectInterval:   cfg.Worker().CollectInterval(),
-		ExcludePods:       cfg.Worker().ExcludePods(),
-		ExcludeNamespaces: cfg.Worker().ExcludeNamespaces(),
-	})
+// render prints the PxL of the named preset or custom script as registered for every cluster.
+func render(ctx context.Context, r *reconciler.Reconciler, worker config.Worker, name string) error {
+	definitions, err := r.Definitions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, definition := range definitions {
+		if definition.Name == name {
+			return printRendered(definition, worker)
+		}
+	}
+	return fmt.Errorf("script %q is neither a preset nor a custom script", name)
+}
 
-	var errs []error
+// renderFile prints the PxL of the script definition file for every cluster. Only the worker
+// configuration is needed, the credentials aren't.
+func renderFile(path string) error {
+	worker, err := config.GetWorkerConfig()
+	if err != nil {
+		return err
+	}
+	definition, err := config.ReadScriptDefinition(path)
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	return printRendered(definition, worker)
+}
 
-	for _, s := range actions.ToDelete {
-		log.Debugf("Deleting script %s", s.Name)
-		err := client.DeleteDataRetentionScript(s.ScriptId)
+// printRendered writes the PxL of the script to stdout exactly as it's registered in Pixie,
+// and the name and frequency of the script and its diagnostics to stderr. An error is
+// returned when a custom script has diagnostics.
+func printRendered(definition *script.ScriptDefinition, worker config.Worker) error {
+	invalid := false
+	for _, cluster := range worker.Clusters() {
+		scriptConfig := reconciler.ScriptConfig(worker, cluster)
+		for _, diagnostic := range script.Validate(definition, scriptConfig) {
+			fmt.Fprintln(os.Stderr, diagnostic)
+			invalid = invalid || !definition.IsPreset
+		}
+		rendered, err := script.Render(definition, scriptConfig)
 		if err != nil {
-			errs = append(errs, err)
+			return err
+		}
+		if rendered == nil {
+			fmt.Fprintf(os.Stderr, "# %s is disabled for cluster %s\n", definition.Name, cluster.Name())
+			continue
 		}
+		fmt.Fprintf(os.Stderr, "# %s (every %ds)\n", rendered.Name, rendered.FrequencyS)
+		fmt.Print(rendered.Script)
+		if !strings.HasSuffix(rendered.Script, "\n") {
+			fmt.Println()
+		}
+	}
+	if invalid {
+		return fmt.Errorf("the script %s is invalid", definition.Name)
 	}
+	return nil
+}
 
-	for _, s := range actions.ToUpdate {
-		log.Debugf("Updating script %s", s.Name)
-		err := client.UpdateDataRetentionScript(clusterId, s.ScriptId, s.Name, s.Description, s.FrequencyS, s.Script)
+// handleSignals returns a context cancelled on SIGTERM or SIGINT, and a function returning
+// the exit status for the received signal, 128 plus the signal number. A second signal
+// terminates the process right away.
+func handleSignals() (context.Context, func() int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	var received syscall.Signal
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Infof("Received %s, shutting down", sig)
+		received = sig.(syscall.Signal)
+		cancel()
+	}()
+	return ctx, func() int {
+		<-ctx.Done()
+		return 128 + int(received)
+	}
+}
+
+// exit closes the Pixie client and exits: with the signal exit status when the integration
+// is shutting down, with 1 when err is set and with 0 otherwise. The exit handlers of the
+// logger run first.
+func exit(ctx context.Context, client *pixie.Client, signalExitCode func() int, err error, msg string) {
+	if err := client.Close(); err != nil {
+		log.WithError(err).Warn("closing the Pixie API connection failed")
+	}
+	if ctx.Err() != nil {
 		if err != nil {
-			errs = append(errs, err)
+			log.WithError(err).Error("interrupted: " + msg)
 		}
+		log.Exit(signalExitCode())
 	}
+	if err != nil {
+		log.WithError(err).Error(msg)
+		log.Exit(1)
+	}
+	log.Exit(0)
+}
 
-	for _, s := range actions.ToCreate {
-		log.Debugf("Creating script %s", s.Name)
-		err := client.AddDataRetentionScript(clusterId, s.Name, s.Description, s.FrequencyS, s.Script)
-		if err != nil {
-			errs = append(errs, err)
+// reconcile runs a reconcile pass, cancelled after runTimeout unless it's zero, and reports
+// its outcome to the health status and, when enabled, to the self-telemetry endpoint.
+func reconcile(ctx context.Context, runTimeout time.Duration, r *reconciler.Reconciler, status *health.Status, selfTelemetry *telemetry.Telemetry) (reconciler.Summary, error) {
+	ctx, cancel := runContext(ctx, runTimeout)
+	defer cancel()
+	start := time.Now()
+	summary, err := r.Reconcile(ctx)
+	status.RecordReconcile(time.Now(), summary.PluginVersion, summary.Scripts, err)
+	if selfTelemetry != nil {
+		if err := selfTelemetry.RecordReconcile(start, time.Since(start), summary, err); err != nil {
+			log.WithError(err).Warn("sending self-telemetry failed")
 		}
 	}
+	return summary, err
+}
+
+// runContext returns the context of a single pass, cancelled after runTimeout unless it's zero.
+func runContext(ctx context.Context, runTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if runTimeout > 0 {
+		return context.WithTimeout(ctx, runTimeout)
+	}
+	return context.WithCancel(ctx)
+}
 
-	if len(errs) > 0 {
-		log.Fatalf("errors while setting up data retention scripts: %v", errs)
+func newTelemetry(cfg config.Config) *telemetry.Telemetry {
+	var clusters []string
+	for _, cluster := range cfg.Worker().Clusters() {
+		clusters = append(clusters, cluster.Name())
 	}
+	log.Infof("Sending self-telemetry to %s", cfg.Exporter().SelfTelemetryURL())
+	return telemetry.New(cfg.Exporter().SelfTelemetryURL(), cfg.Exporter().LicenseKey, cfg.Exporter().UserAgent(), cfg.Settings().Version(), map[string]string{
+		"pixie.cluster.names": strings.Join(clusters, ","),
+	})
+}
 
-	log.Info("All done! The New Relic plugin is now configured.")
-	os.Exit(0)
+func serveHTTP(addr string, status *health.Status) {
+	mux := http.NewServeMux()
+	mux.Handle("/", health.NewHandler(status))
+	mux.Handle("/metrics", metrics.Handler())
+	log.Infof("Serving health endpoints and metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithError(err).Error("HTTP server stopped")
+	}
 }
 
-func setupPixie(ctx context.Context, cfg config.Pixie, tries int, sleepTime time.Duration) (*pixie.Client, error) {
-	for tries > 0 {
-		client, err := pixie.NewClient(ctx, cfg.APIKey(), cfg.Host())
-		if err == nil {
-			return client, nil
-		}
-		tries -= 1
-		log.WithError(err).Warning("error creating Pixie API client")
-		time.Sleep(sleepTime)
+func printPlan(ctx context.Context, computePlan func(context.Context) (*reconciler.Plan, error), output string) error {
+	log.Info("Dry-run enabled, computing the plan without applying it")
+	plan, err := computePlan(ctx)
+	if err != nil {
+		return err
+	}
+	if output == config.PlanOutputJSON {
+		return plan.WriteJSON(os.Stdout)
 	}
-	return nil, fmt.Errorf("exceeded maximum number of retries")
+	return plan.WriteText(os.Stdout)
 }
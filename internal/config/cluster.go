@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+const keyClusters = "worker.clusters"
+
+// Cluster holds the settings of a single Pixie cluster managed by the integration.
+type Cluster interface {
+	Name() string
+	ID() string
+	HttpSpanLimit() int64
+	DbSpanLimit() int64
+	SpanLimits() map[string]int64
+	DefaultSpanLimit() int64
+	ExcludePods() string
+	ExcludeNamespaces() string
+	Filters() script.Filters
+	ScriptVariables() map[string]string
+	ResourceAttributes() map[string]string
+}
+
+type cluster struct {
+	// key is the config file key of the cluster, empty for the cluster defined by env variables.
+	key              string
+	name             string
+	id               string
+	httpSpanLimit    int64
+	dbSpanLimit      int64
+	spanLimits       map[string]int64
+	defaultSpanLimit int64
+	filters          script.Filters
+	scriptVariables  map[string]string
+	resourceAttrs    map[string]string
+}
+
+type fileCluster struct {
+	Name                   string            `yaml:"name" json:"name"`
+	ClusterID              string            `yaml:"clusterId" json:"clusterId"`
+	HttpSpanLimit          *int64            `yaml:"httpSpanLimit" json:"httpSpanLimit"`
+	DbSpanLimit            *int64            `yaml:"dbSpanLimit" json:"dbSpanLimit"`
+	SpanLimits             map[string]int64  `yaml:"spanLimits" json:"spanLimits"`
+	DefaultSpanLimit       *int64            `yaml:"defaultSpanLimit" json:"defaultSpanLimit"`
+	ExcludePodsRegex       *string           `yaml:"excludePodsRegex" json:"excludePodsRegex"`
+	ExcludeNamespacesRegex *string           `yaml:"excludeNamespacesRegex" json:"excludeNamespacesRegex"`
+	Filters                script.Filters    `yaml:"filters" json:"filters"`
+	ScriptVariables        map[string]string `yaml:"scriptVariables" json:"scriptVariables"`
+	ResourceAttributes     map[string]string `yaml:"resourceAttributes" json:"resourceAttributes"`
+}
+
+// getClusters returns the clusters from the config file. Settings which are not set for
+// a cluster are inherited from the worker. Filters are overridden per dimension, and script
+// variables and resource attributes per name. Without clusters in the config file, the
+// single cluster defined by the worker settings is returned.
+func getClusters(fileClusters []fileCluster, defaults *cluster) []*cluster {
+	if len(fileClusters) == 0 {
+		return []*cluster{defaults}
+	}
+	clusters := make([]*cluster, 0, len(fileClusters))
+	for i, fc := range fileClusters {
+		c := *defaults
+		c.key = fmt.Sprintf("%s[%d]", keyClusters, i)
+		c.name = fc.Name
+		c.id = fc.ClusterID
+		c.httpSpanLimit = intOrDefault(fc.HttpSpanLimit, defaults.httpSpanLimit)
+		c.dbSpanLimit = intOrDefault(fc.DbSpanLimit, defaults.dbSpanLimit)
+		c.defaultSpanLimit = intOrDefault(fc.DefaultSpanLimit, defaults.defaultSpanLimit)
+		c.spanLimits = make(map[string]int64, len(defaults.spanLimits)+len(fc.SpanLimits))
+		for protocol, limit := range defaults.spanLimits {
+			c.spanLimits[protocol] = limit
+		}
+		for protocol, limit := range fc.SpanLimits {
+			c.spanLimits[strings.ToLower(protocol)] = limit
+		}
+		c.filters = copyFilters(defaults.filters)
+		if fc.ExcludePodsRegex != nil {
+			c.filters[script.FilterPod] = script.Filter{Include: c.filters[script.FilterPod].Include, Exclude: *fc.ExcludePodsRegex}
+		}
+		if fc.ExcludeNamespacesRegex != nil {
+			c.filters[script.FilterNamespace] = script.Filter{Include: c.filters[script.FilterNamespace].Include, Exclude: *fc.ExcludeNamespacesRegex}
+		}
+		for dimension, filter := range fc.Filters {
+			c.filters[dimension] = filter
+		}
+		c.scriptVariables = mergePairs(defaults.scriptVariables, fc.ScriptVariables)
+		c.resourceAttrs = mergePairs(defaults.resourceAttrs, fc.ResourceAttributes)
+		clusters = append(clusters, &c)
+	}
+	return clusters
+}
+
+func validateClusters(clusters []*cluster) error {
+	for i, c := range clusters {
+		if c.name == "" {
+			return fmt.Errorf("missing required %s", c.setting(envClusterName, keyClusterName, "name"))
+		}
+		if c.id == "" {
+			return fmt.Errorf("missing required %s", c.setting(envPixieClusterID, keyPixieClusterID, "clusterId"))
+		}
+		if err := validateFilters(c.filters, c.filtersKey()); err != nil {
+			return err
+		}
+		if err := script.ValidateVariables(c.scriptVariables); err != nil {
+			return fmt.Errorf("invalid %s: %w", c.setting(envScriptVariables, keyScriptVariables, "scriptVariables"), err)
+		}
+		if err := script.ValidateResourceAttributes(c.resourceAttrs); err != nil {
+			return fmt.Errorf("invalid %s: %w", c.setting(envResourceAttrs, keyResourceAttrs, "resourceAttributes"), err)
+		}
+		for _, other := range clusters[:i] {
+			if other.id == c.id {
+				return fmt.Errorf("%s: cluster id %s is used by more than one cluster", c.key, c.id)
+			}
+			// Scripts are matched to clusters by the -<cluster name> suffix, so one name
+			// can't be the suffix of another.
+			if other.name == c.name || strings.HasSuffix(other.name, "-"+c.name) || strings.HasSuffix(c.name, "-"+other.name) {
+				return fmt.Errorf("%s: cluster names %s and %s are ambiguous", c.key, other.name, c.name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cluster) setting(env, key, clusterKey string) string {
+	if c.key == "" {
+		return setting(env, key)
+	}
+	return fmt.Sprintf("config key '%s.%s'", c.key, clusterKey)
+}
+
+func (c *cluster) filtersKey() string {
+	if c.key == "" {
+		return keyFilters
+	}
+	return c.key + ".filters"
+}
+
+func (c *cluster) Name() string {
+	return c.name
+}
+
+func (c *cluster) ID() string {
+	return c.id
+}
+
+func (c *cluster) HttpSpanLimit() int64 {
+	return c.httpSpanLimit
+}
+
+func (c *cluster) DbSpanLimit() int64 {
+	return c.dbSpanLimit
+}
+
+func (c *cluster) SpanLimits() map[string]int64 {
+	return c.spanLimits
+}
+
+func (c *cluster) DefaultSpanLimit() int64 {
+	return c.defaultSpanLimit
+}
+
+func (c *cluster) ExcludePods() string {
+	return c.filters[script.FilterPod].Exclude
+}
+
+func (c *cluster) ExcludeNamespaces() string {
+	return c.filters[script.FilterNamespace].Exclude
+}
+
+// Filters returns the include and exclude filters of every dimension, including the pod
+// and namespace excludes.
+func (c *cluster) Filters() script.Filters {
+	return c.filters
+}
+
+// ScriptVariables returns the values of the template variables of the custom scripts.
+func (c *cluster) ScriptVariables() map[string]string {
+	return c.scriptVariables
+}
+
+// ResourceAttributes returns the static attributes added to the resource of every script.
+func (c *cluster) ResourceAttributes() map[string]string {
+	return c.resourceAttrs
+}
+
+// mergePairs returns the values of the worker overridden by the values of the cluster.
+func mergePairs(defaults, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(overrides))
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range overrides {
+		merged[name] = value
+	}
+	return merged
+}
@@ -2,16 +2,22 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
 )
 
 const (
+	envConfigFile        = "CONFIG_FILE"
 	envVerbose           = "VERBOSE"
 	envNROTLPHost        = "NR_OTLP_HOST"
 	envNRLicenseKEy      = "NR_LICENSE_KEY"
@@ -22,17 +28,72 @@ const (
 	envClusterName       = "CLUSTER_NAME"
 	envHttpSpanLimit     = "HTTP_SPAN_LIMIT"
 	envDbSpanLimit       = "DB_SPAN_LIMIT"
+	envSpanLimits        = "SPAN_LIMITS"
+	envScriptVariables   = "SCRIPT_VARIABLES"
+	envResourceAttrs     = "RESOURCE_ATTRIBUTES"
+	envScriptEnvPrefix   = "SCRIPT_ENV_PREFIX"
+	envDefaultSpanLimit  = "DEFAULT_SPAN_LIMIT"
+	envSpanLimitMode     = "SPAN_LIMIT_MODE"
+	envSamplePercent     = "SPAN_SAMPLE_PERCENT"
 	envCollectInterval   = "COLLECT_INTERVAL_SEC"
 	envExcludePods       = "EXCLUDE_PODS_REGEX"
 	envExcludeNamespaces = "EXCLUDE_NAMESPACES_REGEX"
+	envReconcileInterval = "RECONCILE_INTERVAL_SEC"
+	envDryRun            = "DRY_RUN"
+	envCleanup           = "CLEANUP"
+	envCleanupPlugin     = "CLEANUP_DISABLE_PLUGIN"
+	envPlanOutput        = "PLAN_OUTPUT"
+	envHTTPAddress       = "HTTP_ADDRESS"
+	envSelfTelemetry     = "SELF_TELEMETRY"
+	envAuditFile         = "AUDIT_FILE"
+	envConcurrency       = "CONCURRENCY"
+	envRetryAttempts     = "RETRY_MAX_ATTEMPTS"
+	envRetryInitial      = "RETRY_INITIAL_BACKOFF_MS"
+	envRetryMax          = "RETRY_MAX_BACKOFF_MS"
+	envRequestTimeout    = "REQUEST_TIMEOUT_SEC"
+	envRunTimeout        = "RUN_TIMEOUT_SEC"
+	envSelfTelemetryURL  = "SELF_TELEMETRY_ENDPOINT"
+	fileSuffix           = "_FILE"
+	keyLicenseKey        = "exporter.licenseKey"
+	keyPixieAPIKey       = "pixie.apiKey"
+	keyPixieClusterID    = "pixie.clusterId"
+	keyClusterName       = "worker.clusterName"
+	keyReconcileInterval = "worker.reconcileIntervalSec"
+	keyPlanOutput        = "worker.planOutput"
+	keyScripts           = "worker.scripts"
+	keyScriptVariables   = "worker.scriptVariables"
+	keyResourceAttrs     = "worker.resourceAttributes"
+	keyScriptEnvPrefix   = "worker.scriptEnvPrefix"
+	keySpanLimitMode     = "worker.spanLimitMode"
+	keySamplePercent     = "worker.spanSamplePercent"
+	keyHTTPAddress       = "worker.httpAddress"
+	keySelfTelemetryURL  = "exporter.selfTelemetryEndpoint"
+	keyConcurrency       = "worker.concurrency"
+	keyRetryAttempts     = "worker.retryMaxAttempts"
+	keyRetryInitial      = "worker.retryInitialBackoffMs"
+	keyRetryMax          = "worker.retryMaxBackoffMs"
+	keyRequestTimeout    = "worker.requestTimeoutSec"
+	keyRunTimeout        = "worker.runTimeoutSec"
 	defScriptDir         = "/scripts"
+	defScriptEnvPrefix   = "PXL_"
 	defPixieHostname     = "work.withpixie.ai:443"
 	endpointEU           = "otlp.eu01.nr-data.net:443"
 	endpointUSA          = "otlp.nr-data.net:443"
 	boolTrue             = "true"
 	defHttpSpanLimit     = 1500
 	defDbSpanLimit       = 500
+	defDefaultSpanLimit  = 1000
+	defSamplePercent     = 10
 	defCollectInterval   = 30
+	defReconcileInterval = 0
+	defConcurrency       = 4
+	defRetryAttempts     = 5
+	defRetryInitial      = 500
+	defRetryMax          = 30000
+	defRequestTimeout    = 30
+	defRunTimeout        = 0
+	PlanOutputText       = "text"
+	PlanOutputJSON       = "json"
 )
 
 var regionLicenseRegex = regexp.MustCompile(`^([a-z]{2,3})`)
@@ -54,66 +115,183 @@ func GetConfig() (Config, error) {
 }
 
 func setUpConfig() error {
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	instance = c
+	return instance.validate()
+}
+
+// GetWorkerConfig returns the worker configuration for the commands which don't connect to
+// Pixie or New Relic. Only the worker configuration is validated, so neither the license
+// key nor the Pixie API key are required.
+func GetWorkerConfig() (Worker, error) {
+	c, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.worker.validate(); err != nil {
+		return nil, fmt.Errorf("error validating worker config: %w", err)
+	}
+	return c.worker, nil
+}
+
+func newConfig() (*config, error) {
+	file, err := readConfigFile(os.Getenv(envConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	verbose := getBoolEnv(envVerbose, file.Verbose)
 	log.SetLevel(log.InfoLevel)
-	if strings.EqualFold(os.Getenv(envVerbose), boolTrue) {
+	if verbose {
 		log.SetLevel(log.DebugLevel)
 	}
-	nrHostname := os.Getenv(envNROTLPHost)
-	nrLicenseKey := os.Getenv(envNRLicenseKEy)
-	pixieClusterID := os.Getenv(envPixieClusterID)
-	pixieAPIKey := os.Getenv(envPixieAPIKey)
-	scriptDir := getEnvWithDefault(envScriptDir, defScriptDir)
-	clusterName := os.Getenv(envClusterName)
-	pixieHost := getEnvWithDefault(envPixieEndpoint, defPixieHostname)
-	excludePods := os.Getenv(envExcludePods)
-	excludeNamespaces := os.Getenv(envExcludeNamespaces)
-
-	var err error
-	httpSpanLimit, err := getIntEnvWithDefault(envHttpSpanLimit, defHttpSpanLimit)
+	nrHostname := getEnvWithDefault(envNROTLPHost, file.Exporter.Endpoint)
+	selfTelemetry := getBoolEnv(envSelfTelemetry, file.Exporter.SelfTelemetry)
+	selfTelemetryURL := getEnvWithDefault(envSelfTelemetryURL, file.Exporter.SelfTelemetryEndpoint)
+	pixieClusterID := getEnvWithDefault(envPixieClusterID, file.Pixie.ClusterID)
+	scriptDir := getEnvWithDefault(envScriptDir, stringOrDefault(file.Worker.ScriptDir, defScriptDir))
+	clusterName := getEnvWithDefault(envClusterName, file.Worker.ClusterName)
+	pixieHost := getEnvWithDefault(envPixieEndpoint, stringOrDefault(file.Pixie.Endpoint, defPixieHostname))
+	filters := getWorkerFilters(file.Worker)
+	spanLimitMode := strings.ToLower(getEnvWithDefault(envSpanLimitMode, stringOrDefault(file.Worker.SpanLimitMode, script.LimitModeHead)))
+	dryRun := getBoolEnv(envDryRun, file.Worker.DryRun)
+	cleanup := getBoolEnv(envCleanup, file.Worker.Cleanup)
+	cleanupPlugin := getBoolEnv(envCleanupPlugin, file.Worker.CleanupDisablePlugin)
+	planOutput := strings.ToLower(getEnvWithDefault(envPlanOutput, stringOrDefault(file.Worker.PlanOutput, PlanOutputText)))
+	httpAddress := getEnvWithDefault(envHTTPAddress, file.Worker.HTTPAddress)
+	auditFile := getEnvWithDefault(envAuditFile, file.Worker.AuditFile)
+	scriptEnv := getScriptEnv(getEnvWithDefault(envScriptEnvPrefix, stringOrDefault(file.Worker.ScriptEnvPrefix, defScriptEnvPrefix)))
+
+	httpSpanLimit, err := getIntEnvWithDefault(envHttpSpanLimit, intOrDefault(file.Worker.HttpSpanLimit, defHttpSpanLimit))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dbSpanLimit, err := getIntEnvWithDefault(envDbSpanLimit, defDbSpanLimit)
+	dbSpanLimit, err := getIntEnvWithDefault(envDbSpanLimit, intOrDefault(file.Worker.DbSpanLimit, defDbSpanLimit))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	collectInterval, err := getIntEnvWithDefault(envCollectInterval, defCollectInterval)
+	defaultSpanLimit, err := getIntEnvWithDefault(envDefaultSpanLimit, intOrDefault(file.Worker.DefaultSpanLimit, defDefaultSpanLimit))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	spanLimits, err := getSpanLimitsEnv(envSpanLimits, file.Worker.SpanLimits)
+	if err != nil {
+		return nil, err
+	}
+	scriptVariables, err := getPairsEnv(envScriptVariables, file.Worker.ScriptVariables)
+	if err != nil {
+		return nil, err
+	}
+	resourceAttributes, err := getPairsEnv(envResourceAttrs, file.Worker.ResourceAttributes)
+	if err != nil {
+		return nil, err
+	}
+	samplePercent, err := getIntEnvWithDefault(envSamplePercent, intOrDefault(file.Worker.SpanSamplePercent, defSamplePercent))
+	if err != nil {
+		return nil, err
+	}
+	collectInterval, err := getIntEnvWithDefault(envCollectInterval, intOrDefault(file.Worker.CollectIntervalSec, defCollectInterval))
+	if err != nil {
+		return nil, err
+	}
+	reconcileInterval, err := getIntEnvWithDefault(envReconcileInterval, intOrDefault(file.Worker.ReconcileIntervalSec, defReconcileInterval))
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := getIntEnvWithDefault(envConcurrency, intOrDefault(file.Worker.Concurrency, defConcurrency))
+	if err != nil {
+		return nil, err
+	}
+	retryAttempts, err := getIntEnvWithDefault(envRetryAttempts, intOrDefault(file.Worker.RetryMaxAttempts, defRetryAttempts))
+	if err != nil {
+		return nil, err
+	}
+	retryInitial, err := getIntEnvWithDefault(envRetryInitial, intOrDefault(file.Worker.RetryInitialBackoffMs, defRetryInitial))
+	if err != nil {
+		return nil, err
+	}
+	retryMax, err := getIntEnvWithDefault(envRetryMax, intOrDefault(file.Worker.RetryMaxBackoffMs, defRetryMax))
+	if err != nil {
+		return nil, err
+	}
+	requestTimeout, err := getIntEnvWithDefault(envRequestTimeout, intOrDefault(file.Worker.RequestTimeoutSec, defRequestTimeout))
+	if err != nil {
+		return nil, err
+	}
+	runTimeout, err := getIntEnvWithDefault(envRunTimeout, intOrDefault(file.Worker.RunTimeoutSec, defRunTimeout))
+	if err != nil {
+		return nil, err
 	}
 
-	nrHostname = getEndpoint(nrHostname, nrLicenseKey)
+	nrLicenseKey, err := getSecretEnv(envNRLicenseKEy, keyLicenseKey, file.Exporter.LicenseKey, file.Exporter.LicenseKeyFile)
 	if err != nil {
-		return fmt.Errorf("error getting endpoint for license: %w", err)
+		return nil, err
 	}
-	instance = &config{
-		settings: &settings{
-			buildDate: buildDate,
-			commit:    gitCommit,
-			version:   integrationVersion,
-		},
+	pixieAPIKey, err := getSecretEnv(envPixieAPIKey, keyPixieAPIKey, file.Pixie.APIKey, file.Pixie.APIKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region is only known when the license key can be read. Validation reports the error otherwise.
+	licenseKey, _ := nrLicenseKey.load()
+	nrHostname = getEndpoint(nrHostname, licenseKey)
+	return &config{
+		verbose:  verbose,
+		settings: BuildSettings(),
 		worker: &worker{
 			scriptDir:         scriptDir,
 			clusterName:       clusterName,
 			pixieClusterID:    pixieClusterID,
 			httpSpanLimit:     httpSpanLimit,
 			dbSpanLimit:       dbSpanLimit,
+			spanLimits:        spanLimits,
+			defaultSpanLimit:  defaultSpanLimit,
+			spanLimitMode:     spanLimitMode,
+			samplePercent:     samplePercent,
 			collectInterval:   collectInterval,
-			excludePods:       excludePods,
-			excludeNamespaces: excludeNamespaces,
+			reconcileInterval: reconcileInterval,
+			filters:           filters,
+			scriptOverrides:   file.Worker.Scripts,
+			scriptEnv:         scriptEnv,
+			clusters: getClusters(file.Worker.Clusters, &cluster{
+				name:             clusterName,
+				id:               pixieClusterID,
+				httpSpanLimit:    httpSpanLimit,
+				dbSpanLimit:      dbSpanLimit,
+				spanLimits:       spanLimits,
+				defaultSpanLimit: defaultSpanLimit,
+				filters:          filters,
+				scriptVariables:  scriptVariables,
+				resourceAttrs:    resourceAttributes,
+			}),
+			dryRun:         dryRun,
+			cleanup:        cleanup,
+			cleanupPlugin:  cleanupPlugin,
+			planOutput:     planOutput,
+			httpAddress:    httpAddress,
+			auditFile:      auditFile,
+			concurrency:    concurrency,
+			retryAttempts:  retryAttempts,
+			retryInitial:   retryInitial,
+			retryMax:       retryMax,
+			requestTimeout: requestTimeout,
+			runTimeout:     runTimeout,
 		},
 		exporter: &exporter{
-			licenseKey: nrLicenseKey,
-			endpoint:   nrHostname,
-			userAgent:  "pixie/" + integrationVersion,
+			licenseKey:       nrLicenseKey,
+			endpoint:         nrHostname,
+			userAgent:        "pixie/" + integrationVersion,
+			selfTelemetry:    selfTelemetry,
+			selfTelemetryURL: selfTelemetryURL,
 		},
 		pixie: &pixie{
 			apiKey:    pixieAPIKey,
 			clusterID: pixieClusterID,
 			host:      pixieHost,
 		},
-	}
-	return instance.validate()
+	}, nil
 }
 
 func getEnvWithDefault(key, defaultValue string) string {
@@ -124,6 +302,79 @@ func getEnvWithDefault(key, defaultValue string) string {
 	return value
 }
 
+// getSpanLimitsEnv returns the span limits of the config file overridden by the env
+// variable, which holds comma separated protocol=limit pairs, eg. "redis=500,kafka=200".
+func getSpanLimitsEnv(key string, fileValue map[string]int64) (map[string]int64, error) {
+	limits := make(map[string]int64, len(fileValue))
+	for protocol, limit := range fileValue {
+		limits[strings.ToLower(protocol)] = limit
+	}
+	value := os.Getenv(key)
+	if value == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		protocol, limit, found := strings.Cut(pair, "=")
+		i, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+		if !found || strings.TrimSpace(protocol) == "" || err != nil {
+			return nil, fmt.Errorf("Environment variable %s must hold protocol=limit pairs, got '%s'.", key, pair)
+		}
+		limits[strings.ToLower(strings.TrimSpace(protocol))] = i
+	}
+	return limits, nil
+}
+
+// getPairsEnv returns the values of the config file overridden by the env variable, which
+// holds comma separated name=value pairs, eg. "region=eu,team=payments".
+func getPairsEnv(key string, fileValue map[string]string) (map[string]string, error) {
+	variables := make(map[string]string, len(fileValue))
+	for name, value := range fileValue {
+		variables[name] = value
+	}
+	value := os.Getenv(key)
+	if value == "" {
+		return variables, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("Environment variable %s must hold name=value pairs, got '%s'.", key, pair)
+		}
+		variables[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return variables, nil
+}
+
+// getScriptEnv returns the env variables with the prefix, which custom scripts can expand.
+// The secrets and the _FILE variables are never exposed, whatever the prefix.
+func getScriptEnv(prefix string) map[string]string {
+	env := make(map[string]string)
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, prefix) || name == envNRLicenseKEy || name == envPixieAPIKey || strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		env[name] = value
+	}
+	return env
+}
+
+// setting describes a configuration value by its env variable and config file key.
+func setting(env, key string) string {
+	return fmt.Sprintf("env variable '%s' (config key '%s')", env, key)
+}
+
+// getSecretEnv reads a secret from the env variable or from the file referenced by the
+// env variable with the _FILE suffix. Env variables override the config file values.
+func getSecretEnv(env, key, fileValue, filePath string) (*secret, error) {
+	value := os.Getenv(env)
+	path := os.Getenv(env + fileSuffix)
+	if value == "" && path == "" {
+		value, path = fileValue, filePath
+	}
+	return newSecret(value, path, env, key)
+}
+
 func getIntEnvWithDefault(key string, defaultValue int64) (int64, error) {
 	value := os.Getenv(key)
 	if value == "" {
@@ -189,6 +440,16 @@ type Settings interface {
 	BuildDate() string
 }
 
+// BuildSettings returns the build information of the integration, which is available
+// without a valid configuration.
+func BuildSettings() Settings {
+	return &settings{
+		buildDate: buildDate,
+		commit:    gitCommit,
+		version:   integrationVersion,
+	}
+}
+
 type settings struct {
 	buildDate string
 	commit    string
@@ -211,24 +472,38 @@ type Exporter interface {
 	LicenseKey() string
 	Endpoint() string
 	UserAgent() string
+	SelfTelemetry() bool
+	SelfTelemetryURL() string
 	validate() error
 }
 
 type exporter struct {
-	licenseKey string
-	endpoint   string
-	userAgent  string
+	licenseKey       *secret
+	endpoint         string
+	userAgent        string
+	selfTelemetry    bool
+	selfTelemetryURL string
 }
 
 func (e *exporter) validate() error {
-	if e.licenseKey == "" {
-		return fmt.Errorf("missing required env variable '%s", envNRLicenseKEy)
+	if !e.licenseKey.isSet() {
+		return fmt.Errorf("missing required %s or %s", setting(envNRLicenseKEy, keyLicenseKey), setting(envNRLicenseKEy+fileSuffix, keyLicenseKey+"File"))
+	}
+	if _, err := e.licenseKey.load(); err != nil {
+		return fmt.Errorf("invalid %s: %w", setting(envNRLicenseKEy+fileSuffix, keyLicenseKey+"File"), err)
+	}
+	if e.selfTelemetryURL != "" {
+		u, err := url.Parse(e.selfTelemetryURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http or https URL", setting(envSelfTelemetryURL, keySelfTelemetryURL))
+		}
 	}
 	return nil
 }
 
+// LicenseKey returns the license key. When it's read from a file, the file is read on every call.
 func (e *exporter) LicenseKey() string {
-	return e.licenseKey
+	return e.licenseKey.get()
 }
 
 func (e *exporter) Endpoint() string {
@@ -239,6 +514,20 @@ func (e *exporter) UserAgent() string {
 	return e.userAgent
 }
 
+// SelfTelemetry returns true when the integration should send its own metrics and logs.
+func (e *exporter) SelfTelemetry() bool {
+	return e.selfTelemetry
+}
+
+// SelfTelemetryURL returns the base URL of the OTLP/HTTP endpoint receiving the
+// integration's own telemetry, which defaults to the New Relic OTLP endpoint.
+func (e *exporter) SelfTelemetryURL() string {
+	if e.selfTelemetryURL != "" {
+		return strings.TrimSuffix(e.selfTelemetryURL, "/")
+	}
+	return "https://" + e.endpoint
+}
+
 type Pixie interface {
 	APIKey() string
 	ClusterID() string
@@ -247,23 +536,24 @@ type Pixie interface {
 }
 
 type pixie struct {
-	apiKey    string
+	apiKey    *secret
 	clusterID string
 	host      string
 }
 
 func (p *pixie) validate() error {
-	if p.apiKey == "" {
-		return fmt.Errorf("missing required env variable '%s", envPixieAPIKey)
+	if !p.apiKey.isSet() {
+		return fmt.Errorf("missing required %s or %s", setting(envPixieAPIKey, keyPixieAPIKey), setting(envPixieAPIKey+fileSuffix, keyPixieAPIKey+"File"))
 	}
-	if p.clusterID == "" {
-		return fmt.Errorf("missing required env variable '%s", envPixieClusterID)
+	if _, err := p.apiKey.load(); err != nil {
+		return fmt.Errorf("invalid %s: %w", setting(envPixieAPIKey+fileSuffix, keyPixieAPIKey+"File"), err)
 	}
 	return nil
 }
 
+// APIKey returns the Pixie API key. When it's read from a file, the file is read on every call.
 func (p *pixie) APIKey() string {
-	return p.apiKey
+	return p.apiKey.get()
 }
 
 func (p *pixie) ClusterID() string {
@@ -280,9 +570,30 @@ type Worker interface {
 	PixieClusterID() string
 	HttpSpanLimit() int64
 	DbSpanLimit() int64
+	SpanLimits() map[string]int64
+	DefaultSpanLimit() int64
+	SpanLimitMode() string
+	SamplePercent() int64
 	CollectInterval() int64
+	ReconcileInterval() int64
 	ExcludePods() string
 	ExcludeNamespaces() string
+	Filters() script.Filters
+	ScriptOverrides() map[string]script.ScriptOverride
+	ScriptEnv() map[string]string
+	Clusters() []Cluster
+	DryRun() bool
+	Cleanup() bool
+	CleanupDisablePlugin() bool
+	PlanOutput() string
+	HTTPAddress() string
+	AuditFile() string
+	Concurrency() int
+	RetryMaxAttempts() int
+	RetryInitialBackoff() time.Duration
+	RetryMaxBackoff() time.Duration
+	RequestTimeout() time.Duration
+	RunTimeout() time.Duration
 	validate() error
 }
 
@@ -292,14 +603,73 @@ type worker struct {
 	pixieClusterID    string
 	httpSpanLimit     int64
 	dbSpanLimit       int64
+	spanLimits        map[string]int64
+	defaultSpanLimit  int64
+	spanLimitMode     string
+	samplePercent     int64
 	collectInterval   int64
-	excludePods       string
-	excludeNamespaces string
+	reconcileInterval int64
+	filters           script.Filters
+	scriptOverrides   map[string]script.ScriptOverride
+	scriptEnv         map[string]string
+	clusters          []*cluster
+	dryRun            bool
+	cleanup           bool
+	cleanupPlugin     bool
+	planOutput        string
+	httpAddress       string
+	auditFile         string
+	concurrency       int64
+	retryAttempts     int64
+	retryInitial      int64
+	retryMax          int64
+	requestTimeout    int64
+	runTimeout        int64
 }
 
 func (a *worker) validate() error {
-	if a.clusterName == "" {
-		return fmt.Errorf("missing required env variable '%s", envClusterName)
+	if err := validateClusters(a.clusters); err != nil {
+		return err
+	}
+	if !script.IsLimitMode(a.spanLimitMode) {
+		return fmt.Errorf("%s must be either '%s' or '%s'", setting(envSpanLimitMode, keySpanLimitMode), script.LimitModeHead, script.LimitModeSample)
+	}
+	if a.samplePercent < 1 || a.samplePercent > 100 {
+		return fmt.Errorf("%s must be between 1 and 100", setting(envSamplePercent, keySamplePercent))
+	}
+	for name, override := range a.scriptOverrides {
+		if err := override.Validate(); err != nil {
+			return fmt.Errorf("invalid script override (config key '%s.%s'): %w", keyScripts, name, err)
+		}
+	}
+	if a.concurrency < 1 {
+		return fmt.Errorf("%s must be positive", setting(envConcurrency, keyConcurrency))
+	}
+	if a.retryAttempts < 1 {
+		return fmt.Errorf("%s must be positive", setting(envRetryAttempts, keyRetryAttempts))
+	}
+	if a.retryInitial < 0 {
+		return fmt.Errorf("%s must not be negative", setting(envRetryInitial, keyRetryInitial))
+	}
+	if a.retryMax < a.retryInitial {
+		return fmt.Errorf("%s must not be lower than the initial backoff", setting(envRetryMax, keyRetryMax))
+	}
+	if a.requestTimeout < 0 {
+		return fmt.Errorf("%s must not be negative", setting(envRequestTimeout, keyRequestTimeout))
+	}
+	if a.runTimeout < 0 {
+		return fmt.Errorf("%s must not be negative", setting(envRunTimeout, keyRunTimeout))
+	}
+	if a.reconcileInterval < 0 {
+		return fmt.Errorf("%s must not be negative", setting(envReconcileInterval, keyReconcileInterval))
+	}
+	if a.planOutput != PlanOutputText && a.planOutput != PlanOutputJSON {
+		return fmt.Errorf("%s must be either '%s' or '%s'", setting(envPlanOutput, keyPlanOutput), PlanOutputText, PlanOutputJSON)
+	}
+	if a.httpAddress != "" {
+		if _, _, err := net.SplitHostPort(a.httpAddress); err != nil {
+			return fmt.Errorf("%s is not a valid address: %w", setting(envHTTPAddress, keyHTTPAddress), err)
+		}
 	}
 	return nil
 }
@@ -324,16 +694,127 @@ func (a *worker) DbSpanLimit() int64 {
 	return a.dbSpanLimit
 }
 
+// SpanLimits returns the row limits of span scripts keyed by lowercase protocol.
+func (a *worker) SpanLimits() map[string]int64 {
+	return a.spanLimits
+}
+
+// DefaultSpanLimit returns the row limit of span scripts of protocols without a limit.
+func (a *worker) DefaultSpanLimit() int64 {
+	return a.defaultSpanLimit
+}
+
+// SpanLimitMode returns how span limits are applied: head or sample.
+func (a *worker) SpanLimitMode() string {
+	return a.spanLimitMode
+}
+
+// SamplePercent returns the percentage of the remaining spans kept by the sample mode.
+func (a *worker) SamplePercent() int64 {
+	return a.samplePercent
+}
+
 func (a *worker) CollectInterval() int64 {
 	return a.collectInterval
 }
 
+// ReconcileInterval returns the number of seconds between reconcile passes.
+// Zero means the integration reconciles once and exits.
+func (a *worker) ReconcileInterval() int64 {
+	return a.reconcileInterval
+}
+
 func (a *worker) ExcludePods() string {
-	return a.excludePods
+	return a.filters[script.FilterPod].Exclude
 }
 
 func (a *worker) ExcludeNamespaces() string {
-	return a.excludeNamespaces
+	return a.filters[script.FilterNamespace].Exclude
+}
+
+func (a *worker) Filters() script.Filters {
+	return a.filters
+}
+
+// ScriptOverrides returns the per script settings keyed by script name.
+func (a *worker) ScriptOverrides() map[string]script.ScriptOverride {
+	return a.scriptOverrides
+}
+
+// ScriptEnv returns the env variables custom scripts can expand, eg. {{ .Env.PXL_REGION }}.
+func (a *worker) ScriptEnv() map[string]string {
+	return a.scriptEnv
+}
+
+// Clusters returns the clusters to reconcile. Without clusters in the config file this
+// is the single cluster defined by CLUSTER_NAME and PIXIE_CLUSTER_ID.
+func (a *worker) Clusters() []Cluster {
+	clusters := make([]Cluster, 0, len(a.clusters))
+	for _, c := range a.clusters {
+		clusters = append(clusters, c)
+	}
+	return clusters
+}
+
+// DryRun returns true when the integration should only print the plan without mutating Pixie.
+func (a *worker) DryRun() bool {
+	return a.dryRun
+}
+
+// Cleanup returns true when the integration should delete the scripts it created instead
+// of reconciling them.
+func (a *worker) Cleanup() bool {
+	return a.cleanup
+}
+
+// CleanupDisablePlugin returns true when the cleanup should also disable the New Relic plugin.
+func (a *worker) CleanupDisablePlugin() bool {
+	return a.cleanupPlugin
+}
+
+func (a *worker) PlanOutput() string {
+	return a.planOutput
+}
+
+// HTTPAddress returns the listen address of the health and status server, eg. ":8080".
+// The server is disabled when the address is empty.
+func (a *worker) HTTPAddress() string {
+	return a.httpAddress
+}
+
+// AuditFile returns the path of the file the script changes are appended to, if any.
+func (a *worker) AuditFile() string {
+	return a.auditFile
+}
+
+// Concurrency returns the maximum number of concurrent requests to the Pixie API.
+func (a *worker) Concurrency() int {
+	return int(a.concurrency)
+}
+
+// RetryMaxAttempts returns the maximum number of attempts of a Pixie API request.
+func (a *worker) RetryMaxAttempts() int {
+	return int(a.retryAttempts)
+}
+
+// RetryInitialBackoff returns the wait before the first retry of a Pixie API request.
+func (a *worker) RetryInitialBackoff() time.Duration {
+	return time.Duration(a.retryInitial) * time.Millisecond
+}
+
+// RetryMaxBackoff returns the maximum wait between two attempts of a Pixie API request.
+func (a *worker) RetryMaxBackoff() time.Duration {
+	return time.Duration(a.retryMax) * time.Millisecond
+}
+
+// RequestTimeout returns the deadline of every attempt of a Pixie API request, 0 for none.
+func (a *worker) RequestTimeout() time.Duration {
+	return time.Duration(a.requestTimeout) * time.Second
+}
+
+// RunTimeout returns the deadline of a reconcile pass, 0 for none.
+func (a *worker) RunTimeout() time.Duration {
+	return time.Duration(a.runTimeout) * time.Second
 }
 
 func getEndpoint(hostname, licenseKey string) string {
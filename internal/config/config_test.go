@@ -1,9 +1,16 @@
 package config
 
 import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
 )
 
 func TestGetEndpoint(t *testing.T) {
@@ -11,3 +18,397 @@ func TestGetEndpoint(t *testing.T) {
 	assert.Equal(t, endpointUSA, getEndpoint("", "anything"))
 	assert.Equal(t, endpointEU, getEndpoint("", "eu01-xxxx"))
 }
+
+func TestReadConfigFile(t *testing.T) {
+	fc, err := readConfigFile("")
+	assert.NoError(t, err)
+	assert.Equal(t, &fileConfig{}, fc)
+
+	fc, err = readConfigFile("testdata/config.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "file-cluster", fc.Worker.ClusterName)
+	assert.Equal(t, int64(100), *fc.Worker.HttpSpanLimit)
+	assert.Nil(t, fc.Worker.DbSpanLimit)
+
+	fc, err = readConfigFile("testdata/config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "file-cluster", fc.Worker.ClusterName)
+	assert.Equal(t, int64(10), *fc.Worker.DbSpanLimit)
+
+	_, err = readConfigFile("testdata/unknown-key.yaml")
+	assert.ErrorContains(t, err, "line 3: field httpSpanLimits not found")
+
+	_, err = readConfigFile("testdata/invalid-type.json")
+	assert.ErrorContains(t, err, "key 'worker.httpSpanLimit' (line 3): cannot use string as int64")
+}
+
+func TestSetUpConfigFromFile(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	t.Setenv(envClusterName, "env-cluster")
+	t.Setenv(envCollectInterval, "10")
+	assert.NoError(t, setUpConfig())
+
+	assert.True(t, instance.Verbose())
+	assert.Equal(t, "eu01xxlicense", instance.Exporter().LicenseKey())
+	assert.Equal(t, endpointEU, instance.Exporter().Endpoint())
+	assert.Equal(t, "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484", instance.Pixie().ClusterID())
+	assert.Equal(t, defPixieHostname, instance.Pixie().Host())
+	assert.Equal(t, "env-cluster", instance.Worker().ClusterName())
+	assert.Equal(t, "/custom-scripts", instance.Worker().ScriptDir())
+	assert.Equal(t, int64(100), instance.Worker().HttpSpanLimit())
+	assert.Equal(t, int64(defDbSpanLimit), instance.Worker().DbSpanLimit())
+	assert.Equal(t, int64(10), instance.Worker().CollectInterval())
+	assert.Equal(t, "kube-.*", instance.Worker().ExcludeNamespaces())
+
+	t.Setenv(envNRLicenseKEy, "")
+	t.Setenv(envConfigFile, "testdata/unknown-key.yaml")
+	assert.Error(t, setUpConfig())
+
+	t.Setenv(envConfigFile, "")
+	assert.EqualError(t, setUpConfig(), "error validating pixie config: missing required env variable 'PIXIE_API_KEY' (config key 'pixie.apiKey') or env variable 'PIXIE_API_KEY_FILE' (config key 'pixie.apiKeyFile')")
+}
+
+func TestSecretsFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	licenseKeyFile := filepath.Join(dir, "license-key")
+	apiKeyFile := filepath.Join(dir, "api-key")
+	assert.NoError(t, os.WriteFile(licenseKeyFile, []byte("eu01xxlicense\n"), 0600))
+	assert.NoError(t, os.WriteFile(apiKeyFile, []byte("  px-api-key  "), 0600))
+
+	t.Setenv(envNRLicenseKEy+fileSuffix, licenseKeyFile)
+	t.Setenv(envPixieAPIKey+fileSuffix, apiKeyFile)
+	t.Setenv(envPixieClusterID, "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484")
+	t.Setenv(envClusterName, "test-cluster")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, "eu01xxlicense", instance.Exporter().LicenseKey())
+	assert.Equal(t, endpointEU, instance.Exporter().Endpoint())
+	assert.Equal(t, "px-api-key", instance.Pixie().APIKey())
+
+	// rotated secrets are picked up, unreadable secrets keep the last known value
+	assert.NoError(t, os.WriteFile(licenseKeyFile, []byte("eu01rotated"), 0600))
+	assert.Equal(t, "eu01rotated", instance.Exporter().LicenseKey())
+	assert.NoError(t, os.Remove(licenseKeyFile))
+	assert.Equal(t, "eu01rotated", instance.Exporter().LicenseKey())
+
+	assert.EqualError(t, setUpConfig(), "invalid env variable 'NR_LICENSE_KEY_FILE' (config key 'exporter.licenseKeyFile'): error reading secret file: open "+licenseKeyFile+": no such file or directory")
+
+	assert.NoError(t, os.WriteFile(licenseKeyFile, []byte("\n"), 0600))
+	assert.EqualError(t, setUpConfig(), "invalid env variable 'NR_LICENSE_KEY_FILE' (config key 'exporter.licenseKeyFile'): secret file "+licenseKeyFile+" is empty")
+
+	t.Setenv(envPixieAPIKey, "px-api-key")
+	assert.EqualError(t, setUpConfig(), "only one of env variable 'PIXIE_API_KEY' (config key 'pixie.apiKey') and env variable 'PIXIE_API_KEY_FILE' (config key 'pixie.apiKeyFile') can be set")
+}
+
+func TestClusters(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/clusters.yaml")
+	assert.NoError(t, setUpConfig())
+	clusters := instance.Worker().Clusters()
+	assert.Equal(t, 2, len(clusters))
+	assert.Equal(t, "prod", clusters[0].Name())
+	assert.Equal(t, "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484", clusters[0].ID())
+	assert.Equal(t, int64(100), clusters[0].HttpSpanLimit())
+	assert.Equal(t, int64(defDbSpanLimit), clusters[0].DbSpanLimit())
+	assert.Equal(t, ".*-canary", clusters[0].ExcludePods())
+	assert.Equal(t, "staging", clusters[1].Name())
+	assert.Equal(t, int64(10), clusters[1].HttpSpanLimit())
+	assert.Equal(t, "", clusters[1].ExcludePods())
+
+	// Without clusters in the config file, the cluster is defined by the env variables
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	clusters = instance.Worker().Clusters()
+	assert.Equal(t, 1, len(clusters))
+	assert.Equal(t, "file-cluster", clusters[0].Name())
+	assert.Equal(t, "kube-.*", clusters[0].ExcludeNamespaces())
+}
+
+func TestValidateClusters(t *testing.T) {
+	assert.EqualError(t, validateClusters([]*cluster{{name: "prod"}}), "missing required env variable 'PIXIE_CLUSTER_ID' (config key 'pixie.clusterId')")
+	assert.EqualError(t, validateClusters([]*cluster{{key: "worker.clusters[0]", id: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"}}), "missing required config key 'worker.clusters[0].name'")
+	assert.EqualError(t, validateClusters([]*cluster{
+		{key: "worker.clusters[0]", name: "prod", id: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"},
+		{key: "worker.clusters[1]", name: "eu-prod", id: "b8749d5b-3352-4a0c-92ef-4a1479464b74"},
+	}), "worker.clusters[1]: cluster names prod and eu-prod are ambiguous")
+	assert.EqualError(t, validateClusters([]*cluster{
+		{key: "worker.clusters[0]", name: "prod", id: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"},
+		{key: "worker.clusters[1]", name: "staging", id: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"},
+	}), "worker.clusters[1]: cluster id 91cb2c1d-e6fd-4fb9-9d2f-8358895bf484 is used by more than one cluster")
+	assert.NoError(t, validateClusters([]*cluster{
+		{key: "worker.clusters[0]", name: "prod", id: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"},
+		{key: "worker.clusters[1]", name: "staging", id: "b8749d5b-3352-4a0c-92ef-4a1479464b74"},
+	}))
+}
+
+func TestFilters(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/filters.yaml")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: invalid filters (config key 'worker.clusters[1].filters'): unknown filter dimension 'label', must be one of [namespace pod service node container]")
+
+	fc, err := readConfigFile("testdata/filters.yaml")
+	assert.NoError(t, err)
+	delete(fc.Worker.Clusters[1].Filters, "label")
+	t.Setenv("EXCLUDE_NODES_REGEX", "node-1")
+	t.Setenv("INCLUDE_SERVICES_REGEX", "shop/.*")
+	filters := getWorkerFilters(fc.Worker)
+	assert.Equal(t, script.Filters{
+		script.FilterNamespace: {Include: "team-.*"},
+		script.FilterPod:       {Exclude: ".*-canary"},
+		script.FilterService:   {Include: "shop/.*", Exclude: ".*/internal-.*"},
+		script.FilterNode:      {Exclude: "node-1"},
+	}, filters)
+
+	clusters := getClusters(fc.Worker.Clusters, &cluster{filters: filters})
+	assert.Equal(t, filters, clusters[0].Filters())
+	assert.Equal(t, script.Filter{Exclude: "kube-.*"}, clusters[1].Filters()[script.FilterNamespace])
+	assert.Equal(t, "kube-.*", clusters[1].ExcludeNamespaces())
+	assert.Equal(t, ".*-canary", clusters[1].ExcludePods())
+	assert.NoError(t, validateClusters(clusters))
+
+	clusters[0].filters[script.FilterPod] = script.Filter{Include: "a("}
+	assert.ErrorContains(t, validateClusters(clusters), "invalid filters (config key 'worker.clusters[0].filters'): invalid include regex for pod")
+}
+
+func TestScriptOverrides(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/scripts.yaml")
+	assert.NoError(t, setUpConfig())
+	overrides := instance.Worker().ScriptOverrides()
+	assert.Equal(t, 4, len(overrides))
+	assert.Equal(t, int64(60), *overrides["JVM Metrics"].FrequencyS)
+	assert.False(t, *overrides["MySQL Spans"].Enabled)
+	assert.Equal(t, int64(200), *overrides["HTTP Spans"].Limit)
+	assert.Equal(t, ".*/healthz", overrides["HTTP Spans"].Filters[script.FilterService].Exclude)
+
+	frequency := int64(-1)
+	w := instance.Worker().(*worker)
+	w.scriptOverrides["JVM Metrics"] = script.ScriptOverride{FrequencyS: &frequency}
+	assert.EqualError(t, w.validate(), "invalid script override (config key 'worker.scripts.JVM Metrics'): frequencyS must be positive, use enabled: false to disable the script")
+}
+
+func TestSpanLimits(t *testing.T) {
+	limits, err := getSpanLimitsEnv(envSpanLimits, map[string]int64{"Redis": 100, "kafka": 50})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"redis": 100, "kafka": 50}, limits)
+
+	t.Setenv(envSpanLimits, "redis=500, DNS=0")
+	limits, err = getSpanLimitsEnv(envSpanLimits, map[string]int64{"redis": 100, "kafka": 50})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"redis": 500, "kafka": 50, "dns": 0}, limits)
+
+	t.Setenv(envSpanLimits, "redis")
+	_, err = getSpanLimitsEnv(envSpanLimits, nil)
+	assert.EqualError(t, err, "Environment variable SPAN_LIMITS must hold protocol=limit pairs, got 'redis'.")
+
+	clusters := getClusters([]fileCluster{{Name: "prod", SpanLimits: map[string]int64{"Kafka": 10}}}, &cluster{
+		spanLimits:       map[string]int64{"redis": 500},
+		defaultSpanLimit: defDefaultSpanLimit,
+	})
+	assert.Equal(t, map[string]int64{"redis": 500, "kafka": 10}, clusters[0].SpanLimits())
+	assert.Equal(t, int64(defDefaultSpanLimit), clusters[0].DefaultSpanLimit())
+}
+
+func TestSpanLimitMode(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, script.LimitModeHead, instance.Worker().SpanLimitMode())
+	assert.Equal(t, int64(defSamplePercent), instance.Worker().SamplePercent())
+
+	t.Setenv(envSpanLimitMode, "Sample")
+	t.Setenv(envSamplePercent, "25")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, script.LimitModeSample, instance.Worker().SpanLimitMode())
+	assert.Equal(t, int64(25), instance.Worker().SamplePercent())
+
+	t.Setenv(envSamplePercent, "0")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'SPAN_SAMPLE_PERCENT' (config key 'worker.spanSamplePercent') must be between 1 and 100")
+
+	t.Setenv(envSpanLimitMode, "random")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'SPAN_LIMIT_MODE' (config key 'worker.spanLimitMode') must be either 'head' or 'sample'")
+}
+
+func TestHTTPAddress(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, "", instance.Worker().HTTPAddress())
+
+	t.Setenv(envHTTPAddress, ":8080")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, ":8080", instance.Worker().HTTPAddress())
+
+	t.Setenv(envHTTPAddress, "8080")
+	assert.ErrorContains(t, setUpConfig(), "env variable 'HTTP_ADDRESS' (config key 'worker.httpAddress') is not a valid address")
+}
+
+func TestSelfTelemetry(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.False(t, instance.Exporter().SelfTelemetry())
+	assert.Equal(t, "https://"+instance.Exporter().Endpoint(), instance.Exporter().SelfTelemetryURL())
+
+	t.Setenv(envSelfTelemetry, "true")
+	t.Setenv(envSelfTelemetryURL, "http://localhost:4318/")
+	assert.NoError(t, setUpConfig())
+	assert.True(t, instance.Exporter().SelfTelemetry())
+	assert.Equal(t, "http://localhost:4318", instance.Exporter().SelfTelemetryURL())
+
+	t.Setenv(envSelfTelemetryURL, "localhost:4318")
+	assert.EqualError(t, setUpConfig(), "env variable 'SELF_TELEMETRY_ENDPOINT' (config key 'exporter.selfTelemetryEndpoint') must be an http or https URL")
+}
+
+func TestConcurrency(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, defConcurrency, instance.Worker().Concurrency())
+
+	t.Setenv(envConcurrency, "8")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, 8, instance.Worker().Concurrency())
+
+	t.Setenv(envConcurrency, "0")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'CONCURRENCY' (config key 'worker.concurrency') must be positive")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, defRetryAttempts, instance.Worker().RetryMaxAttempts())
+	assert.Equal(t, 500*time.Millisecond, instance.Worker().RetryInitialBackoff())
+	assert.Equal(t, 30*time.Second, instance.Worker().RetryMaxBackoff())
+
+	t.Setenv(envRetryAttempts, "1")
+	t.Setenv(envRetryInitial, "100")
+	t.Setenv(envRetryMax, "1000")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, 1, instance.Worker().RetryMaxAttempts())
+	assert.Equal(t, 100*time.Millisecond, instance.Worker().RetryInitialBackoff())
+	assert.Equal(t, time.Second, instance.Worker().RetryMaxBackoff())
+
+	t.Setenv(envRetryMax, "10")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'RETRY_MAX_BACKOFF_MS' (config key 'worker.retryMaxBackoffMs') must not be lower than the initial backoff")
+
+	t.Setenv(envRetryAttempts, "0")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'RETRY_MAX_ATTEMPTS' (config key 'worker.retryMaxAttempts') must be positive")
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, 30*time.Second, instance.Worker().RequestTimeout())
+	assert.Equal(t, time.Duration(0), instance.Worker().RunTimeout())
+
+	t.Setenv(envRequestTimeout, "5")
+	t.Setenv(envRunTimeout, "600")
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, 5*time.Second, instance.Worker().RequestTimeout())
+	assert.Equal(t, 10*time.Minute, instance.Worker().RunTimeout())
+
+	t.Setenv(envRunTimeout, "-1")
+	assert.EqualError(t, setUpConfig(), "error validating worker config: env variable 'RUN_TIMEOUT_SEC' (config key 'worker.runTimeoutSec') must not be negative")
+}
+
+func TestCleanup(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	assert.NoError(t, setUpConfig())
+	assert.False(t, instance.Worker().Cleanup())
+	assert.False(t, instance.Worker().CleanupDisablePlugin())
+
+	t.Setenv(envCleanup, "true")
+	t.Setenv(envCleanupPlugin, "true")
+	assert.NoError(t, setUpConfig())
+	assert.True(t, instance.Worker().Cleanup())
+	assert.True(t, instance.Worker().CleanupDisablePlugin())
+}
+
+func TestRegisterFlags(t *testing.T) {
+	t.Setenv(envConfigFile, "testdata/config.yaml")
+	t.Setenv(envConcurrency, "")
+	t.Setenv(envDryRun, "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"-concurrency", "8", "-dry-run", "extra"}))
+	assert.Equal(t, []string{"extra"}, fs.Args())
+	assert.NoError(t, setUpConfig())
+	assert.Equal(t, 8, instance.Worker().Concurrency())
+	assert.True(t, instance.Worker().DryRun())
+
+	assert.Error(t, fs.Parse([]string{"-unknown"}))
+	assert.Nil(t, fs.Lookup(flagName(envPixieAPIKey)))
+	assert.Nil(t, fs.Lookup(flagName(envNRLicenseKEy)))
+	assert.NotNil(t, fs.Lookup(flagName(envPixieAPIKey+fileSuffix)))
+}
+
+func TestGetWorkerConfig(t *testing.T) {
+	t.Setenv(envConfigFile, "")
+	t.Setenv(envNRLicenseKEy, "")
+	t.Setenv(envPixieAPIKey, "")
+	t.Setenv(envClusterName, "my-cluster")
+	t.Setenv(envPixieClusterID, "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484")
+	assert.Error(t, setUpConfig())
+
+	worker, err := GetWorkerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "my-cluster", worker.Clusters()[0].Name())
+
+	t.Setenv(envClusterName, "")
+	_, err = GetWorkerConfig()
+	assert.EqualError(t, err, "error validating worker config: missing required env variable 'CLUSTER_NAME' (config key 'worker.clusterName')")
+}
+
+func TestReadScriptDefinitions(t *testing.T) {
+	definitions, err := ReadScriptDefinitions("testdata/definitions")
+	assert.NoError(t, err)
+	assert.Len(t, definitions, 1)
+	assert.Equal(t, "Custom HTTP Metrics", definitions[0].Name)
+	assert.Equal(t, filepath.Join("testdata/definitions", "custom-http.yaml"), definitions[0].Source)
+	assert.Equal(t, 5, definitions[0].FirstLine)
+	assert.Empty(t, script.Validate(definitions[0], script.ScriptConfig{CollectInterval: 10}))
+}
+
+func TestScriptVariables(t *testing.T) {
+	t.Setenv(envScriptVariables, "region=eu, team=payments")
+	variables, err := getPairsEnv(envScriptVariables, map[string]string{"team": "core", "tier": "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"region": "eu", "team": "payments", "tier": "1"}, variables)
+
+	t.Setenv(envScriptVariables, "region")
+	_, err = getPairsEnv(envScriptVariables, nil)
+	assert.EqualError(t, err, "Environment variable SCRIPT_VARIABLES must hold name=value pairs, got 'region'.")
+
+	clusters := getClusters([]fileCluster{
+		{Name: "prod", ClusterID: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484", ScriptVariables: map[string]string{"region": "us"}},
+		{Name: "staging", ClusterID: "b8749d5b-3352-4a0c-92ef-4a1479464b74", ScriptVariables: map[string]string{"ClusterName": "x"}},
+	}, &cluster{scriptVariables: map[string]string{"region": "eu", "team": "core"}})
+	assert.Equal(t, map[string]string{"region": "us", "team": "core"}, clusters[0].ScriptVariables())
+	assert.EqualError(t, validateClusters(clusters), "invalid config key 'worker.clusters[1].scriptVariables': variable ClusterName is set by the integration")
+}
+
+func TestScriptEnv(t *testing.T) {
+	t.Setenv("PXL_REGION", "eu")
+	t.Setenv("PXL_TOKEN_FILE", "/secrets/token")
+	t.Setenv("REGION", "us")
+	t.Setenv(envNRLicenseKEy, "license")
+	t.Setenv(envPixieAPIKey, "api-key")
+	t.Setenv(envPixieAPIKey+fileSuffix, "/secrets/api-key")
+	assert.Equal(t, map[string]string{"PXL_REGION": "eu"}, getScriptEnv(defScriptEnvPrefix))
+
+	// the secrets aren't exposed whatever the prefix
+	env := getScriptEnv("")
+	assert.Equal(t, "us", env["REGION"])
+	assert.NotContains(t, env, envNRLicenseKEy)
+	assert.NotContains(t, env, envPixieAPIKey)
+	assert.NotContains(t, env, envPixieAPIKey+fileSuffix)
+	assert.NotContains(t, env, "PXL_TOKEN_FILE")
+}
+
+func TestResourceAttributes(t *testing.T) {
+	t.Setenv(envResourceAttrs, "environment=prod,service.namespace=shop")
+	attributes, err := getPairsEnv(envResourceAttrs, map[string]string{"team": "payments", "environment": "staging"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"environment": "prod", "service.namespace": "shop", "team": "payments"}, attributes)
+
+	clusters := getClusters([]fileCluster{
+		{Name: "prod", ClusterID: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484", ResourceAttributes: map[string]string{"region": "us"}},
+		{Name: "staging", ClusterID: "b8749d5b-3352-4a0c-92ef-4a1479464b74", ResourceAttributes: map[string]string{"px.source": "x"}},
+	}, &cluster{resourceAttrs: attributes})
+	assert.Equal(t, map[string]string{"environment": "prod", "service.namespace": "shop", "team": "payments", "region": "us"}, clusters[0].ResourceAttributes())
+	assert.EqualError(t, validateClusters(clusters), "invalid config key 'worker.clusters[1].resourceAttributes': resource attribute px.source is set by the integration")
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -13,6 +14,8 @@ import (
 
 const scriptExtension = ".yaml"
 
+var scriptBlockRegex = regexp.MustCompile(`^script:\s*[|>][-+0-9]*\s*$`)
+
 // ReadScriptDefinitions reads the script definition from the given directory path.
 // Only .yaml files are read and subdirectories are not traversed.
 func ReadScriptDefinitions(dir string) ([]*script.ScriptDefinition, error) {
@@ -26,7 +29,7 @@ func ReadScriptDefinitions(dir string) ([]*script.ScriptDefinition, error) {
 	var l []*script.ScriptDefinition
 	for _, file := range files {
 		if strings.HasSuffix(file.Name(), scriptExtension) {
-			description, err := readScriptDefinition(filepath.Join(dir, file.Name()))
+			description, err := ReadScriptDefinition(filepath.Join(dir, file.Name()))
 			if err != nil {
 				return nil, err
 			}
@@ -36,7 +39,8 @@ func ReadScriptDefinitions(dir string) ([]*script.ScriptDefinition, error) {
 	return l, nil
 }
 
-func readScriptDefinition(path string) (*script.ScriptDefinition, error) {
+// ReadScriptDefinition reads the script definition from the given YAML file.
+func ReadScriptDefinition(path string) (*script.ScriptDefinition, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -46,5 +50,18 @@ func readScriptDefinition(path string) (*script.ScriptDefinition, error) {
 	if err != nil {
 		return nil, err
 	}
+	definition.Source = path
+	definition.FirstLine = scriptLine(content)
 	return &definition, nil
 }
+
+// scriptLine returns the line of the script key when the script is a block scalar, so the
+// lines of the script can be reported as lines of the file, and 0 otherwise.
+func scriptLine(content []byte) int {
+	for i, line := range strings.Split(string(content), "\n") {
+		if scriptBlockRegex.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+// fileConfig is the structure of the optional configuration file. Every value can be
+// overridden by its environment variable.
+type fileConfig struct {
+	Verbose  *bool        `yaml:"verbose" json:"verbose"`
+	Exporter fileExporter `yaml:"exporter" json:"exporter"`
+	Pixie    filePixie    `yaml:"pixie" json:"pixie"`
+	Worker   fileWorker   `yaml:"worker" json:"worker"`
+}
+
+type fileExporter struct {
+	LicenseKey     string `yaml:"licenseKey" json:"licenseKey"`
+	LicenseKeyFile string `yaml:"licenseKeyFile" json:"licenseKeyFile"`
+	Endpoint       string `yaml:"endpoint" json:"endpoint"`
+	// SelfTelemetry enables sending the integration's own metrics and logs over OTLP.
+	SelfTelemetry         *bool  `yaml:"selfTelemetry" json:"selfTelemetry"`
+	SelfTelemetryEndpoint string `yaml:"selfTelemetryEndpoint" json:"selfTelemetryEndpoint"`
+}
+
+type filePixie struct {
+	APIKey     string `yaml:"apiKey" json:"apiKey"`
+	APIKeyFile string `yaml:"apiKeyFile" json:"apiKeyFile"`
+	ClusterID  string `yaml:"clusterId" json:"clusterId"`
+	Endpoint   string `yaml:"endpoint" json:"endpoint"`
+}
+
+type fileWorker struct {
+	ClusterName            string                           `yaml:"clusterName" json:"clusterName"`
+	Clusters               []fileCluster                    `yaml:"clusters" json:"clusters"`
+	ScriptDir              string                           `yaml:"scriptDir" json:"scriptDir"`
+	HttpSpanLimit          *int64                           `yaml:"httpSpanLimit" json:"httpSpanLimit"`
+	DbSpanLimit            *int64                           `yaml:"dbSpanLimit" json:"dbSpanLimit"`
+	SpanLimits             map[string]int64                 `yaml:"spanLimits" json:"spanLimits"`
+	ScriptVariables        map[string]string                `yaml:"scriptVariables" json:"scriptVariables"`
+	ResourceAttributes     map[string]string                `yaml:"resourceAttributes" json:"resourceAttributes"`
+	ScriptEnvPrefix        string                           `yaml:"scriptEnvPrefix" json:"scriptEnvPrefix"`
+	DefaultSpanLimit       *int64                           `yaml:"defaultSpanLimit" json:"defaultSpanLimit"`
+	SpanLimitMode          string                           `yaml:"spanLimitMode" json:"spanLimitMode"`
+	SpanSamplePercent      *int64                           `yaml:"spanSamplePercent" json:"spanSamplePercent"`
+	CollectIntervalSec     *int64                           `yaml:"collectIntervalSec" json:"collectIntervalSec"`
+	ReconcileIntervalSec   *int64                           `yaml:"reconcileIntervalSec" json:"reconcileIntervalSec"`
+	Concurrency            *int64                           `yaml:"concurrency" json:"concurrency"`
+	RetryMaxAttempts       *int64                           `yaml:"retryMaxAttempts" json:"retryMaxAttempts"`
+	RetryInitialBackoffMs  *int64                           `yaml:"retryInitialBackoffMs" json:"retryInitialBackoffMs"`
+	RetryMaxBackoffMs      *int64                           `yaml:"retryMaxBackoffMs" json:"retryMaxBackoffMs"`
+	RequestTimeoutSec      *int64                           `yaml:"requestTimeoutSec" json:"requestTimeoutSec"`
+	RunTimeoutSec          *int64                           `yaml:"runTimeoutSec" json:"runTimeoutSec"`
+	ExcludePodsRegex       string                           `yaml:"excludePodsRegex" json:"excludePodsRegex"`
+	ExcludeNamespacesRegex string                           `yaml:"excludeNamespacesRegex" json:"excludeNamespacesRegex"`
+	Filters                script.Filters                   `yaml:"filters" json:"filters"`
+	Scripts                map[string]script.ScriptOverride `yaml:"scripts" json:"scripts"`
+	DryRun                 *bool                            `yaml:"dryRun" json:"dryRun"`
+	Cleanup                *bool                            `yaml:"cleanup" json:"cleanup"`
+	CleanupDisablePlugin   *bool                            `yaml:"cleanupDisablePlugin" json:"cleanupDisablePlugin"`
+	PlanOutput             string                           `yaml:"planOutput" json:"planOutput"`
+	HTTPAddress            string                           `yaml:"httpAddress" json:"httpAddress"`
+	AuditFile              string                           `yaml:"auditFile" json:"auditFile"`
+}
+
+// readConfigFile parses the YAML or JSON configuration file at path. Files with a .json
+// extension are parsed as JSON, anything else as YAML. Unknown keys are rejected.
+// An empty path returns an empty configuration.
+func readConfigFile(path string) (*fileConfig, error) {
+	fc := &fileConfig{}
+	if path == "" {
+		return fc, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(fc); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, jsonError(content, err))
+		}
+		return fc, nil
+	}
+	if err := yaml.UnmarshalStrict(content, fc); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return fc, nil
+}
+
+// jsonError adds the offending key or line to the errors returned by the JSON decoder.
+func jsonError(content []byte, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("key '%s' (line %d): cannot use %s as %s", typeErr.Field, lineOf(content, typeErr.Offset), typeErr.Value, typeErr.Type)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("line %d: %w", lineOf(content, syntaxErr.Offset), err)
+	}
+	return err
+}
+
+func lineOf(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+func intOrDefault(value *int64, defaultValue int64) int64 {
+	if value == nil {
+		return defaultValue
+	}
+	return *value
+}
+
+func stringOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// getBoolEnv returns true when the env variable is set to true. When the env variable
+// is not set, the value from the config file is used.
+func getBoolEnv(key string, fileValue *bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		return strings.EqualFold(value, boolTrue)
+	}
+	return fileValue != nil && *fileValue
+}
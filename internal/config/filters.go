@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+const keyFilters = "worker.filters"
+
+type filterEnv struct {
+	include string
+	exclude string
+}
+
+// filterEnvs maps every filter dimension to its include and exclude env variables.
+var filterEnvs = map[string]filterEnv{
+	script.FilterNamespace: {include: "INCLUDE_NAMESPACES_REGEX", exclude: envExcludeNamespaces},
+	script.FilterPod:       {include: "INCLUDE_PODS_REGEX", exclude: envExcludePods},
+	script.FilterService:   {include: "INCLUDE_SERVICES_REGEX", exclude: "EXCLUDE_SERVICES_REGEX"},
+	script.FilterNode:      {include: "INCLUDE_NODES_REGEX", exclude: "EXCLUDE_NODES_REGEX"},
+	script.FilterContainer: {include: "INCLUDE_CONTAINERS_REGEX", exclude: "EXCLUDE_CONTAINERS_REGEX"},
+}
+
+// getWorkerFilters returns the filters of the config file overridden by the legacy
+// excludePodsRegex and excludeNamespacesRegex keys and by the env variables.
+func getWorkerFilters(fw fileWorker) script.Filters {
+	filters := copyFilters(fw.Filters)
+	setExclude(filters, script.FilterPod, fw.ExcludePodsRegex)
+	setExclude(filters, script.FilterNamespace, fw.ExcludeNamespacesRegex)
+	for dimension, envs := range filterEnvs {
+		filter := filters[dimension]
+		filter.Include = getEnvWithDefault(envs.include, filter.Include)
+		filter.Exclude = getEnvWithDefault(envs.exclude, filter.Exclude)
+		if filter.Include != "" || filter.Exclude != "" {
+			filters[dimension] = filter
+		}
+	}
+	return filters
+}
+
+func copyFilters(filters script.Filters) script.Filters {
+	c := make(script.Filters, len(filters))
+	for dimension, filter := range filters {
+		c[dimension] = filter
+	}
+	return c
+}
+
+func setExclude(filters script.Filters, dimension, exclude string) {
+	if exclude == "" {
+		return
+	}
+	filter := filters[dimension]
+	filter.Exclude = exclude
+	filters[dimension] = filter
+}
+
+func validateFilters(filters script.Filters, key string) error {
+	if err := filters.Validate(); err != nil {
+		return fmt.Errorf("invalid filters (config key '%s'): %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+type envFlag struct {
+	env     string
+	usage   string
+	boolean bool
+}
+
+// envFlags are the env variables which can be set with a command line flag as well. The
+// license and API keys have no flag, as command lines show up in ps and the shell history:
+// only the flags of their _FILE variables are offered.
+var envFlags = []envFlag{
+	{env: envConfigFile, usage: "path of the YAML or JSON config file"},
+	{env: envVerbose, usage: "log at debug level", boolean: true},
+	{env: envNRLicenseKEy + fileSuffix, usage: "path of the file holding the New Relic license key"},
+	{env: envNROTLPHost, usage: "New Relic OTLP endpoint the data is exported to"},
+	{env: envPixieAPIKey + fileSuffix, usage: "path of the file holding the Pixie API key"},
+	{env: envPixieEndpoint, usage: "Pixie cloud API endpoint"},
+	{env: envPixieClusterID, usage: "Pixie cluster ID"},
+	{env: envClusterName, usage: "name of the cluster"},
+	{env: envScriptDir, usage: "directory of the custom scripts"},
+	{env: envHttpSpanLimit, usage: "limit of HTTP spans per run, 0 for no limit"},
+	{env: envDbSpanLimit, usage: "limit of MySQL and PostgreSQL spans per run, 0 for no limit"},
+	{env: envSpanLimits, usage: "comma separated protocol=limit span limits"},
+	{env: envScriptVariables, usage: "comma separated name=value template variables of the custom scripts"},
+	{env: envResourceAttrs, usage: "comma separated key=value resource attributes added to every script"},
+	{env: envScriptEnvPrefix, usage: "prefix of the env variables the custom scripts can expand"},
+	{env: envDefaultSpanLimit, usage: "limit of the spans of any other protocol per run, 0 for no limit"},
+	{env: envSpanLimitMode, usage: "how span limits are applied, head or sample"},
+	{env: envSamplePercent, usage: "percent of the remaining spans kept in sample mode"},
+	{env: envCollectInterval, usage: "collection interval in seconds of scripts without a default frequency"},
+	{env: filterEnvs[script.FilterNamespace].include, usage: "only send data of the namespaces matching the regex"},
+	{env: envExcludeNamespaces, usage: "don't send data of the namespaces matching the regex"},
+	{env: filterEnvs[script.FilterPod].include, usage: "only send data of the pods matching the regex"},
+	{env: envExcludePods, usage: "don't send data of the pods matching the regex"},
+	{env: filterEnvs[script.FilterService].include, usage: "only send data of the services matching the regex"},
+	{env: filterEnvs[script.FilterService].exclude, usage: "don't send data of the services matching the regex"},
+	{env: filterEnvs[script.FilterNode].include, usage: "only send data of the nodes matching the regex"},
+	{env: filterEnvs[script.FilterNode].exclude, usage: "don't send data of the nodes matching the regex"},
+	{env: filterEnvs[script.FilterContainer].include, usage: "only send data of the containers matching the regex"},
+	{env: filterEnvs[script.FilterContainer].exclude, usage: "don't send data of the containers matching the regex"},
+	{env: envReconcileInterval, usage: "reconcile interval in seconds, 0 to reconcile once"},
+	{env: envDryRun, usage: "print the plan without mutating Pixie", boolean: true},
+	{env: envPlanOutput, usage: "format of the plan, text or json"},
+	{env: envCleanup, usage: "delete the scripts of the configured clusters instead of reconciling them", boolean: true},
+	{env: envCleanupPlugin, usage: "disable the New Relic plugin on cleanup when no other cluster has scripts", boolean: true},
+	{env: envHTTPAddress, usage: "address of the health and metrics endpoints"},
+	{env: envAuditFile, usage: "file the script change records are appended to"},
+	{env: envConcurrency, usage: "maximum number of concurrent Pixie API requests"},
+	{env: envRetryAttempts, usage: "maximum number of attempts of a Pixie API request"},
+	{env: envRetryInitial, usage: "wait in milliseconds before the first retry of a Pixie API request"},
+	{env: envRetryMax, usage: "maximum wait in milliseconds between two attempts of a Pixie API request"},
+	{env: envRequestTimeout, usage: "deadline in seconds of a Pixie API request attempt, 0 for none"},
+	{env: envRunTimeout, usage: "deadline in seconds of a reconcile pass, 0 for none"},
+	{env: envSelfTelemetry, usage: "send the integration metrics and logs to New Relic", boolean: true},
+	{env: envSelfTelemetryURL, usage: "OTLP/HTTP endpoint of the self-telemetry"},
+}
+
+// RegisterFlags defines a flag on fs for every env variable, named after the env variable
+// in lower case with dashes, eg. -cluster-name for CLUSTER_NAME. A flag which is set
+// overrides the env variable, so flags take precedence over the env and the config file.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, f := range envFlags {
+		env := f.env
+		set := func(value string) error {
+			return os.Setenv(env, value)
+		}
+		if f.boolean {
+			fs.BoolFunc(flagName(env), f.usage+" ("+env+")", set)
+		} else {
+			fs.Func(flagName(env), f.usage+" ("+env+")", set)
+		}
+	}
+}
+
+// flagName returns the name of the flag of the env variable.
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// secret holds a sensitive value given either directly or as the path of a mounted file.
+// File based secrets are read again on every access so rotated files are picked up
+// without a restart.
+type secret struct {
+	value string
+	path  string
+
+	mu   sync.Mutex
+	last string
+}
+
+func newSecret(value, path, env, key string) (*secret, error) {
+	if value != "" && path != "" {
+		return nil, fmt.Errorf("only one of %s and %s can be set", setting(env, key), setting(env+fileSuffix, key+"File"))
+	}
+	return &secret{value: value, path: path}, nil
+}
+
+// load reads the secret, failing when the file can't be read or is empty.
+func (s *secret) load() (string, error) {
+	if s.path == "" {
+		return s.value, nil
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %w", err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", s.path)
+	}
+	s.mu.Lock()
+	s.last = value
+	s.mu.Unlock()
+	return value, nil
+}
+
+// get returns the current secret. When the file can't be read, the last value read
+// successfully is returned.
+func (s *secret) get() string {
+	value, err := s.load()
+	if err != nil {
+		log.WithError(err).Warn("using last known value of the secret")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.last
+	}
+	return value
+}
+
+func (s *secret) isSet() bool {
+	return s.value != "" || s.path != ""
+}
@@ -0,0 +1,120 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status tracks the state of the integration reported by the health endpoints. It is
+// ready once the Pixie client is established and a reconcile pass succeeded.
+type Status struct {
+	mu             sync.RWMutex
+	pixieConnected bool
+	lastReconcile  time.Time
+	lastSuccess    time.Time
+	pluginVersion  string
+	scripts        int
+	lastError      string
+}
+
+// Report is the JSON document served by /status.
+type Report struct {
+	Ready             bool       `json:"ready"`
+	PixieConnected    bool       `json:"pixieConnected"`
+	LastReconcileTime *time.Time `json:"lastReconcileTime,omitempty"`
+	LastSuccessTime   *time.Time `json:"lastSuccessTime,omitempty"`
+	PluginVersion     string     `json:"pluginVersion,omitempty"`
+	ManagedScripts    int        `json:"managedScripts"`
+	LastError         string     `json:"lastError,omitempty"`
+}
+
+func NewStatus() *Status {
+	return &Status{}
+}
+
+// SetPixieConnected records that the Pixie API client was established.
+func (s *Status) SetPixieConnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pixieConnected = true
+}
+
+// RecordReconcile records the outcome of a reconcile pass finished at the given time. The plugin
+// version and the number of managed scripts are kept from the previous pass when pluginVersion
+// is empty, ie. the pass failed before the plan was computed.
+func (s *Status) RecordReconcile(at time.Time, pluginVersion string, scripts int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastReconcile = at
+	if pluginVersion != "" {
+		s.pluginVersion = pluginVersion
+		s.scripts = scripts
+	}
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+	s.lastError = ""
+	s.lastSuccess = at
+}
+
+// Report returns a snapshot of the status.
+func (s *Status) Report() Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report := Report{
+		Ready:          s.isReady(),
+		PixieConnected: s.pixieConnected,
+		PluginVersion:  s.pluginVersion,
+		ManagedScripts: s.scripts,
+		LastError:      s.lastError,
+	}
+	if !s.lastReconcile.IsZero() {
+		t := s.lastReconcile
+		report.LastReconcileTime = &t
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		report.LastSuccessTime = &t
+	}
+	return report
+}
+
+func (s *Status) isReady() bool {
+	return s.pixieConnected && !s.lastSuccess.IsZero()
+}
+
+func (s *Status) notReadyReason() string {
+	if !s.pixieConnected {
+		return "the Pixie client is not established"
+	}
+	return "no reconcile pass succeeded yet"
+}
+
+// NewHandler returns the handler serving /healthz, /readyz and /status.
+func NewHandler(status *Status) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		status.mu.RLock()
+		ready, reason := status.isReady(), status.notReadyReason()
+		status.mu.RUnlock()
+		if !ready {
+			http.Error(w, "not ready: "+reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(status.Report())
+	})
+	return mux
+}
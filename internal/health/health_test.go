@@ -0,0 +1,59 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	status := NewStatus()
+	handler := NewHandler(status)
+
+	assert.Equal(t, http.StatusOK, get(t, handler, "/healthz").Code)
+
+	rec := get(t, handler, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "not ready: the Pixie client is not established\n", rec.Body.String())
+
+	status.SetPixieConnected()
+	first := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	status.RecordReconcile(first, "0.0.3", 0, fmt.Errorf("cluster test-cluster is unavailable"))
+	rec = get(t, handler, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "not ready: no reconcile pass succeeded yet\n", rec.Body.String())
+
+	second := first.Add(time.Minute)
+	status.RecordReconcile(second, "0.0.3", 4, nil)
+	assert.Equal(t, http.StatusOK, get(t, handler, "/readyz").Code)
+
+	third := second.Add(time.Minute)
+	status.RecordReconcile(third, "", 0, fmt.Errorf("getting data retention plugins failed"))
+	assert.Equal(t, http.StatusOK, get(t, handler, "/readyz").Code)
+
+	rec = get(t, handler, "/status")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var report Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, Report{
+		Ready:             true,
+		PixieConnected:    true,
+		LastReconcileTime: &third,
+		LastSuccessTime:   &second,
+		PluginVersion:     "0.0.3",
+		ManagedScripts:    4,
+		LastError:         "getting data retention plugins failed",
+	}, report)
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import "net/http"
+
+const namespace = "nr_pixie_integration_"
+
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+	OutcomeSuccess  = "success"
+	OutcomeFailure  = "failure"
+)
+
+// requestBuckets are the upper bounds in seconds of the Pixie request duration histogram.
+var requestBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry of the integration metrics served by Handler.
+var Default = NewRegistry()
+
+var (
+	BuildInfo = Default.NewGauge(namespace+"build_info",
+		"Build information of the integration, always 1.", "version", "commit", "build_date")
+	PixieRequestDuration = Default.NewHistogram(namespace+"pixie_request_duration_seconds",
+		"Duration of the Pixie plugin service requests.", requestBuckets, "method")
+	PixieRequestErrors = Default.NewCounter(namespace+"pixie_request_errors_total",
+		"Number of failed Pixie plugin service requests.", "method")
+	PixieRequestRetries = Default.NewCounter(namespace+"pixie_request_retries_total",
+		"Number of retried Pixie plugin service requests.", "method")
+	ScriptOperations = Default.NewCounter(namespace+"script_operations_total",
+		"Number of data retention script operations by outcome.", "cluster", "script", "operation", "outcome")
+	ScriptActions = Default.NewGauge(namespace+"script_actions",
+		"Number of script operations planned by the last reconcile pass.", "cluster", "operation")
+	ManagedScripts = Default.NewGauge(namespace+"managed_scripts",
+		"Number of nri- data retention scripts after the last reconcile pass.", "cluster")
+)
+
+// Handler returns the handler serving the integration metrics.
+func Handler() http.Handler {
+	return Default.Handler()
+}
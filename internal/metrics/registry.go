@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+	// labelSeparator joins label values into series keys and can't appear in valid UTF-8.
+	labelSeparator = "\xff"
+)
+
+// Registry holds metrics and writes them in the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// metric is a family of series sharing a name and label names.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts holds the cumulative bucket counts of histograms.
+	counts []uint64
+	count  uint64
+}
+
+// Counter is a metric which only increases.
+type Counter struct{ m *metric }
+
+// Gauge is a metric which can be set to any value.
+type Gauge struct{ m *metric }
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct{ m *metric }
+
+func (r *Registry) register(m *metric) *metric {
+	m.series = make(map[string]*series)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&metric{name: name, help: help, kind: typeCounter, labels: labels})}
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&metric{name: name, help: help, kind: typeGauge, labels: labels})}
+}
+
+// NewHistogram creates a histogram with the given upper bounds, which must be sorted.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(&metric{name: name, help: help, kind: typeHistogram, labels: labels, buckets: buckets})}
+}
+
+// get returns the series of the label values, creating it when needed. The caller must hold m.mu.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == typeHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.m.name))
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labelValues).value += v
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value = v
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labelValues)
+	for i, bound := range h.m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Write writes every metric in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns the handler serving the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+		bucketLabels := with(m.labels, "le")
+		for i, bound := range m.buckets {
+			labels := formatLabels(bucketLabels, with(s.labelValues, formatValue(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(bucketLabels, with(s.labelValues, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+// with returns a copy of values with v appended, leaving values untouched.
+func with(values []string, v string) []string {
+	return append(append(make([]string, 0, len(values)+1), values...), v)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("test_operations_total", "Number of operations.", "operation", "script")
+	gauge := r.NewGauge("test_info", "Info with \"quotes\" and \\ backslash.")
+	histogram := r.NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "method")
+
+	counter.Inc("update", "nri-HTTP Metrics-test")
+	counter.Add(2, "create", `nri-"quoted"-test`)
+	counter.Inc("update", "nri-HTTP Metrics-test")
+	gauge.Set(1)
+	histogram.Observe(0.05, "GetPlugins")
+	histogram.Observe(0.5, "GetPlugins")
+	histogram.Observe(5, "GetPlugins")
+
+	var b strings.Builder
+	assert.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP test_operations_total Number of operations.
+# TYPE test_operations_total counter
+test_operations_total{operation="create",script="nri-\"quoted\"-test"} 2
+test_operations_total{operation="update",script="nri-HTTP Metrics-test"} 2
+# HELP test_info Info with "quotes" and \\ backslash.
+# TYPE test_info gauge
+test_info 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="GetPlugins",le="0.1"} 1
+test_duration_seconds_bucket{method="GetPlugins",le="1"} 2
+test_duration_seconds_bucket{method="GetPlugins",le="+Inf"} 3
+test_duration_seconds_sum{method="GetPlugins"} 5.55
+test_duration_seconds_count{method="GetPlugins"} 3
+`, b.String())
+}
+
+func TestRegistryLabelMismatch(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("test_total", "Test.", "operation")
+	assert.Panics(t, func() { counter.Inc() })
+	assert.Panics(t, func() { counter.Add(-1, "create") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_info", "Test.").Set(1)
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_info Test.\n# TYPE test_info gauge\ntest_info 1\n", rec.Body.String())
+}
@@ -4,36 +4,55 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/gogo/protobuf/types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"px.dev/pxapi/proto/cloudpb"
 	"px.dev/pxapi/proto/uuidpb"
 	"px.dev/pxapi/utils"
 
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
+	"github.com/newrelic/newrelic-pixie-integration/internal/pool"
 	"github.com/newrelic/newrelic-pixie-integration/internal/script"
 )
 
 const (
 	newRelicPluginId = "new-relic"
 	apiKeyConfig     = "api-key"
+	apiKeyHeader     = "pixie-api-key"
 )
 
+// Options holds the settings of the requests to the Pixie cloud API. At most Concurrency
+// script contents are fetched at the same time and every attempt of a request is cancelled
+// after RequestTimeout, unless it is zero.
+type Options struct {
+	Concurrency    int
+	Retry          RetryPolicy
+	RequestTimeout time.Duration
+}
+
 type Client struct {
 	cloudAddr string
-	ctx       context.Context
+	apiKey    func() string
+	options   Options
 
 	grpcConn     *grpc.ClientConn
 	pluginClient cloudpb.PluginServiceClient
 }
 
-func NewClient(ctx context.Context, apiKey string, cloudAddr string) (*Client, error) {
+// NewClient creates a client for the Pixie cloud API. The apiKey function is called for
+// every request so rotated API keys are picked up without recreating the client.
+func NewClient(apiKey func() string, cloudAddr string, options Options) (*Client, error) {
 	c := &Client{
 		cloudAddr: cloudAddr,
-		ctx:       metadata.AppendToOutgoingContext(ctx, "pixie-api-key", apiKey),
+		apiKey:    apiKey,
+		options:   options,
 	}
 
 	if err := c.init(); err != nil {
@@ -49,7 +68,11 @@ func (c *Client) init() error {
 	tlsConfig := &tls.Config{InsecureSkipVerify: isInternal}
 	creds := credentials.NewTLS(tlsConfig)
 
-	conn, err := grpc.Dial(c.cloudAddr, grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(c.cloudAddr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(apiKeyCredentials(c.apiKey)),
+		grpc.WithChainUnaryInterceptor(c.options.Retry.interceptor, c.options.timeout, instrument),
+	)
 	if err != nil {
 		return err
 	}
@@ -59,11 +82,49 @@ func (c *Client) init() error {
 	return nil
 }
 
-func (c *Client) GetNewRelicPlugin() (*cloudpb.Plugin, error) {
+// Close closes the connection to the Pixie cloud API.
+func (c *Client) Close() error {
+	return c.grpcConn.Close()
+}
+
+// timeout sets the deadline of every attempt of a request.
+func (o Options) timeout(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if o.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.RequestTimeout)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// apiKeyCredentials adds the Pixie API key to the metadata of every request.
+type apiKeyCredentials func() string
+
+func (a apiKeyCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	return map[string]string{apiKeyHeader: a()}, nil
+}
+
+func (a apiKeyCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// instrument records the duration and the errors of every attempt of a request, by method name.
+func instrument(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	name := path.Base(method)
+	metrics.PixieRequestDuration.Observe(time.Since(start).Seconds(), name)
+	if err != nil {
+		metrics.PixieRequestErrors.Inc(name)
+	}
+	return err
+}
+
+func (c *Client) GetNewRelicPlugin(ctx context.Context) (*cloudpb.Plugin, error) {
 	req := &cloudpb.GetPluginsRequest{
 		Kind: cloudpb.PK_RETENTION,
 	}
-	resp, err := c.pluginClient.GetPlugins(c.ctx, req)
+	resp, err := c.pluginClient.GetPlugins(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -80,17 +141,17 @@ type NewRelicPluginConfig struct {
 	ExportUrl  string
 }
 
-func (c *Client) GetNewRelicPluginConfig() (*NewRelicPluginConfig, error) {
+func (c *Client) GetNewRelicPluginConfig(ctx context.Context) (*NewRelicPluginConfig, error) {
 	req := &cloudpb.GetOrgRetentionPluginConfigRequest{
 		PluginId: newRelicPluginId,
 	}
-	resp, err := c.pluginClient.GetOrgRetentionPluginConfig(c.ctx, req)
+	resp, err := c.pluginClient.GetOrgRetentionPluginConfig(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 	exportUrl := resp.CustomExportUrl
 	if exportUrl == "" {
-		exportUrl, err = c.getDefaultNewRelicExportUrl()
+		exportUrl, err = c.getDefaultNewRelicExportUrl(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -101,18 +162,18 @@ func (c *Client) GetNewRelicPluginConfig() (*NewRelicPluginConfig, error) {
 	}, nil
 }
 
-func (c *Client) getDefaultNewRelicExportUrl() (string, error) {
+func (c *Client) getDefaultNewRelicExportUrl(ctx context.Context) (string, error) {
 	req := &cloudpb.GetRetentionPluginInfoRequest{
 		PluginId: newRelicPluginId,
 	}
-	info, err := c.pluginClient.GetRetentionPluginInfo(c.ctx, req)
+	info, err := c.pluginClient.GetRetentionPluginInfo(ctx, req)
 	if err != nil {
 		return "", err
 	}
 	return info.DefaultExportURL, nil
 }
 
-func (c *Client) EnableNewRelicPlugin(config *NewRelicPluginConfig, version string) error {
+func (c *Client) EnableNewRelicPlugin(ctx context.Context, config *NewRelicPluginConfig, version string) error {
 	req := &cloudpb.UpdateRetentionPluginConfigRequest{
 		PluginId: newRelicPluginId,
 		Configs: map[string]string{
@@ -124,50 +185,77 @@ func (c *Client) EnableNewRelicPlugin(config *NewRelicPluginConfig, version stri
 		InsecureTLS:     &types.BoolValue{Value: false},
 		DisablePresets:  &types.BoolValue{Value: true},
 	}
-	_, err := c.pluginClient.UpdateRetentionPluginConfig(c.ctx, req)
+	_, err := c.pluginClient.UpdateRetentionPluginConfig(ctx, req)
 	return err
 }
 
-func (c *Client) GetPresetScripts() ([]*script.ScriptDefinition, error) {
-	resp, err := c.pluginClient.GetRetentionScripts(c.ctx, &cloudpb.GetRetentionScriptsRequest{})
+// DisableNewRelicPlugin disables the New Relic data retention plugin of the organization.
+func (c *Client) DisableNewRelicPlugin(ctx context.Context) error {
+	req := &cloudpb.UpdateRetentionPluginConfigRequest{
+		PluginId: newRelicPluginId,
+		Enabled:  &types.BoolValue{Value: false},
+	}
+	_, err := c.pluginClient.UpdateRetentionPluginConfig(ctx, req)
+	return err
+}
+
+// GetRetentionScripts lists the data retention scripts of the organization. The listing
+// can be shared by GetPresetScripts and GetClusterScripts.
+func (c *Client) GetRetentionScripts(ctx context.Context) ([]*cloudpb.RetentionScript, error) {
+	resp, err := c.pluginClient.GetRetentionScripts(ctx, &cloudpb.GetRetentionScriptsRequest{})
 	if err != nil {
 		return nil, err
 	}
-	var l []*script.ScriptDefinition
-	for _, s := range resp.Scripts {
+	return resp.Scripts, nil
+}
+
+func (c *Client) GetPresetScripts(ctx context.Context, scripts []*cloudpb.RetentionScript) ([]*script.ScriptDefinition, error) {
+	var presets []*cloudpb.RetentionScript
+	for _, s := range scripts {
 		if s.IsPreset {
-			sd, err := c.getScriptDefinition(s)
-			if err != nil {
-				return nil, err
-			}
-			l = append(l, sd)
+			presets = append(presets, s)
 		}
 	}
-	return l, nil
+	return c.getScriptDefinitions(ctx, presets)
 }
 
-func (c *Client) GetClusterScripts(clusterId, clusterName string) ([]*script.Script, error) {
-	resp, err := c.pluginClient.GetRetentionScripts(c.ctx, &cloudpb.GetRetentionScriptsRequest{})
+func (c *Client) GetClusterScripts(ctx context.Context, scripts []*cloudpb.RetentionScript, clusterId, clusterName string) ([]*script.Script, error) {
+	var matching []*cloudpb.RetentionScript
+	for _, s := range scripts {
+		if script.IsScriptForCluster(s.ScriptName, clusterName) || isScriptForClusterById(s.ScriptName, s.ClusterIDs, clusterId) {
+			matching = append(matching, s)
+		}
+	}
+	definitions, err := c.getScriptDefinitions(ctx, matching)
 	if err != nil {
 		return nil, err
 	}
 	var l []*script.Script
-	for _, s := range resp.Scripts {
-		if script.IsScriptForCluster(s.ScriptName, clusterName) || isScriptForClusterById(s.ScriptName, s.ClusterIDs, clusterId) {
-			sd, err := c.getScriptDefinition(s)
-			if err != nil {
-				return nil, err
-			}
-			l = append(l, &script.Script{
-				ScriptDefinition: *sd,
-				ScriptId:         utils.ProtoToUUIDStr(s.ScriptID),
-				ClusterIds:       getClusterIdsAsString(s.ClusterIDs),
-			})
-		}
+	for i, s := range matching {
+		l = append(l, &script.Script{
+			ScriptDefinition: *definitions[i],
+			ScriptId:         utils.ProtoToUUIDStr(s.ScriptID),
+			ClusterIds:       getClusterIdsAsString(s.ClusterIDs),
+		})
 	}
 	return l, nil
 }
 
+// getScriptDefinitions fetches the contents of the scripts concurrently. The definitions
+// are returned in the order of the scripts and the error of the first failing script wins.
+func (c *Client) getScriptDefinitions(ctx context.Context, scripts []*cloudpb.RetentionScript) ([]*script.ScriptDefinition, error) {
+	definitions := make([]*script.ScriptDefinition, len(scripts))
+	errs := pool.Run(len(scripts), c.options.Concurrency, func(i int) error {
+		sd, err := c.getScriptDefinition(ctx, scripts[i])
+		definitions[i] = sd
+		return err
+	})
+	if err := pool.FirstError(errs); err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
 func isScriptForClusterById(scriptName string, clusterIDs []*uuidpb.UUID, clusterId string) bool {
 	return script.IsNewRelicScript(scriptName) && len(clusterIDs) == 1 && utils.ProtoToUUIDStr(clusterIDs[0]) == clusterId
 }
@@ -183,8 +271,8 @@ func getClusterIdsAsString(clusterIDs []*uuidpb.UUID) string {
 	return scriptClusterId
 }
 
-func (c *Client) getScriptDefinition(s *cloudpb.RetentionScript) (*script.ScriptDefinition, error) {
-	resp, err := c.pluginClient.GetRetentionScript(c.ctx, &cloudpb.GetRetentionScriptRequest{ID: s.ScriptID})
+func (c *Client) getScriptDefinition(ctx context.Context, s *cloudpb.RetentionScript) (*script.ScriptDefinition, error) {
+	resp, err := c.pluginClient.GetRetentionScript(ctx, &cloudpb.GetRetentionScriptRequest{ID: s.ScriptID})
 	if err != nil {
 		return nil, err
 	}
@@ -197,7 +285,7 @@ func (c *Client) getScriptDefinition(s *cloudpb.RetentionScript) (*script.Script
 	}, nil
 }
 
-func (c *Client) AddDataRetentionScript(clusterId string, scriptName string, description string, frequencyS int64, contents string) error {
+func (c *Client) AddDataRetentionScript(ctx context.Context, clusterId string, scriptName string, description string, frequencyS int64, contents string) error {
 	req := &cloudpb.CreateRetentionScriptRequest{
 		ScriptName:  scriptName,
 		Description: description,
@@ -206,11 +294,11 @@ func (c *Client) AddDataRetentionScript(clusterId string, scriptName string, des
 		ClusterIDs:  []*uuidpb.UUID{utils.ProtoFromUUIDStrOrNil(clusterId)},
 		PluginId:    newRelicPluginId,
 	}
-	_, err := c.pluginClient.CreateRetentionScript(c.ctx, req)
+	_, err := c.pluginClient.CreateRetentionScript(ctx, req)
 	return err
 }
 
-func (c *Client) UpdateDataRetentionScript(clusterId string, scriptId string, scriptName string, description string, frequencyS int64, contents string) error {
+func (c *Client) UpdateDataRetentionScript(ctx context.Context, clusterId string, scriptId string, scriptName string, description string, frequencyS int64, contents string) error {
 	req := &cloudpb.UpdateRetentionScriptRequest{
 		ID:          utils.ProtoFromUUIDStrOrNil(scriptId),
 		ScriptName:  &types.StringValue{Value: scriptName},
@@ -220,14 +308,19 @@ func (c *Client) UpdateDataRetentionScript(clusterId string, scriptId string, sc
 		Contents:    &types.StringValue{Value: contents},
 		ClusterIDs:  []*uuidpb.UUID{utils.ProtoFromUUIDStrOrNil(clusterId)},
 	}
-	_, err := c.pluginClient.UpdateRetentionScript(c.ctx, req)
+	_, err := c.pluginClient.UpdateRetentionScript(ctx, req)
 	return err
 }
 
-func (c *Client) DeleteDataRetentionScript(scriptId string) error {
+// DeleteDataRetentionScript deletes the script. A script which is already gone is deleted,
+// eg. when a retried request timed out after deleting it.
+func (c *Client) DeleteDataRetentionScript(ctx context.Context, scriptId string) error {
 	req := &cloudpb.DeleteRetentionScriptRequest{
 		ID: utils.ProtoFromUUIDStrOrNil(scriptId),
 	}
-	_, err := c.pluginClient.DeleteRetentionScript(c.ctx, req)
+	_, err := c.pluginClient.DeleteRetentionScript(ctx, req)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
 	return err
 }
@@ -1,11 +1,21 @@
 package pixie
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"px.dev/pxapi/proto/cloudpb"
 	"px.dev/pxapi/proto/uuidpb"
 	"px.dev/pxapi/utils"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
 )
 
 func TestGetScriptClusterIdsAsString(t *testing.T) {
@@ -27,3 +37,164 @@ func TestIsScriptForClusterById(t *testing.T) {
 	assert.True(t, isScriptForClusterById("nri-script-cluster", []*uuidpb.UUID{utils.ProtoFromUUIDStrOrNil("b8749d5b-3352-4a0c-92ef-4a1479464b74")}, "b8749d5b-3352-4a0c-92ef-4a1479464b74"))
 	assert.False(t, isScriptForClusterById("nri-script-cluster", []*uuidpb.UUID{utils.ProtoFromUUIDStrOrNil("b8749d5b-3352-4a0c-92ef-4a1479464b74"), utils.ProtoFromUUIDStrOrNil("94fb8941-d353-43e0-b3e1-248f941c3af6")}, "b8749d5b-3352-4a0c-92ef-4a1479464b74"))
 }
+
+func TestAPIKeyCredentials(t *testing.T) {
+	apiKey := "px-api-key"
+	creds := apiKeyCredentials(func() string { return apiKey })
+	md, err := creds.GetRequestMetadata(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pixie-api-key": "px-api-key"}, md)
+
+	apiKey = "rotated-api-key"
+	md, err = creds.GetRequestMetadata(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pixie-api-key": "rotated-api-key"}, md)
+}
+
+func TestInstrument(t *testing.T) {
+	invoker := func(_ context.Context, method string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		if method == "/px.cloudapi.PluginService/DeleteRetentionScript" {
+			return fmt.Errorf("permission denied")
+		}
+		return nil
+	}
+	assert.NoError(t, instrument(context.Background(), "/px.cloudapi.PluginService/GetPlugins", nil, nil, nil, invoker))
+	assert.Error(t, instrument(context.Background(), "/px.cloudapi.PluginService/DeleteRetentionScript", nil, nil, nil, invoker))
+
+	var b strings.Builder
+	assert.NoError(t, metrics.Default.Write(&b))
+	assert.Contains(t, b.String(), `nr_pixie_integration_pixie_request_duration_seconds_count{method="GetPlugins"} 1`)
+	assert.Contains(t, b.String(), `nr_pixie_integration_pixie_request_duration_seconds_count{method="DeleteRetentionScript"} 1`)
+	assert.Contains(t, b.String(), `nr_pixie_integration_pixie_request_errors_total{method="DeleteRetentionScript"} 1`)
+	assert.NotContains(t, b.String(), `nr_pixie_integration_pixie_request_errors_total{method="GetPlugins"}`)
+}
+
+type fakePluginClient struct {
+	cloudpb.PluginServiceClient
+	contents map[string]string
+}
+
+func (f *fakePluginClient) GetRetentionScript(_ context.Context, in *cloudpb.GetRetentionScriptRequest, _ ...grpc.CallOption) (*cloudpb.GetRetentionScriptResponse, error) {
+	contents, ok := f.contents[utils.ProtoToUUIDStr(in.ID)]
+	if !ok {
+		return nil, fmt.Errorf("script %s not found", utils.ProtoToUUIDStr(in.ID))
+	}
+	return &cloudpb.GetRetentionScriptResponse{Contents: contents}, nil
+}
+
+func (f *fakePluginClient) DeleteRetentionScript(_ context.Context, in *cloudpb.DeleteRetentionScriptRequest, _ ...grpc.CallOption) (*cloudpb.DeleteRetentionScriptResponse, error) {
+	id := utils.ProtoToUUIDStr(in.ID)
+	if _, ok := f.contents[id]; !ok {
+		return nil, status.Errorf(codes.NotFound, "script %s not found", id)
+	}
+	delete(f.contents, id)
+	return &cloudpb.DeleteRetentionScriptResponse{}, nil
+}
+
+func TestDeleteDataRetentionScript(t *testing.T) {
+	id := "06906e7e-c684-4858-9fa1-e0bf552b40a6"
+	c := &Client{pluginClient: &fakePluginClient{contents: map[string]string{id: "px.export(df)"}}}
+	assert.NoError(t, c.DeleteDataRetentionScript(context.Background(), id))
+	// a script deleted by a request which timed out is already gone when the request is retried
+	assert.NoError(t, c.DeleteDataRetentionScript(context.Background(), id))
+}
+
+func TestGetClusterScripts(t *testing.T) {
+	clusterId := "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"
+	ids := []string{
+		"06906e7e-c684-4858-9fa1-e0bf552b40a6",
+		"4e4e51b2-86a8-4d57-a2a9-6771d15afcae",
+		"b8749d5b-3352-4a0c-92ef-4a1479464b74",
+		"d4d8b0e6-0c3f-4f4e-9f60-3c1a3f1d7c55",
+	}
+	var scripts []*cloudpb.RetentionScript
+	contents := make(map[string]string)
+	for i, id := range ids {
+		scripts = append(scripts, &cloudpb.RetentionScript{
+			ScriptID:   utils.ProtoFromUUIDStrOrNil(id),
+			ScriptName: fmt.Sprintf("nri-Script %d-test-cluster", i),
+			ClusterIDs: []*uuidpb.UUID{utils.ProtoFromUUIDStrOrNil(clusterId)},
+		})
+		contents[id] = fmt.Sprintf("px.export(df%d)", i)
+	}
+	scripts = append(scripts, &cloudpb.RetentionScript{ScriptName: "other-script", IsPreset: true})
+
+	c := &Client{options: Options{Concurrency: 2}, pluginClient: &fakePluginClient{contents: contents}}
+	l, err := c.GetClusterScripts(context.Background(), scripts, clusterId, "test-cluster")
+	assert.NoError(t, err)
+	assert.Len(t, l, 4)
+	for i, s := range l {
+		assert.Equal(t, fmt.Sprintf("nri-Script %d-test-cluster", i), s.Name)
+		assert.Equal(t, ids[i], s.ScriptId)
+		assert.Equal(t, fmt.Sprintf("px.export(df%d)", i), s.Script)
+		assert.Equal(t, clusterId, s.ClusterIds)
+	}
+
+	delete(contents, ids[3])
+	delete(contents, ids[1])
+	_, err = c.GetClusterScripts(context.Background(), scripts, clusterId, "test-cluster")
+	assert.EqualError(t, err, "script "+ids[1]+" not found")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}
+	for retry, max := range map[int]time.Duration{1: time.Millisecond, 2: 2 * time.Millisecond, 3: 3 * time.Millisecond, 4: 3 * time.Millisecond} {
+		backoff := policy.Backoff(retry)
+		assert.GreaterOrEqual(t, backoff, max/2)
+		assert.LessOrEqual(t, backoff, max)
+	}
+
+	attempts := 0
+	failing := func(code codes.Code, failures int) grpc.UnaryInvoker {
+		attempts = 0
+		return func(_ context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			attempts++
+			if attempts <= failures {
+				return status.Error(code, "failed")
+			}
+			return nil
+		}
+	}
+	ctx := context.Background()
+	getPlugins := "/px.cloudapi.PluginService/GetPlugins"
+
+	assert.NoError(t, policy.interceptor(ctx, getPlugins, nil, nil, nil, failing(codes.Unavailable, 3)))
+	assert.Equal(t, 4, attempts)
+
+	assert.Error(t, policy.interceptor(ctx, getPlugins, nil, nil, nil, failing(codes.DeadlineExceeded, 4)))
+	assert.Equal(t, 4, attempts)
+
+	assert.Error(t, policy.interceptor(ctx, getPlugins, nil, nil, nil, failing(codes.InvalidArgument, 1)))
+	assert.Equal(t, 1, attempts)
+
+	assert.Error(t, policy.interceptor(ctx, getPlugins, nil, nil, nil, failing(codes.PermissionDenied, 1)))
+	assert.Equal(t, 1, attempts)
+
+	create := "/px.cloudapi.PluginService/CreateRetentionScript"
+	assert.Error(t, policy.interceptor(ctx, create, nil, nil, nil, failing(codes.DeadlineExceeded, 1)))
+	assert.Equal(t, 1, attempts)
+	assert.NoError(t, policy.interceptor(ctx, create, nil, nil, nil, failing(codes.Unavailable, 1)))
+	assert.Equal(t, 2, attempts)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Error(t, policy.interceptor(cancelled, getPlugins, nil, nil, nil, failing(codes.Unavailable, 4)))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	invoker := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		deadline, ok = ctx.Deadline()
+		return nil
+	}
+
+	start := time.Now()
+	assert.NoError(t, Options{RequestTimeout: time.Minute}.timeout(context.Background(), "/px.cloudapi.PluginService/GetPlugins", nil, nil, nil, invoker))
+	assert.True(t, ok)
+	assert.WithinDuration(t, start.Add(time.Minute), deadline, 5*time.Second)
+
+	assert.NoError(t, Options{}.timeout(context.Background(), "/px.cloudapi.PluginService/GetPlugins", nil, nil, nil, invoker))
+	assert.False(t, ok)
+}
@@ -0,0 +1,73 @@
+package pixie
+
+import (
+	"context"
+	"math/rand"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
+)
+
+// createMethod isn't idempotent: a request which timed out may have created the script.
+const createMethod = "CreateRetentionScript"
+
+// RetryPolicy configures the retries of the Pixie API requests. Requests are attempted at
+// most MaxAttempts times, waiting an exponential backoff with jitter between attempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// isRetryable returns true for the status codes of transient failures. Requests of
+// non-idempotent methods are only retried when they didn't reach the server.
+func isRetryable(method string, err error) bool {
+	code := status.Code(err)
+	if path.Base(method) == createMethod {
+		return code == codes.Unavailable
+	}
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Backoff returns the wait before the given retry, starting at 1: the initial backoff
+// doubled for every retry, capped to the max backoff, of which a random half is skipped.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// interceptor retries the requests which failed with a retryable status code.
+func (p RetryPolicy) interceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	for attempt := 1; attempt < p.MaxAttempts && err != nil && isRetryable(method, err); attempt++ {
+		wait := p.Backoff(attempt)
+		log.WithError(err).Debugf("Retrying %s in %s (attempt %d of %d)", path.Base(method), wait, attempt+1, p.MaxAttempts)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		metrics.PixieRequestRetries.Inc(path.Base(method))
+		err = invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return err
+}
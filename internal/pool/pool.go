@@ -0,0 +1,43 @@
+package pool
+
+import "sync"
+
+// Run calls fn for every index in [0, n) with at most concurrency calls in flight and
+// returns the errors by index, so callers can aggregate them in a deterministic order.
+// A concurrency below 1 runs the calls sequentially.
+func Run(n, concurrency int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// FirstError returns the error with the lowest index, if any.
+func FirstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package pool
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	var inFlight, maxInFlight int32
+	errs := Run(20, 3, func(i int) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		if i%7 == 3 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	assert.Len(t, errs, 20)
+	assert.LessOrEqual(t, maxInFlight, int32(3))
+	for i, err := range errs {
+		if i%7 == 3 {
+			assert.EqualError(t, err, fmt.Sprintf("error %d", i))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.EqualError(t, FirstError(errs), "error 3")
+}
+
+func TestRunSequential(t *testing.T) {
+	var order []int
+	Run(5, 0, func(i int) error {
+		order = append(order, i)
+		return nil
+	})
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+	assert.Empty(t, Run(0, 4, func(int) error { return nil }))
+	assert.NoError(t, FirstError(nil))
+}
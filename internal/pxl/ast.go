@@ -0,0 +1,276 @@
+package pxl
+
+import "strings"
+
+// Node is an expression of a script.
+type Node interface {
+	// Start and End are the first and the last token of the expression.
+	Start() *Token
+	End() *Token
+	children() []Node
+}
+
+// Name is an identifier, eg. px or df.
+type Name struct {
+	Tok *Token
+}
+
+// Literal is a number, one or more adjacent string literals, True, False, None or an ellipsis.
+type Literal struct {
+	Toks []*Token
+}
+
+// Attribute is an attribute access, eg. px.export.
+type Attribute struct {
+	X    Node
+	Name *Token
+}
+
+// Call is a function call. Args holds the positional arguments and then the keyword ones.
+type Call struct {
+	Func   Node
+	Lparen *Token
+	Args   []*Arg
+	Rparen *Token
+}
+
+// Arg is an argument of a call. Keyword is nil for positional arguments.
+type Arg struct {
+	Keyword *Token
+	Value   Node
+}
+
+// Subscript is an indexing, eg. df[df.latency > 100] or df.req_path[0:8].
+type Subscript struct {
+	X      Node
+	Index  Node
+	Rbrack *Token
+}
+
+// Dict is a dict display. Comprehensions and ** unpacking are Items without Key.
+type Dict struct {
+	Lbrace *Token
+	Items  []*DictItem
+	Rbrace *Token
+}
+
+// DictItem is a key value pair of a dict display.
+type DictItem struct {
+	Key   Node
+	Value Node
+}
+
+// NamedExpr is an assignment expression, eg. (n := len(a)).
+type NamedExpr struct {
+	Name  *Name
+	Op    *Token
+	Value Node
+}
+
+// Expr is any other expression, eg. an operation, a tuple, a list or a lambda. Children
+// holds its operands.
+type Expr struct {
+	First    *Token
+	Last     *Token
+	Children []Node
+}
+
+func (n *Name) Start() *Token       { return n.Tok }
+func (n *Name) End() *Token         { return n.Tok }
+func (n *Name) children() []Node    { return nil }
+func (n *Literal) Start() *Token    { return n.Toks[0] }
+func (n *Literal) End() *Token      { return n.Toks[len(n.Toks)-1] }
+func (n *Literal) children() []Node { return nil }
+func (n *Attribute) Start() *Token  { return n.X.Start() }
+func (n *Attribute) End() *Token    { return n.Name }
+func (n *Attribute) children() []Node {
+	return []Node{n.X}
+}
+func (n *Call) Start() *Token { return n.Func.Start() }
+func (n *Call) End() *Token   { return n.Rparen }
+func (n *Call) children() []Node {
+	nodes := []Node{n.Func}
+	for _, a := range n.Args {
+		nodes = append(nodes, a.Value)
+	}
+	return nodes
+}
+func (n *Subscript) Start() *Token { return n.X.Start() }
+func (n *Subscript) End() *Token   { return n.Rbrack }
+func (n *Subscript) children() []Node {
+	return []Node{n.X, n.Index}
+}
+func (n *Dict) Start() *Token { return n.Lbrace }
+func (n *Dict) End() *Token   { return n.Rbrace }
+func (n *Dict) children() []Node {
+	var nodes []Node
+	for _, item := range n.Items {
+		if item.Key != nil {
+			nodes = append(nodes, item.Key)
+		}
+		nodes = append(nodes, item.Value)
+	}
+	return nodes
+}
+func (n *NamedExpr) Start() *Token { return n.Name.Tok }
+func (n *NamedExpr) End() *Token   { return n.Value.End() }
+func (n *NamedExpr) children() []Node {
+	return []Node{n.Name, n.Value}
+}
+func (n *Expr) Start() *Token    { return n.First }
+func (n *Expr) End() *Token      { return n.Last }
+func (n *Expr) children() []Node { return n.Children }
+
+// Keyword returns the value of the keyword argument of the call, nil when there is none.
+func (n *Call) Keyword(name string) Node {
+	for _, a := range n.Args {
+		if a.Keyword != nil && a.Keyword.Text == name {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// StringValue returns the value of a string literal, eg. 'k8s.pod.name', concatenating
+// adjacent strings. Escape sequences are kept as they are. ok is false for other literals.
+func (n *Literal) StringValue() (value string, ok bool) {
+	var b strings.Builder
+	for _, t := range n.Toks {
+		if t.Kind != KindString {
+			return "", false
+		}
+		text := strings.TrimLeft(t.Text, "rRbBuUfF")
+		quote := 1
+		if strings.HasPrefix(text, `"""`) || strings.HasPrefix(text, "'''") {
+			quote = 3
+		}
+		b.WriteString(text[quote : len(text)-quote])
+	}
+	return b.String(), true
+}
+
+// Stmt is a statement of a script.
+type Stmt interface {
+	// Start is the first token of the statement.
+	Start() *Token
+	exprs() []Node
+	body() []Stmt
+}
+
+// ExprStmt is an expression used as a statement, eg. a call to px.export.
+type ExprStmt struct {
+	X Node
+}
+
+// Assign is an assignment, possibly chained or augmented, eg. df.latency = df.latency / 1000.
+type Assign struct {
+	Targets []Node
+	Op      *Token
+	Value   Node
+}
+
+// Import is an import statement. Names holds the imported modules, or the names imported
+// from Module for a from statement.
+type Import struct {
+	Keyword *Token
+	Module  string
+	Names   []string
+}
+
+// SimpleStmt is any other statement on a single line, eg. a return statement.
+type SimpleStmt struct {
+	Keyword *Token
+	Exprs   []Node
+}
+
+// Compound is a statement with clauses, eg. a function definition or an if statement.
+type Compound struct {
+	Clauses []*Clause
+}
+
+// Clause is a clause of a compound statement, eg. the else clause of an if statement, or a
+// decorator. Exprs holds the expressions of its header.
+type Clause struct {
+	Keyword *Token
+	Exprs   []Node
+	Body    []Stmt
+}
+
+func (s *ExprStmt) Start() *Token   { return s.X.Start() }
+func (s *ExprStmt) exprs() []Node   { return []Node{s.X} }
+func (s *ExprStmt) body() []Stmt    { return nil }
+func (s *Assign) Start() *Token     { return s.Targets[0].Start() }
+func (s *Assign) exprs() []Node     { return append(append([]Node{}, s.Targets...), s.Value) }
+func (s *Assign) body() []Stmt      { return nil }
+func (s *Import) Start() *Token     { return s.Keyword }
+func (s *Import) exprs() []Node     { return nil }
+func (s *Import) body() []Stmt      { return nil }
+func (s *SimpleStmt) Start() *Token { return s.Keyword }
+func (s *SimpleStmt) exprs() []Node { return s.Exprs }
+func (s *SimpleStmt) body() []Stmt  { return nil }
+func (s *Compound) Start() *Token   { return s.Clauses[0].Keyword }
+func (s *Compound) exprs() []Node {
+	var nodes []Node
+	for _, c := range s.Clauses {
+		nodes = append(nodes, c.Exprs...)
+	}
+	return nodes
+}
+func (s *Compound) body() []Stmt {
+	var stmts []Stmt
+	for _, c := range s.Clauses {
+		stmts = append(stmts, c.Body...)
+	}
+	return stmts
+}
+
+// Walk calls fn for the statements, including the ones nested in compound statements, in the
+// order of the script.
+func Walk(stmts []Stmt, fn func(Stmt)) {
+	for _, s := range stmts {
+		fn(s)
+		Walk(s.body(), fn)
+	}
+}
+
+// Inspect calls fn for every expression of the statements in depth-first order, including the
+// expressions of nested statements. The children of a node are skipped when fn returns false.
+func Inspect(stmts []Stmt, fn func(Node) bool) {
+	Walk(stmts, func(s Stmt) {
+		for _, n := range s.exprs() {
+			inspect(n, fn)
+		}
+	})
+}
+
+func inspect(n Node, fn func(Node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	for _, c := range n.children() {
+		inspect(c, fn)
+	}
+}
+
+// IsCall returns the call when n calls the function with the dotted name, eg. px.otel.Data.
+func IsCall(n Node, name string) (*Call, bool) {
+	call, ok := n.(*Call)
+	if !ok || DottedName(call.Func) != name {
+		return nil, false
+	}
+	return call, true
+}
+
+// DottedName returns the dotted name of n, eg. px.otel.Data, or "" when n isn't a name nor an
+// attribute of one.
+func DottedName(n Node) string {
+	switch n := n.(type) {
+	case *Name:
+		return n.Tok.Text
+	case *Attribute:
+		if x := DottedName(n.X); x != "" {
+			return x + "." + n.Name.Text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package pxl
+
+import "strings"
+
+// Replace replaces the source of the expression with the text. The whitespace and comments
+// preceding the expression are kept, the comments within it are dropped.
+func (f *File) Replace(n Node, text string) {
+	start, end := n.Start().index, n.End().index
+	f.tokens[start].Text, f.tokens[start].suffix = text, ""
+	for _, t := range f.tokens[start+1 : end+1] {
+		t.Prefix, t.Text, t.suffix = "", "", ""
+	}
+}
+
+// InsertAfter inserts the text right after the token, eg. after the opening brace of a dict.
+func (f *File) InsertAfter(t *Token, text string) {
+	t.suffix += text
+}
+
+// InsertBefore inserts the lines before the statement, at its indentation. The comments and
+// blank lines preceding the statement stay above the inserted lines.
+func (f *File) InsertBefore(s Stmt, lines []string) {
+	t := s.Start()
+	lineStart := strings.LastIndexByte(t.Prefix, '\n') + 1
+	indent := t.Prefix[lineStart:]
+	var b strings.Builder
+	b.WriteString(t.Prefix[:lineStart])
+	for _, line := range lines {
+		if line != "" {
+			b.WriteString(indent)
+			b.WriteString(line)
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString(indent)
+	t.Prefix = b.String()
+}
+
+// Text returns the source of the expression, without the whitespace and comments preceding it.
+func (f *File) Text(n Node) string {
+	var b strings.Builder
+	for i, t := range f.tokens[n.Start().index : n.End().index+1] {
+		if i > 0 {
+			b.WriteString(t.Prefix)
+		}
+		b.WriteString(t.Text)
+		b.WriteString(t.suffix)
+	}
+	return b.String()
+}
+
+// StartsLine returns whether the statement is the first of its line, eg. not after a ';' nor
+// after the ':' of an if statement on a single line, so that lines can be inserted before it.
+func (f *File) StartsLine(s Stmt) bool {
+	i := s.Start().index - 1
+	for i >= 0 && (f.tokens[i].Kind == KindIndent || f.tokens[i].Kind == KindDedent) {
+		i--
+	}
+	return i < 0 || f.tokens[i].Kind == KindNewline
+}
@@ -0,0 +1,865 @@
+package pxl
+
+import (
+	"fmt"
+	"strings"
+)
+
+var keywords = map[string]bool{
+	"and": true, "as": true, "assert": true, "async": true, "await": true, "break": true, "class": true,
+	"continue": true, "def": true, "del": true, "elif": true, "else": true, "except": true, "finally": true,
+	"for": true, "from": true, "global": true, "if": true, "import": true, "in": true, "is": true,
+	"lambda": true, "nonlocal": true, "not": true, "or": true, "pass": true, "raise": true, "return": true,
+	"try": true, "while": true, "with": true, "yield": true, "True": true, "False": true, "None": true,
+}
+
+var augmentedAssignments = map[string]bool{
+	"+=": true, "-=": true, "*=": true, "/=": true, "//=": true, "%=": true, "**=": true,
+	">>=": true, "<<=": true, "&=": true, "|=": true, "^=": true, "@=": true,
+}
+
+// File is a parsed script.
+type File struct {
+	Stmts  []Stmt
+	tokens []*Token
+}
+
+// Parse parses the PxL script, the subset of Python supported by Pixie. The returned error is
+// an *Error locating the syntax error.
+func Parse(src string) (file *File, err error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			file, err = nil, e
+		}
+	}()
+	return &File{Stmts: p.file(), tokens: tokens}, nil
+}
+
+// String returns the source of the script, with the edits made since it was parsed.
+func (f *File) String() string {
+	var b strings.Builder
+	for _, t := range f.tokens {
+		b.WriteString(t.Prefix)
+		b.WriteString(t.Text)
+		b.WriteString(t.suffix)
+	}
+	return b.String()
+}
+
+// parser is a recursive descent parser. Syntax errors are raised as an *Error panic recovered
+// by Parse.
+type parser struct {
+	tokens []*Token
+	pos    int
+}
+
+func (p *parser) peek() *Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(offset int) *Token {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *parser) next() *Token {
+	t := p.tokens[p.pos]
+	if t.Kind != KindEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is returns whether the next token is the operator or the keyword.
+func (p *parser) is(text string) bool {
+	return isText(p.peek(), text)
+}
+
+func (p *parser) isAny(texts ...string) bool {
+	for _, text := range texts {
+		if p.is(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func isText(t *Token, text string) bool {
+	return (t.Kind == KindOp || t.Kind == KindName) && t.Text == text
+}
+
+func (p *parser) expect(text string) *Token {
+	if !p.is(text) {
+		p.unexpected(fmt.Sprintf("expected '%s'", text))
+	}
+	return p.next()
+}
+
+func (p *parser) expectKind(kind Kind, expected string) *Token {
+	if p.peek().Kind != kind {
+		p.unexpected("expected " + expected)
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected(expected string) {
+	t := p.peek()
+	var found string
+	switch t.Kind {
+	case KindNewline:
+		found = "end of line"
+	case KindIndent:
+		found = "indent"
+	case KindDedent:
+		found = "dedent"
+	case KindEOF:
+		found = "end of script"
+	default:
+		found = "'" + t.Text + "'"
+	}
+	msg := "unexpected " + found
+	if expected != "" {
+		msg += ", " + expected
+	}
+	panic(&Error{Line: t.Line, Msg: msg})
+}
+
+func (p *parser) file() []Stmt {
+	var stmts []Stmt
+	for p.peek().Kind != KindEOF {
+		stmts = append(stmts, p.statement()...)
+	}
+	return stmts
+}
+
+func (p *parser) statement() []Stmt {
+	t := p.peek()
+	if t.Kind == KindOp && t.Text == "@" {
+		return []Stmt{p.compound()}
+	}
+	if t.Kind == KindName {
+		switch t.Text {
+		case "if", "while", "for", "def", "with", "try", "class":
+			return []Stmt{p.compound()}
+		}
+	}
+	return p.simpleStmts()
+}
+
+func (p *parser) simpleStmts() []Stmt {
+	stmts := []Stmt{p.smallStmt()}
+	for p.is(";") {
+		p.next()
+		if p.peek().Kind == KindNewline {
+			break
+		}
+		stmts = append(stmts, p.smallStmt())
+	}
+	p.expectKind(KindNewline, "end of line")
+	return stmts
+}
+
+func (p *parser) smallStmt() Stmt {
+	t := p.peek()
+	if t.Kind != KindName {
+		return p.exprStmt()
+	}
+	switch t.Text {
+	case "pass", "break", "continue":
+		return &SimpleStmt{Keyword: p.next()}
+	case "return", "del", "global", "nonlocal", "assert", "raise", "yield":
+		s := &SimpleStmt{Keyword: p.next()}
+		if canStartExpr(p.peek()) {
+			s.Exprs = append(s.Exprs, p.testList())
+			if p.is("from") {
+				p.next()
+				s.Exprs = append(s.Exprs, p.test())
+			}
+		}
+		return s
+	case "import":
+		s := &Import{Keyword: p.next()}
+		for {
+			s.Names = append(s.Names, p.dottedName())
+			if p.is("as") {
+				p.next()
+				p.expectKind(KindName, "a name")
+			}
+			if !p.is(",") {
+				return s
+			}
+			p.next()
+		}
+	case "from":
+		s := &Import{Keyword: p.next()}
+		for p.isAny(".", "...") {
+			s.Module += p.next().Text
+		}
+		if !p.is("import") {
+			s.Module += p.dottedName()
+		}
+		p.expect("import")
+		if p.is("*") {
+			s.Names = []string{p.next().Text}
+			return s
+		}
+		parens := p.is("(")
+		if parens {
+			p.next()
+		}
+		for {
+			s.Names = append(s.Names, p.expectKind(KindName, "a name").Text)
+			if p.is("as") {
+				p.next()
+				p.expectKind(KindName, "a name")
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+			if parens && p.is(")") {
+				break
+			}
+		}
+		if parens {
+			p.expect(")")
+		}
+		return s
+	}
+	return p.exprStmt()
+}
+
+func (p *parser) dottedName() string {
+	name := p.expectKind(KindName, "a name").Text
+	for p.is(".") {
+		p.next()
+		name += "." + p.expectKind(KindName, "a name").Text
+	}
+	return name
+}
+
+func (p *parser) exprStmt() Stmt {
+	x := p.testList()
+	switch t := p.peek(); {
+	case isText(t, "="):
+		s := &Assign{Targets: []Node{x}, Op: t}
+		for p.is("=") {
+			p.next()
+			s.Targets = append(s.Targets, p.yieldOrTestList())
+		}
+		s.Value = s.Targets[len(s.Targets)-1]
+		s.Targets = s.Targets[:len(s.Targets)-1]
+		return s
+	case t.Kind == KindOp && augmentedAssignments[t.Text]:
+		p.next()
+		return &Assign{Targets: []Node{x}, Op: t, Value: p.yieldOrTestList()}
+	case isText(t, ":"):
+		p.next()
+		annotation := p.test()
+		if p.is("=") {
+			return &Assign{Targets: []Node{x}, Op: p.next(), Value: p.testList()}
+		}
+		return &ExprStmt{X: &Expr{First: x.Start(), Last: annotation.End(), Children: []Node{x, annotation}}}
+	}
+	return &ExprStmt{X: x}
+}
+
+func (p *parser) compound() Stmt {
+	s := &Compound{}
+	for p.is("@") {
+		c := &Clause{Keyword: p.next(), Exprs: []Node{p.test()}}
+		p.expectKind(KindNewline, "end of line")
+		s.Clauses = append(s.Clauses, c)
+	}
+	if len(s.Clauses) > 0 && !p.isAny("def", "class") {
+		p.unexpected("expected a function or class definition")
+	}
+	switch p.peek().Text {
+	case "if":
+		s.Clauses = append(s.Clauses, p.clause(p.namedExpr))
+		for p.is("elif") {
+			s.Clauses = append(s.Clauses, p.clause(p.namedExpr))
+		}
+		p.elseClause(s)
+	case "while":
+		s.Clauses = append(s.Clauses, p.clause(p.namedExpr))
+		p.elseClause(s)
+	case "for":
+		s.Clauses = append(s.Clauses, p.clause(func() Node {
+			target := p.exprList()
+			p.expect("in")
+			iter := p.testList()
+			return &Expr{First: target.Start(), Last: iter.End(), Children: []Node{target, iter}}
+		}))
+		p.elseClause(s)
+	case "with":
+		s.Clauses = append(s.Clauses, p.clause(func() Node {
+			items := &Expr{}
+			for {
+				x := p.test()
+				items.Children = append(items.Children, x)
+				if p.is("as") {
+					p.next()
+					x = p.bitOr()
+					items.Children = append(items.Children, x)
+				}
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			items.First, items.Last = items.Children[0].Start(), items.Children[len(items.Children)-1].End()
+			return items
+		}))
+	case "try":
+		s.Clauses = append(s.Clauses, p.clause(nil))
+		for p.is("except") {
+			s.Clauses = append(s.Clauses, p.clause(func() Node {
+				if p.is(":") {
+					return nil
+				}
+				x := p.test()
+				if p.is("as") {
+					p.next()
+					p.expectKind(KindName, "a name")
+				}
+				return x
+			}))
+		}
+		p.elseClause(s)
+		if p.is("finally") {
+			s.Clauses = append(s.Clauses, p.clause(nil))
+		}
+	case "def":
+		c := &Clause{Keyword: p.next()}
+		c.Exprs = append(c.Exprs, &Name{Tok: p.expectKind(KindName, "a function name")})
+		p.expect("(")
+		c.Exprs = append(c.Exprs, p.parameters(")", true)...)
+		p.expect(")")
+		if p.is("->") {
+			p.next()
+			c.Exprs = append(c.Exprs, p.test())
+		}
+		c.Body = p.suite()
+		s.Clauses = append(s.Clauses, c)
+	case "class":
+		c := &Clause{Keyword: p.next()}
+		c.Exprs = append(c.Exprs, &Name{Tok: p.expectKind(KindName, "a class name")})
+		if p.is("(") {
+			p.next()
+			for _, a := range p.arguments(")") {
+				c.Exprs = append(c.Exprs, a.Value)
+			}
+			p.expect(")")
+		}
+		c.Body = p.suite()
+		s.Clauses = append(s.Clauses, c)
+	}
+	return s
+}
+
+// clause parses a clause starting with a keyword, with the header parsed by header when it
+// isn't nil.
+func (p *parser) clause(header func() Node) *Clause {
+	c := &Clause{Keyword: p.next()}
+	if header != nil {
+		if x := header(); x != nil {
+			c.Exprs = []Node{x}
+		}
+	}
+	c.Body = p.suite()
+	return c
+}
+
+func (p *parser) elseClause(s *Compound) {
+	if p.is("else") {
+		s.Clauses = append(s.Clauses, p.clause(nil))
+	}
+}
+
+func (p *parser) suite() []Stmt {
+	p.expect(":")
+	if p.peek().Kind != KindNewline {
+		return p.simpleStmts()
+	}
+	p.next()
+	p.expectKind(KindIndent, "an indented block")
+	var stmts []Stmt
+	for p.peek().Kind != KindDedent {
+		stmts = append(stmts, p.statement()...)
+	}
+	p.next()
+	return stmts
+}
+
+// parameters parses the parameters of a function or a lambda up to the closing token, and
+// returns their annotations and default values.
+func (p *parser) parameters(close string, annotations bool) []Node {
+	var nodes []Node
+	for !p.is(close) {
+		switch {
+		case p.is("/"):
+			p.next()
+		case p.isAny("*", "**"):
+			p.next()
+			if p.peek().Kind == KindName {
+				p.next()
+			}
+		default:
+			p.expectKind(KindName, "a parameter name")
+		}
+		if annotations && p.is(":") {
+			p.next()
+			nodes = append(nodes, p.test())
+		}
+		if p.is("=") {
+			p.next()
+			nodes = append(nodes, p.test())
+		}
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	return nodes
+}
+
+// canStartExpr returns whether an expression can start with the token.
+func canStartExpr(t *Token) bool {
+	switch t.Kind {
+	case KindNumber, KindString:
+		return true
+	case KindName:
+		switch t.Text {
+		case "True", "False", "None", "not", "lambda", "await":
+			return true
+		}
+		return !keywords[t.Text]
+	case KindOp:
+		switch t.Text {
+		case "(", "[", "{", "-", "+", "~", "*", "**", "...":
+			return true
+		}
+	}
+	return false
+}
+
+// list parses a comma separated list of elements, returning the only element when there is
+// no comma.
+func (p *parser) list(elem func() Node) Node {
+	x := elem()
+	if !p.is(",") {
+		return x
+	}
+	tuple := &Expr{First: x.Start(), Children: []Node{x}}
+	for p.is(",") {
+		tuple.Last = p.next()
+		if !canStartExpr(p.peek()) {
+			break
+		}
+		y := elem()
+		tuple.Children = append(tuple.Children, y)
+		tuple.Last = y.End()
+	}
+	return tuple
+}
+
+func (p *parser) testList() Node {
+	return p.list(p.testOrStar)
+}
+
+func (p *parser) exprList() Node {
+	return p.list(func() Node { return p.starred(p.bitOr) })
+}
+
+func (p *parser) testOrStar() Node {
+	return p.starred(p.test)
+}
+
+func (p *parser) starred(elem func() Node) Node {
+	if !p.is("*") {
+		return elem()
+	}
+	star := p.next()
+	x := p.bitOr()
+	return &Expr{First: star, Last: x.End(), Children: []Node{x}}
+}
+
+// yieldOrTestList parses a yield expression, eg. the value of x = yield y, or a test list.
+func (p *parser) yieldOrTestList() Node {
+	if !p.is("yield") {
+		return p.testList()
+	}
+	x := &Expr{First: p.next()}
+	x.Last = x.First
+	switch {
+	case p.is("from"):
+		p.next()
+		x.Children = []Node{p.test()}
+	case canStartExpr(p.peek()):
+		x.Children = []Node{p.testList()}
+	}
+	if len(x.Children) > 0 {
+		x.Last = x.Children[0].End()
+	}
+	return x
+}
+
+// namedExpr parses an assignment expression, eg. n := len(a), or a test.
+func (p *parser) namedExpr() Node {
+	if p.peek().Kind != KindName || !isText(p.peekAt(1), ":=") {
+		return p.test()
+	}
+	name := &Name{Tok: p.next()}
+	op := p.next()
+	return &NamedExpr{Name: name, Op: op, Value: p.test()}
+}
+
+func (p *parser) test() Node {
+	if p.is("lambda") {
+		keyword := p.next()
+		nodes := p.parameters(":", false)
+		p.expect(":")
+		body := p.test()
+		return &Expr{First: keyword, Last: body.End(), Children: append(nodes, body)}
+	}
+	x := p.orTest()
+	if !p.is("if") {
+		return x
+	}
+	p.next()
+	condition := p.orTest()
+	p.expect("else")
+	y := p.test()
+	return &Expr{First: x.Start(), Last: y.End(), Children: []Node{x, condition, y}}
+}
+
+// binary parses a left associative binary operation of the operands parsed by operand.
+func (p *parser) binary(operand func() Node, ops ...string) Node {
+	x := operand()
+	for p.isAny(ops...) {
+		p.next()
+		y := operand()
+		x = &Expr{First: x.Start(), Last: y.End(), Children: []Node{x, y}}
+	}
+	return x
+}
+
+func (p *parser) orTest() Node {
+	return p.binary(p.andTest, "or")
+}
+
+func (p *parser) andTest() Node {
+	return p.binary(p.notTest, "and")
+}
+
+func (p *parser) notTest() Node {
+	if !p.is("not") {
+		return p.comparison()
+	}
+	not := p.next()
+	x := p.notTest()
+	return &Expr{First: not, Last: x.End(), Children: []Node{x}}
+}
+
+func (p *parser) comparison() Node {
+	x := p.bitOr()
+	for {
+		switch {
+		case p.isAny("<", ">", "==", ">=", "<=", "!=", "in"):
+			p.next()
+		case p.is("is"):
+			p.next()
+			if p.is("not") {
+				p.next()
+			}
+		case p.is("not") && isText(p.peekAt(1), "in"):
+			p.next()
+			p.next()
+		default:
+			return x
+		}
+		y := p.bitOr()
+		x = &Expr{First: x.Start(), Last: y.End(), Children: []Node{x, y}}
+	}
+}
+
+func (p *parser) bitOr() Node {
+	return p.binary(p.bitXor, "|")
+}
+
+func (p *parser) bitXor() Node {
+	return p.binary(p.bitAnd, "^")
+}
+
+func (p *parser) bitAnd() Node {
+	return p.binary(p.shift, "&")
+}
+
+func (p *parser) shift() Node {
+	return p.binary(p.arith, "<<", ">>")
+}
+
+func (p *parser) arith() Node {
+	return p.binary(p.term, "+", "-")
+}
+
+func (p *parser) term() Node {
+	return p.binary(p.factor, "*", "/", "%", "//", "@")
+}
+
+func (p *parser) factor() Node {
+	if !p.isAny("+", "-", "~") {
+		return p.power()
+	}
+	op := p.next()
+	x := p.factor()
+	return &Expr{First: op, Last: x.End(), Children: []Node{x}}
+}
+
+func (p *parser) power() Node {
+	var await *Token
+	if p.is("await") {
+		await = p.next()
+	}
+	x := p.trailers(p.atom())
+	if await != nil {
+		x = &Expr{First: await, Last: x.End(), Children: []Node{x}}
+	}
+	if !p.is("**") {
+		return x
+	}
+	p.next()
+	y := p.factor()
+	return &Expr{First: x.Start(), Last: y.End(), Children: []Node{x, y}}
+}
+
+func (p *parser) trailers(x Node) Node {
+	for {
+		switch {
+		case p.is("("):
+			call := &Call{Func: x, Lparen: p.next()}
+			call.Args = p.arguments(")")
+			call.Rparen = p.expect(")")
+			x = call
+		case p.is("["):
+			p.next()
+			x = &Subscript{X: x, Index: p.subscripts(), Rbrack: p.expect("]")}
+		case p.is("."):
+			p.next()
+			x = &Attribute{X: x, Name: p.expectKind(KindName, "an attribute name")}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) arguments(close string) []*Arg {
+	var args []*Arg
+	for !p.is(close) {
+		arg := &Arg{}
+		switch {
+		case p.isAny("*", "**"):
+			star := p.next()
+			x := p.test()
+			arg.Value = &Expr{First: star, Last: x.End(), Children: []Node{x}}
+		case p.peek().Kind == KindName && isText(p.peekAt(1), "="):
+			arg.Keyword = p.next()
+			p.next()
+			arg.Value = p.test()
+		default:
+			arg.Value = p.comprehension(p.namedExpr())
+		}
+		args = append(args, arg)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	return args
+}
+
+// subscripts parses the indexes and slices of a subscript, returning a tuple when there are
+// several.
+func (p *parser) subscripts() Node {
+	x := p.subscript()
+	if !p.is(",") {
+		return x
+	}
+	tuple := &Expr{First: x.Start(), Children: []Node{x}}
+	for p.is(",") {
+		tuple.Last = p.next()
+		if p.is("]") {
+			break
+		}
+		y := p.subscript()
+		tuple.Children = append(tuple.Children, y)
+		tuple.Last = y.End()
+	}
+	return tuple
+}
+
+func (p *parser) subscript() Node {
+	first := p.peek()
+	var parts []Node
+	if !p.is(":") {
+		x := p.namedExpr()
+		if !p.is(":") {
+			return x
+		}
+		parts = append(parts, x)
+	}
+	last := p.next()
+	if !p.isAny("]", ",", ":") {
+		x := p.test()
+		parts = append(parts, x)
+		last = x.End()
+	}
+	if p.is(":") {
+		last = p.next()
+		if !p.isAny("]", ",") {
+			x := p.test()
+			parts = append(parts, x)
+			last = x.End()
+		}
+	}
+	return &Expr{First: first, Last: last, Children: parts}
+}
+
+// comprehension parses the for and if clauses following the element x of a comprehension,
+// returning x when there are none.
+func (p *parser) comprehension(x Node) Node {
+	if !p.is("for") {
+		return x
+	}
+	comprehension := &Expr{First: x.Start(), Children: []Node{x}}
+	for p.isAny("for", "if") {
+		var y Node
+		if p.next().Text == "for" {
+			y = p.exprList()
+			comprehension.Children = append(comprehension.Children, y)
+			p.expect("in")
+		}
+		y = p.orTest()
+		comprehension.Children = append(comprehension.Children, y)
+		comprehension.Last = y.End()
+	}
+	return comprehension
+}
+
+func (p *parser) atom() Node {
+	t := p.peek()
+	switch t.Kind {
+	case KindNumber:
+		return &Literal{Toks: []*Token{p.next()}}
+	case KindString:
+		lit := &Literal{}
+		for p.peek().Kind == KindString {
+			lit.Toks = append(lit.Toks, p.next())
+		}
+		return lit
+	case KindName:
+		switch {
+		case t.Text == "True" || t.Text == "False" || t.Text == "None":
+			return &Literal{Toks: []*Token{p.next()}}
+		case !keywords[t.Text]:
+			return &Name{Tok: p.next()}
+		}
+	case KindOp:
+		switch t.Text {
+		case "...":
+			return &Literal{Toks: []*Token{p.next()}}
+		case "(", "[":
+			p.next()
+			close := map[string]string{"(": ")", "[": "]"}[t.Text]
+			group := &Expr{First: t}
+			switch {
+			case t.Text == "(" && p.is("yield"):
+				group.Children = []Node{p.yieldOrTestList()}
+			case !p.is(close):
+				group.Children = p.elements(close)
+			}
+			group.Last = p.expect(close)
+			return group
+		case "{":
+			return p.dictOrSet()
+		}
+	}
+	p.unexpected("")
+	return nil
+}
+
+// elements parses the elements of a list, a tuple or a set display up to the closing token.
+func (p *parser) elements(close string) []Node {
+	element := func() Node { return p.starred(p.namedExpr) }
+	x := p.comprehension(element())
+	nodes := []Node{x}
+	for p.is(",") {
+		p.next()
+		if p.is(close) {
+			break
+		}
+		nodes = append(nodes, element())
+	}
+	return nodes
+}
+
+func (p *parser) dictOrSet() Node {
+	lbrace := p.next()
+	if p.is("}") {
+		return &Dict{Lbrace: lbrace, Rbrace: p.next()}
+	}
+	if p.is("*") || (!p.is("**") && !p.isDictItem()) {
+		set := &Expr{First: lbrace, Children: p.elements("}")}
+		set.Last = p.expect("}")
+		return set
+	}
+	dict := &Dict{Lbrace: lbrace}
+	for !p.is("}") {
+		item := &DictItem{}
+		if p.is("**") {
+			star := p.next()
+			x := p.bitOr()
+			item.Value = &Expr{First: star, Last: x.End(), Children: []Node{x}}
+		} else {
+			item.Key = p.test()
+			p.expect(":")
+			item.Value = p.test()
+			if p.is("for") {
+				comprehension := p.comprehension(item.Value).(*Expr)
+				comprehension.First = item.Key.Start()
+				comprehension.Children = append([]Node{item.Key}, comprehension.Children...)
+				item.Key, item.Value = nil, comprehension
+			}
+		}
+		dict.Items = append(dict.Items, item)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	dict.Rbrace = p.expect("}")
+	return dict
+}
+
+// isDictItem returns whether the next expression is followed by a colon, without consuming it.
+func (p *parser) isDictItem() bool {
+	pos := p.pos
+	defer func() {
+		p.pos = pos
+		recover()
+	}()
+	p.test()
+	return p.is(":")
+}
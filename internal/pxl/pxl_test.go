@@ -0,0 +1,208 @@
+package pxl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const spansScript = `#px:set max_output_rows_per_table=1500
+
+import px
+
+ns_per_ms = 1000 * 1000
+ns_per_s = 1000 * ns_per_ms
+
+
+def remove_ns_prefix(column):
+    return px.replace('[a-z0-9\-]*/', column, '')
+
+
+@px.vis.vega
+def http_spans(start_time: str, \
+               namespace: str = '') -> px.DataFrame:
+    """Returns the HTTP spans.
+
+    The latency is converted to milliseconds.
+    """
+    df = px.DataFrame(table='http_events', start_time=start_time)
+    df = df[df.trace_role == 2]  # server side
+    df.pod = df.ctx['pod']
+    df.service = remove_ns_prefix(df.ctx['service'])
+    df.latency_ms = df.latency / ns_per_ms if df.latency > 0 else 0
+    df.path = df.req_path[0:64]
+    df = df[not px.contains(df.req_path, '/healthz') and df.resp_status not in [301, 302]]
+    df = df[df.namespace != '' or namespace == '']
+    df.start_time = df.time_ - df.latency
+    return df[['time_', 'start_time', 'pod', 'service', 'latency_ms', 'path']]
+
+
+df = http_spans(px.plugin.start_time)
+df.cluster_name = px.vizier_name()
+codes = {code: str(code) for code in [200, 404]}
+retries = [n for n in range(3) if n % 2 == 0]
+scale = lambda x, factor=2: x * factor
+df.latency_ms *= 1.5e-3
+px.export(df, px.otel.Data(
+  resource={
+      'service.name': df.service,
+      'k8s.cluster.name': df.cluster_name,
+      **{},
+  },
+  data=[
+    px.otel.trace.Span(
+      name=df.path,
+      start_time=df.start_time,
+      end_time=df.time_,
+      kind=px.otel.trace.SPAN_KIND_SERVER,
+      attributes={'http.method': df.req_method},
+    ),
+  ],
+))`
+
+func TestParse(t *testing.T) {
+	file, err := Parse(spansScript)
+	assert.NoError(t, err)
+	assert.Equal(t, spansScript, file.String())
+
+	var calls []string
+	Inspect(file.Stmts, func(n Node) bool {
+		if call, ok := n.(*Call); ok && DottedName(call.Func) != "" {
+			calls = append(calls, DottedName(call.Func))
+		}
+		return true
+	})
+	assert.Equal(t, []string{
+		"px.replace", "px.DataFrame", "remove_ns_prefix", "px.contains", "http_spans",
+		"px.vizier_name", "str", "range", "px.export", "px.otel.Data", "px.otel.trace.Span",
+	}, calls)
+
+	var imports []string
+	var exports int
+	Walk(file.Stmts, func(s Stmt) {
+		switch s := s.(type) {
+		case *Import:
+			imports = append(imports, s.Names...)
+		case *ExprStmt:
+			if call, ok := IsCall(s.X, "px.export"); ok {
+				exports++
+				data, _ := IsCall(call.Args[1].Value, "px.otel.Data")
+				var keys []string
+				for _, item := range data.Keyword("resource").(*Dict).Items {
+					if key, ok := item.Key.(*Literal); ok {
+						value, _ := key.StringValue()
+						keys = append(keys, value)
+					}
+				}
+				assert.Equal(t, []string{"service.name", "k8s.cluster.name"}, keys)
+				assert.Nil(t, data.Keyword("unknown"))
+			}
+		}
+	})
+	assert.Equal(t, []string{"px"}, imports)
+	assert.Equal(t, 1, exports)
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, script := range []string{
+		"",
+		"\n\n# only a comment",
+		"import px\n",
+		"import px as p, os.path\nfrom px.otel import trace, Data as D\nfrom . import (a, b,)\n",
+		"x = 1; y = 2;\n",
+		"a = b = c\n",
+		"a, *b = c, d\n",
+		"t: int = 1\nu: str\n",
+		"if a:\n  pass\nelif b: x = 1\nelse:\n\n  # comment\n  y = 2\n",
+		"for i, j in x:\n    continue\nelse:\n    break\n",
+		"while not done:\n    done = True\n",
+		"with open(f) as g, h:\n\tpass\n",
+		"try:\n  x()\nexcept ValueError as e:\n  raise Exception('x') from e\nexcept:\n  pass\nfinally:\n  y()\n",
+		"class A(B, metaclass=M):\n    def f(self, *args, b=1, **kwargs):\n        return\n",
+		"x = {1, 2, *y}\ny = {}\nz = {**a, 'b': 1}\ns = (i for i in x)\n",
+		"x = a[1:2, ::3, :]\ny = a[...]\nz = (-a) ** -b // ~c\n",
+		"x = a is not b and c not in d or e <= f < g\n",
+		"s = r'\\d' b\"x\" 'y'\nd = '''a\n'b'\n'''\n",
+		"x = 0x1F + 1_000 + 1e-3 + .5j\n",
+		"x = [\n  1,  # one\n  2,\n]\ny = 1 + \\\n    2",
+		"if (n := len(a)) > 1:\n  pass\nwhile m := f():\n  pass\nx = [y := 1, y]\nf(z := 2)\nw = a[i := 0]\n",
+		"def g():\n    x = yield 1, 2\n    y = yield\n    z = (yield from g())\n    yield\n",
+	} {
+		file, err := Parse(script)
+		if assert.NoError(t, err, script) {
+			assert.Equal(t, script, file.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for script, expected := range map[string]string{
+		"df = df[df.a == 1":               "line 1: unclosed '['",
+		"df = df.a)\n":                    "line 1: unbalanced ')'",
+		"x = 'abc\n":                      "line 1: unterminated string",
+		"x = '''abc\n\n":                  "line 1: unterminated string",
+		"x = 1 $ 2\n":                     "line 1: unexpected character '$'",
+		"import px\n  x = 1\n":            "line 2: unexpected indent",
+		"if x:\n    y = 1\n  z = 2\n":     "line 3: unindent does not match any outer indentation level",
+		"def f():\nreturn 1\n":            "line 2: unexpected 'return', expected an indented block",
+		"x = = 1\n":                       "line 1: unexpected '='",
+		"px.export(df\n  px.otel.Data())": "line 2: unexpected 'px', expected ')'",
+		"x = 1 if y\n":                    "line 1: unexpected end of line, expected 'else'",
+		"@decorator\nx = 1\n":             "line 2: unexpected 'x', expected a function or class definition",
+		"x = (1,\n":                       "line 1: unclosed '('",
+	} {
+		_, err := Parse(script)
+		assert.EqualError(t, err, expected, script)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	file, err := Parse("import px\n\ndef f(df):\n    # export\n    px.export(df, px.otel.Data(resource={}, data=[]))\n\ndf.name = px.vizier_name( )  # name\nf(df)\n")
+	assert.NoError(t, err)
+	Inspect(file.Stmts, func(n Node) bool {
+		if call, ok := IsCall(n, "px.vizier_name"); ok {
+			file.Replace(call, "'cluster'")
+		}
+		if call, ok := IsCall(n, "px.otel.Data"); ok {
+			file.InsertAfter(call.Keyword("resource").Start(), "'a': 1,")
+		}
+		return true
+	})
+	Walk(file.Stmts, func(s Stmt) {
+		if stmt, ok := s.(*ExprStmt); ok {
+			if _, ok := IsCall(stmt.X, "px.export"); ok {
+				file.InsertBefore(stmt, []string{"df = df.head(10)", "", "df.x = 1"})
+			}
+		}
+	})
+	assert.Equal(t, "import px\n\ndef f(df):\n    # export\n    df = df.head(10)\n\n    df.x = 1\n    px.export(df, px.otel.Data(resource={'a': 1,}, data=[]))\n\ndf.name = 'cluster'  # name\nf(df)\n", file.String())
+}
+
+func TestTextAndStartsLine(t *testing.T) {
+	file, err := Parse("import px\nif True:\n    px.export(df[df.x > 1], px.otel.Data(data=[]))\na = 1; px.export(df)\nif True: px.export(df)\n")
+	assert.NoError(t, err)
+	var texts []string
+	var startsLine []bool
+	Walk(file.Stmts, func(s Stmt) {
+		if stmt, ok := s.(*ExprStmt); ok {
+			call, _ := IsCall(stmt.X, "px.export")
+			texts = append(texts, file.Text(call.Args[0].Value))
+			startsLine = append(startsLine, file.StartsLine(stmt))
+		}
+	})
+	assert.Equal(t, []string{"df[df.x > 1]", "df", "df"}, texts)
+	assert.Equal(t, []bool{true, false, false}, startsLine)
+}
+
+func TestParseNamedExpr(t *testing.T) {
+	file, err := Parse("df = df[(n := df.latency) > 1]\n")
+	assert.NoError(t, err)
+	var names []string
+	Inspect(file.Stmts, func(n Node) bool {
+		if named, ok := n.(*NamedExpr); ok {
+			names = append(names, named.Name.Tok.Text+" := "+DottedName(named.Value))
+		}
+		return true
+	})
+	assert.Equal(t, []string{"n := df.latency"}, names)
+}
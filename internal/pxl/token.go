@@ -0,0 +1,289 @@
+package pxl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind is the kind of a token.
+type Kind int
+
+const (
+	KindName Kind = iota
+	KindNumber
+	KindString
+	KindOp
+	// KindNewline ends a logical line. It is empty when the script doesn't end with a newline.
+	KindNewline
+	// KindIndent and KindDedent are empty tokens marking the start and the end of a block.
+	KindIndent
+	KindDedent
+	KindEOF
+)
+
+// Token is a token of a script. Prefix holds the whitespace, comments, blank lines and line
+// continuations preceding the token, so the concatenation of the prefixes and the texts of
+// the tokens is the script.
+type Token struct {
+	Kind   Kind
+	Prefix string
+	Text   string
+	// Line is the line of the token, starting at 1.
+	Line int
+
+	index  int
+	suffix string
+}
+
+// Error is a syntax error at a line of the script.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// operators are sorted so that the longest operator matches first.
+var operators = []string{
+	"**=", "//=", ">>=", "<<=", "...",
+	"->", "**", "//", "<<", ">>", "<=", ">=", "==", "!=", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "@=", ":=",
+	"+", "-", "*", "/", "%", "@", "&", "|", "^", "~", "<", ">", "(", ")", "[", "]", "{", "}", ",", ":", ".", ";", "=",
+}
+
+var closing = map[string]string{")": "(", "]": "[", "}": "{"}
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	tokens []*Token
+	prefix strings.Builder
+	// brackets holds the tokens of the unclosed brackets.
+	brackets []*Token
+	indents  []int
+	// atLineStart is true until the first token of a logical line.
+	atLineStart bool
+}
+
+func tokenize(src string) ([]*Token, error) {
+	l := &lexer{src: src, line: 1, indents: []int{0}, atLineStart: true}
+	if err := l.run(); err != nil {
+		return nil, err
+	}
+	return l.tokens, nil
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) emit(kind Kind, text string) {
+	t := &Token{Kind: kind, Prefix: l.prefix.String(), Text: text, Line: l.line, index: len(l.tokens)}
+	l.prefix.Reset()
+	l.tokens = append(l.tokens, t)
+}
+
+// emitEmpty adds a token without prefix nor text, eg. an indent.
+func (l *lexer) emitEmpty(kind Kind) {
+	l.tokens = append(l.tokens, &Token{Kind: kind, Line: l.line, index: len(l.tokens)})
+}
+
+func (l *lexer) run() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\f' || c == '\r':
+			l.prefix.WriteByte(c)
+			l.pos++
+		case c == '#':
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end < 0 {
+				end = len(l.src) - l.pos
+			}
+			l.prefix.WriteString(l.src[l.pos : l.pos+end])
+			l.pos += end
+		case c == '\\' && strings.HasPrefix(l.src[l.pos+1:], "\n"):
+			l.prefix.WriteString("\\\n")
+			l.pos += 2
+			l.line++
+		case c == '\n':
+			if l.atLineStart || len(l.brackets) > 0 {
+				// Blank lines and newlines within brackets don't end a logical line.
+				l.prefix.WriteByte(c)
+			} else {
+				l.emit(KindNewline, "\n")
+				l.atLineStart = true
+			}
+			l.pos++
+			l.line++
+		default:
+			if err := l.token(); err != nil {
+				return err
+			}
+		}
+	}
+	if !l.atLineStart {
+		l.emitEmpty(KindNewline)
+	}
+	if len(l.brackets) > 0 {
+		unclosed := l.brackets[len(l.brackets)-1]
+		return &Error{Line: unclosed.Line, Msg: fmt.Sprintf("unclosed '%s'", unclosed.Text)}
+	}
+	for len(l.indents) > 1 {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.emitEmpty(KindDedent)
+	}
+	l.emit(KindEOF, "")
+	return nil
+}
+
+func (l *lexer) token() error {
+	if l.atLineStart && len(l.brackets) == 0 {
+		if err := l.indent(); err != nil {
+			return err
+		}
+		l.atLineStart = false
+	}
+	rest := l.src[l.pos:]
+	c := rest[0]
+	switch {
+	case isNameStart(c):
+		if n := stringPrefixLen(rest); n > 0 {
+			return l.string(n)
+		}
+		end := 1
+		for end < len(rest) && isNameChar(rest[end]) {
+			end++
+		}
+		l.emit(KindName, rest[:end])
+		l.pos += end
+	case isDigit(c) || (c == '.' && len(rest) > 1 && isDigit(rest[1])):
+		end := 1
+		for end < len(rest) && (isNameChar(rest[end]) || rest[end] == '.' ||
+			((rest[end] == '+' || rest[end] == '-') && (rest[end-1] == 'e' || rest[end-1] == 'E') && !strings.HasPrefix(strings.ToLower(rest), "0x"))) {
+			end++
+		}
+		l.emit(KindNumber, rest[:end])
+		l.pos += end
+	case c == '\'' || c == '"':
+		return l.string(0)
+	default:
+		for _, op := range operators {
+			if strings.HasPrefix(rest, op) {
+				if err := l.closeBracket(op); err != nil {
+					return err
+				}
+				l.emit(KindOp, op)
+				l.pos += len(op)
+				if op == "(" || op == "[" || op == "{" {
+					l.brackets = append(l.brackets, l.tokens[len(l.tokens)-1])
+				}
+				return nil
+			}
+		}
+		return l.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+// indent emits the indent or dedent tokens of a logical line starting at the current column.
+func (l *lexer) indent() error {
+	prefix := l.prefix.String()
+	column := len(prefix) - strings.LastIndexAny(prefix, "\n") - 1
+	current := l.indents[len(l.indents)-1]
+	switch {
+	case column > current:
+		l.indents = append(l.indents, column)
+		l.emitEmpty(KindIndent)
+	case column < current:
+		for column < l.indents[len(l.indents)-1] {
+			l.indents = l.indents[:len(l.indents)-1]
+			l.emitEmpty(KindDedent)
+		}
+		if column != l.indents[len(l.indents)-1] {
+			return l.errorf("unindent does not match any outer indentation level")
+		}
+	}
+	return nil
+}
+
+// closeBracket pops the bracket closed by op, if op is a closing bracket.
+func (l *lexer) closeBracket(op string) error {
+	opening, ok := closing[op]
+	if !ok {
+		return nil
+	}
+	if len(l.brackets) == 0 || l.brackets[len(l.brackets)-1].Text != opening {
+		return l.errorf("unbalanced '%s'", op)
+	}
+	l.brackets = l.brackets[:len(l.brackets)-1]
+	return nil
+}
+
+// string emits the string literal starting after the prefix of n characters, eg. r or b.
+func (l *lexer) string(n int) error {
+	rest := l.src[l.pos:]
+	quote := rest[n : n+1]
+	if strings.HasPrefix(rest[n:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	line := l.line
+	end := n + len(quote)
+	for {
+		if end >= len(rest) {
+			l.line = line
+			return l.errorf("unterminated string")
+		}
+		switch {
+		case rest[end] == '\\' && end+1 < len(rest):
+			if rest[end+1] == '\n' {
+				l.line++
+			}
+			end += 2
+			continue
+		case strings.HasPrefix(rest[end:], quote):
+			end += len(quote)
+			text := rest[:end]
+			t := &Token{Kind: KindString, Prefix: l.prefix.String(), Text: text, Line: line, index: len(l.tokens)}
+			l.prefix.Reset()
+			l.tokens = append(l.tokens, t)
+			l.pos += end
+			return nil
+		case rest[end] == '\n':
+			if len(quote) == 1 {
+				l.line = line
+				return l.errorf("unterminated string")
+			}
+			l.line++
+		}
+		end++
+	}
+}
+
+// stringPrefixLen returns the length of the prefix of a string literal, eg. 1 for r'\d+',
+// and 0 when s doesn't start with a prefixed string literal.
+func stringPrefixLen(s string) int {
+	for n := 1; n <= 2 && n < len(s); n++ {
+		if !strings.ContainsRune("rRbBuUfF", rune(s[n-1])) {
+			return 0
+		}
+		if s[n] == '\'' || s[n] == '"' {
+			return n
+		}
+	}
+	return 0
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,129 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+// ChangeRecord is the audit record of a single script change applied to Pixie. Old values
+// are only set for updates and deletions, new values for creations and updates.
+type ChangeRecord struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	ClusterName    string    `json:"clusterName"`
+	ClusterId      string    `json:"clusterId"`
+	ScriptName     string    `json:"scriptName"`
+	ScriptId       string    `json:"scriptId,omitempty"`
+	Reasons        []string  `json:"reasons"`
+	OldClusterIds  string    `json:"oldClusterIds,omitempty"`
+	OldFrequencyS  *int64    `json:"oldFrequencyS,omitempty"`
+	NewFrequencyS  *int64    `json:"newFrequencyS,omitempty"`
+	OldContentHash string    `json:"oldContentHash,omitempty"`
+	NewContentHash string    `json:"newContentHash,omitempty"`
+}
+
+func newChangeRecord(action string, cp *ClusterPlan, s *script.Script, err error) ChangeRecord {
+	record := ChangeRecord{
+		Time:        time.Now().UTC(),
+		Action:      action,
+		Outcome:     metrics.OutcomeSuccess,
+		ClusterName: cp.ClusterName,
+		ClusterId:   cp.ClusterId,
+		ScriptName:  s.Name,
+		ScriptId:    s.ScriptId,
+	}
+	if err != nil {
+		record.Outcome = metrics.OutcomeFailure
+		record.Error = err.Error()
+	}
+	switch action {
+	case metrics.OperationCreate:
+		record.Reasons = []string{script.ReasonNew}
+		record.setNew(s)
+	case metrics.OperationUpdate:
+		record.Reasons = script.Reasons(s.Changes)
+		record.setNew(s)
+		if current, ok := cp.current[s.ScriptId]; ok {
+			record.setOld(current)
+		}
+	case metrics.OperationDelete:
+		record.Reasons = []string{script.ReasonOrphaned}
+		if cp.cleanup {
+			record.Reasons = []string{script.ReasonCleanup}
+		}
+		record.setOld(s)
+	}
+	return record
+}
+
+func (c *ChangeRecord) setOld(s *script.Script) {
+	frequencyS := s.FrequencyS
+	c.OldFrequencyS = &frequencyS
+	c.OldContentHash = contentHash(s.Script)
+	if s.ClusterIds != c.ClusterId {
+		c.OldClusterIds = s.ClusterIds
+	}
+}
+
+func (c *ChangeRecord) setNew(s *script.Script) {
+	frequencyS := s.FrequencyS
+	c.NewFrequencyS = &frequencyS
+	c.NewContentHash = contentHash(s.Script)
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// audit logs the change records and appends them to the audit file, if any. Failing to
+// write the audit file doesn't fail the reconcile pass.
+func (r *Reconciler) audit(records []ChangeRecord) {
+	if len(records) == 0 {
+		return
+	}
+	lines := make([][]byte, 0, len(records))
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.WithError(err).Warn("encoding the script change record failed")
+			continue
+		}
+		log.Infof("Script change: %s", line)
+		lines = append(lines, line)
+	}
+	if r.auditFile == "" {
+		return
+	}
+	if err := appendLines(r.auditFile, lines); err != nil {
+		log.WithError(err).Warnf("writing the audit file %s failed", r.auditFile)
+	}
+}
+
+func appendLines(path string, lines [][]byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+// Cleanup deletes the nri- scripts of every configured cluster. With disablePlugin, the
+// New Relic plugin is disabled as well once no other cluster has nri- scripts left.
+func (r *Reconciler) Cleanup(ctx context.Context, disablePlugin bool) (Summary, error) {
+	var summary Summary
+	plan, err := r.CleanupPlan(ctx, disablePlugin)
+	if err != nil {
+		return summary, err
+	}
+	summary.PluginVersion = plan.PluginVersion
+
+	if errs := r.applyClusters(ctx, plan, &summary); len(errs) > 0 {
+		if plan.DisablePlugin {
+			log.Warn("Not disabling the New Relic plugin as not every script could be deleted")
+		}
+		return summary, fmt.Errorf("errors while cleaning up clusters: %s", strings.Join(errs, "; "))
+	}
+
+	if plan.DisablePlugin {
+		log.Info("Disabling the New Relic plugin")
+		if err := r.client.DisableNewRelicPlugin(ctx); err != nil {
+			return summary, fmt.Errorf("failed to disable New Relic plugin: %w", err)
+		}
+	}
+	return summary, nil
+}
+
+// CleanupPlan performs only read calls against Pixie and returns the changes a cleanup pass
+// would apply. The plugin is only disabled when it's enabled and every nri- script belongs
+// to the configured clusters.
+func (r *Reconciler) CleanupPlan(ctx context.Context, disablePlugin bool) (*Plan, error) {
+	plan := &Plan{cleanup: true}
+	log.Debug("Checking the current New Relic plugin configuration")
+	plugin, err := r.client.GetNewRelicPlugin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting data retention plugins failed: %w", err)
+	}
+	plan.PluginVersion = plugin.LatestVersion
+
+	log.Debug("Getting the data retention scripts")
+	scripts, err := r.client.GetRetentionScripts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data retention scripts: %w", err)
+	}
+
+	remaining := 0
+	for _, s := range scripts {
+		if script.IsNewRelicScript(s.ScriptName) {
+			remaining++
+		}
+	}
+	failed := false
+	for _, cluster := range r.cfg.Worker().Clusters() {
+		cp := &ClusterPlan{
+			ClusterId:   cluster.ID(),
+			ClusterName: cluster.Name(),
+			cleanup:     true,
+		}
+		plan.Clusters = append(plan.Clusters, cp)
+
+		log.Debugf("Getting current scripts for cluster %s", cluster.Name())
+		currentScripts, err := r.client.GetClusterScripts(ctx, scripts, cluster.ID(), cluster.Name())
+		if err != nil {
+			cp.setError(fmt.Errorf("failed to get data retention scripts: %w", err))
+			failed = true
+			continue
+		}
+		cp.setActions(script.ScriptActions{ToDelete: currentScripts}, currentScripts)
+		remaining -= len(currentScripts)
+	}
+
+	switch {
+	case !disablePlugin || !plugin.RetentionEnabled:
+	case failed:
+		log.Warn("Not disabling the New Relic plugin as the scripts of every cluster could not be listed")
+	case remaining > 0:
+		log.Infof("Not disabling the New Relic plugin as %d nri- scripts of other clusters remain", remaining)
+	default:
+		plan.DisablePlugin = true
+	}
+	return plan, nil
+}
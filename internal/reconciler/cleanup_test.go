@@ -0,0 +1,75 @@
+package reconciler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"px.dev/pxapi/proto/cloudpb"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+func newCleanupClient() *fakeClient {
+	return &fakeClient{
+		plugin: &cloudpb.Plugin{RetentionEnabled: true, LatestVersion: "0.0.3"},
+		listing: []*cloudpb.RetentionScript{
+			{ScriptName: "nri-JVM Metrics-test-cluster"},
+			{ScriptName: "nri-HTTP Metrics-other-cluster"},
+			{ScriptName: "JVM Metrics", IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-JVM Metrics-test-cluster", FrequencyS: 10}, ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", ClusterIds: testClusterId},
+			},
+			"other-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-HTTP Metrics-other-cluster", FrequencyS: 10}, ScriptId: "06906e7e-c684-4858-9fa1-e0bf552b40a6", ClusterIds: "b8749d5b-3352-4a0c-92ef-4a1479464b74"},
+			},
+		},
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	client := newCleanupClient()
+	summary, err := New(getTestConfig(t), client).Cleanup(context.Background(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, Summary{Deleted: 2, PluginVersion: "0.0.3"}, summary)
+	assert.ElementsMatch(t, []string{"4e4e51b2-86a8-4d57-a2a9-6771d15afcae", "06906e7e-c684-4858-9fa1-e0bf552b40a6"}, client.deleted)
+	assert.True(t, client.disabled)
+
+	client = newCleanupClient()
+	_, err = New(getTestConfig(t), client).Cleanup(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Len(t, client.deleted, 2)
+	assert.False(t, client.disabled)
+}
+
+func TestCleanupKeepsPlugin(t *testing.T) {
+	client := newCleanupClient()
+	client.listing = append(client.listing, &cloudpb.RetentionScript{ScriptName: "nri-JVM Metrics-third-cluster"})
+	summary, err := New(getTestConfig(t), client).Cleanup(context.Background(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Deleted)
+	assert.False(t, client.disabled)
+
+	client = newCleanupClient()
+	client.failClusters = map[string]bool{"other-cluster": true}
+	summary, err = New(getTestConfig(t), client).Cleanup(context.Background(), true)
+	assert.EqualError(t, err, "errors while cleaning up clusters: cluster other-cluster: failed to get data retention scripts: cluster other-cluster is unavailable")
+	assert.Equal(t, 1, summary.Deleted)
+	assert.False(t, client.disabled)
+}
+
+func TestCleanupPlan(t *testing.T) {
+	plan, err := New(getTestConfig(t), newCleanupClient()).CleanupPlan(context.Background(), true)
+	assert.NoError(t, err)
+	assert.True(t, plan.DisablePlugin)
+	assert.True(t, plan.HasChanges())
+	assert.Equal(t, []PlannedScript{{Name: "nri-JVM Metrics-test-cluster", ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", FrequencyS: 10}}, plan.Clusters[0].ToDelete)
+
+	var b strings.Builder
+	assert.NoError(t, plan.WriteText(&b))
+	assert.True(t, strings.HasPrefix(b.String(), "The New Relic plugin will be disabled\n"))
+	assert.Contains(t, b.String(), "  - nri-JVM Metrics-test-cluster [4e4e51b2-86a8-4d57-a2a9-6771d15afcae]\n")
+}
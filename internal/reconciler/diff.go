@@ -0,0 +1,112 @@
+package reconciler
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns the line based unified diff between a and b, or an empty string
+// when both are equal.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(strings.Split(a, "\n"), strings.Split(b, "\n"))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// Extend the hunk until there are more than 2*diffContext unchanged lines in a row.
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+		hunkStart := max(start-diffContext, 0)
+		hunkEnd := min(end+diffContext, len(ops))
+		writeHunk(&sb, ops, hunkStart, hunkEnd)
+		start = hunkEnd
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, ops []diffOp, from, to int) {
+	lineA, lineB := 1, 1
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			lineA++
+		}
+		if op.kind != '-' {
+			lineB++
+		}
+	}
+	countA, countB := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			countA++
+		}
+		if op.kind != '-' {
+			countB++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+	for _, op := range ops[from:to] {
+		fmt.Fprintf(sb, "%c%s\n", op.kind, op.line)
+	}
+}
+
+// diffLines computes the edit script between a and b using their longest common subsequence.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
@@ -0,0 +1,200 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+// Plan describes the changes a reconcile or a cleanup pass would apply to Pixie.
+type Plan struct {
+	EnablePlugin       bool           `json:"enablePlugin"`
+	EnablePluginReason string         `json:"enablePluginReason,omitempty"`
+	DisablePlugin      bool           `json:"disablePlugin,omitempty"`
+	PluginVersion      string         `json:"pluginVersion"`
+	Clusters           []*ClusterPlan `json:"clusters"`
+
+	cleanup bool
+}
+
+// ClusterPlan describes the script changes for a single cluster. Error is set when the
+// changes for the cluster could not be computed.
+type ClusterPlan struct {
+	ClusterId   string          `json:"clusterId"`
+	ClusterName string          `json:"clusterName"`
+	Error       string          `json:"error,omitempty"`
+	ToCreate    []PlannedScript `json:"toCreate"`
+	ToUpdate    []PlannedScript `json:"toUpdate"`
+	ToDelete    []PlannedScript `json:"toDelete"`
+	Failed      []PlannedScript `json:"failed"`
+
+	actions script.ScriptActions
+	current map[string]*script.Script
+	managed int
+	cleanup bool
+	err     error
+}
+
+// PlannedScript is a single script change of a Plan. Reasons, Changes and Diff are only
+// set for updates: Changes describes every changed field and Diff holds the unified diff
+// between the current and the desired PxL. Error is only set for the failed scripts, which
+// are left unchanged.
+type PlannedScript struct {
+	Name       string   `json:"name"`
+	ScriptId   string   `json:"scriptId,omitempty"`
+	FrequencyS int64    `json:"frequencyS"`
+	Reasons    []string `json:"reasons,omitempty"`
+	Changes    []string `json:"changes,omitempty"`
+	Diff       string   `json:"diff,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (cp *ClusterPlan) setError(err error) {
+	cp.err = err
+	cp.Error = err.Error()
+}
+
+func (cp *ClusterPlan) setActions(actions script.ScriptActions, currentScripts []*script.Script) {
+	cp.actions = actions
+	current := make(map[string]*script.Script)
+	for _, s := range currentScripts {
+		current[s.ScriptId] = s
+		if script.IsNewRelicScript(s.Name) {
+			cp.managed++
+		}
+	}
+	cp.current = current
+	cp.ToCreate = []PlannedScript{}
+	for _, s := range actions.ToCreate {
+		cp.ToCreate = append(cp.ToCreate, PlannedScript{Name: s.Name, FrequencyS: s.FrequencyS})
+	}
+	cp.ToUpdate = []PlannedScript{}
+	for _, s := range actions.ToUpdate {
+		var old string
+		if c, ok := current[s.ScriptId]; ok {
+			old = c.Script
+		}
+		cp.ToUpdate = append(cp.ToUpdate, PlannedScript{
+			Name:       s.Name,
+			ScriptId:   s.ScriptId,
+			FrequencyS: s.FrequencyS,
+			Reasons:    script.Reasons(s.Changes),
+			Changes:    describeChanges(s.Changes),
+			Diff:       unifiedDiff("current/"+s.Name, "desired/"+s.Name, old, s.Script),
+		})
+	}
+	cp.ToDelete = []PlannedScript{}
+	for _, s := range actions.ToDelete {
+		cp.ToDelete = append(cp.ToDelete, PlannedScript{Name: s.Name, ScriptId: s.ScriptId, FrequencyS: s.FrequencyS})
+	}
+	cp.Failed = []PlannedScript{}
+	for _, s := range actions.Failed {
+		cp.Failed = append(cp.Failed, PlannedScript{Name: s.Name, Error: s.Err.Error()})
+	}
+}
+
+// Managed returns the number of nri- scripts of the cluster before the plan is applied.
+func (cp *ClusterPlan) Managed() int {
+	return cp.managed
+}
+
+func describeChanges(changes []script.Change) []string {
+	descriptions := make([]string, 0, len(changes))
+	for _, c := range changes {
+		descriptions = append(descriptions, c.String())
+	}
+	return descriptions
+}
+
+func (cp *ClusterPlan) hasChanges() bool {
+	return len(cp.ToCreate) > 0 || len(cp.ToUpdate) > 0 || len(cp.ToDelete) > 0
+}
+
+// HasChanges returns true when applying the plan would mutate Pixie.
+func (p *Plan) HasChanges() bool {
+	if p.EnablePlugin || p.DisablePlugin {
+		return true
+	}
+	for _, cp := range p.Clusters {
+		if cp.hasChanges() {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes the machine-readable form of the plan.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteText writes the human-readable form of the plan.
+func (p *Plan) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	if p.cleanup {
+		if p.DisablePlugin {
+			ew.printf("The New Relic plugin will be disabled\n")
+		} else {
+			ew.printf("The New Relic plugin will be left unchanged\n")
+		}
+	} else if p.EnablePlugin {
+		ew.printf("The New Relic plugin (version %s) will be enabled: %s\n", p.PluginVersion, p.EnablePluginReason)
+	} else {
+		ew.printf("The New Relic plugin is already enabled and up-to-date\n")
+	}
+	for _, cp := range p.Clusters {
+		cp.writeText(ew)
+	}
+	if !p.HasChanges() {
+		ew.printf("\nNo changes. Pixie is in-sync with the configuration.\n")
+	}
+	return ew.err
+}
+
+func (cp *ClusterPlan) writeText(ew *errWriter) {
+	ew.printf("\nPlan for cluster %s (%s)\n", cp.ClusterName, cp.ClusterId)
+	if cp.Error != "" {
+		ew.printf("  Error: %s\n", cp.Error)
+		return
+	}
+	ew.printf("\nScripts to create: %d\n", len(cp.ToCreate))
+	for _, s := range cp.ToCreate {
+		ew.printf("  + %s (every %ds)\n", s.Name, s.FrequencyS)
+	}
+	ew.printf("\nScripts to update: %d\n", len(cp.ToUpdate))
+	for _, s := range cp.ToUpdate {
+		ew.printf("  ~ %s [%s] (every %ds)\n", s.Name, s.ScriptId, s.FrequencyS)
+		for _, change := range s.Changes {
+			ew.printf("    %s\n", change)
+		}
+		if s.Diff != "" {
+			ew.printf("%s", s.Diff)
+		}
+	}
+	ew.printf("\nScripts to delete: %d\n", len(cp.ToDelete))
+	for _, s := range cp.ToDelete {
+		ew.printf("  - %s [%s]\n", s.Name, s.ScriptId)
+	}
+	if len(cp.Failed) > 0 {
+		ew.printf("\nScripts left unchanged on errors: %d\n", len(cp.Failed))
+		for _, s := range cp.Failed {
+			ew.printf("  ! %s: %s\n", s.Name, s.Error)
+		}
+	}
+}
+
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,344 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"px.dev/pxapi/proto/cloudpb"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/config"
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
+	"github.com/newrelic/newrelic-pixie-integration/internal/pixie"
+	"github.com/newrelic/newrelic-pixie-integration/internal/pool"
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+const (
+	reasonPluginDisabled   = "the New Relic plugin is not enabled"
+	reasonLicenseKeyChange = "the New Relic plugin is configured with another license key"
+)
+
+// PixieClient is the subset of the Pixie API used to reconcile the data retention scripts.
+type PixieClient interface {
+	GetNewRelicPlugin(ctx context.Context) (*cloudpb.Plugin, error)
+	GetNewRelicPluginConfig(ctx context.Context) (*pixie.NewRelicPluginConfig, error)
+	EnableNewRelicPlugin(ctx context.Context, config *pixie.NewRelicPluginConfig, version string) error
+	DisableNewRelicPlugin(ctx context.Context) error
+	GetRetentionScripts(ctx context.Context) ([]*cloudpb.RetentionScript, error)
+	GetPresetScripts(ctx context.Context, scripts []*cloudpb.RetentionScript) ([]*script.ScriptDefinition, error)
+	GetClusterScripts(ctx context.Context, scripts []*cloudpb.RetentionScript, clusterId, clusterName string) ([]*script.Script, error)
+	AddDataRetentionScript(ctx context.Context, clusterId string, scriptName string, description string, frequencyS int64, contents string) error
+	UpdateDataRetentionScript(ctx context.Context, clusterId string, scriptId string, scriptName string, description string, frequencyS int64, contents string) error
+	DeleteDataRetentionScript(ctx context.Context, scriptId string) error
+}
+
+// Summary holds the outcome of a single reconcile pass. PluginVersion and Scripts, the
+// number of nri- scripts managed after the pass, are only set once the plan was computed.
+type Summary struct {
+	Created       int
+	Updated       int
+	Deleted       int
+	Failed        int
+	PluginVersion string
+	Scripts       int
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d deleted, %d failed", s.Created, s.Updated, s.Deleted, s.Failed)
+}
+
+func (s *Summary) add(other Summary) {
+	s.Created += other.Created
+	s.Updated += other.Updated
+	s.Deleted += other.Deleted
+	s.Failed += other.Failed
+	s.Scripts += other.Scripts
+}
+
+type Reconciler struct {
+	cfg       config.Config
+	client    PixieClient
+	auditFile string
+}
+
+func New(cfg config.Config, client PixieClient) *Reconciler {
+	return &Reconciler{
+		cfg:       cfg,
+		client:    client,
+		auditFile: cfg.Worker().AuditFile(),
+	}
+}
+
+// Reconcile enables the New Relic plugin when needed and brings the data retention scripts
+// of every cluster in-sync with the configuration. A failure in one cluster doesn't stop
+// the other clusters from being reconciled. Once ctx is done, the remaining script
+// operations are skipped and counted as failed.
+func (r *Reconciler) Reconcile(ctx context.Context) (Summary, error) {
+	var summary Summary
+	plan, err := r.Plan(ctx)
+	if err != nil {
+		return summary, err
+	}
+	summary.PluginVersion = plan.PluginVersion
+
+	if plan.EnablePlugin {
+		log.Infof("Enabling New Relic plugin: %s", plan.EnablePluginReason)
+		err := r.client.EnableNewRelicPlugin(ctx, &pixie.NewRelicPluginConfig{
+			LicenseKey: r.cfg.Exporter().LicenseKey(),
+			ExportUrl:  r.cfg.Exporter().Endpoint(),
+		}, plan.PluginVersion)
+		if err != nil {
+			return summary, fmt.Errorf("failed to enabled New Relic plugin: %w", err)
+		}
+	}
+
+	if errs := r.applyClusters(ctx, plan, &summary); len(errs) > 0 {
+		return summary, fmt.Errorf("errors while reconciling clusters: %s", strings.Join(errs, "; "))
+	}
+	return summary, nil
+}
+
+// applyClusters applies the script changes of every cluster plan, adds their outcome to the
+// summary and returns the errors of the failed clusters.
+func (r *Reconciler) applyClusters(ctx context.Context, plan *Plan, summary *Summary) []string {
+	var errs []string
+	for _, cp := range plan.Clusters {
+		if cp.err != nil {
+			errs = append(errs, fmt.Sprintf("cluster %s: %v", cp.ClusterName, cp.err))
+			continue
+		}
+		log.Infof("Setting up the data retention scripts for cluster %s", cp.ClusterName)
+		metrics.ScriptActions.Set(float64(len(cp.actions.ToCreate)), cp.ClusterName, metrics.OperationCreate)
+		metrics.ScriptActions.Set(float64(len(cp.actions.ToUpdate)), cp.ClusterName, metrics.OperationUpdate)
+		metrics.ScriptActions.Set(float64(len(cp.actions.ToDelete)), cp.ClusterName, metrics.OperationDelete)
+		clusterSummary, err := r.apply(ctx, cp)
+		metrics.ManagedScripts.Set(float64(clusterSummary.Scripts), cp.ClusterName)
+		log.Infof("Cluster %s: %s", cp.ClusterName, clusterSummary)
+		summary.add(clusterSummary)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("cluster %s: %v", cp.ClusterName, err))
+		}
+	}
+	return errs
+}
+
+// apply deletes, then updates and then creates the scripts of the cluster plan. The
+// operations of each phase run concurrently; their outcomes are recorded in plan order.
+func (r *Reconciler) apply(ctx context.Context, cp *ClusterPlan) (Summary, error) {
+	var summary Summary
+	var errs []error
+	var records []ChangeRecord
+	defer func() { r.audit(records) }()
+
+	// run applies the action to the scripts and returns the number of successful operations.
+	run := func(action string, scripts []*script.Script, fn func(s *script.Script) error) int {
+		results := pool.Run(len(scripts), r.cfg.Worker().Concurrency(), func(i int) error {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("skipped: %w", err)
+			}
+			return fn(scripts[i])
+		})
+		succeeded := 0
+		for i, err := range results {
+			s := scripts[i]
+			records = append(records, newChangeRecord(action, cp, s, err))
+			if err != nil {
+				metrics.ScriptOperations.Inc(cp.ClusterName, s.Name, action, metrics.OutcomeFailure)
+				errs = append(errs, err)
+				continue
+			}
+			metrics.ScriptOperations.Inc(cp.ClusterName, s.Name, action, metrics.OutcomeSuccess)
+			succeeded++
+		}
+		return succeeded
+	}
+
+	for _, s := range cp.actions.ToDelete {
+		log.Debugf("Deleting script %s", s.Name)
+	}
+	summary.Deleted = run(metrics.OperationDelete, cp.actions.ToDelete, func(s *script.Script) error {
+		return r.client.DeleteDataRetentionScript(ctx, s.ScriptId)
+	})
+
+	for _, s := range cp.actions.ToUpdate {
+		log.Infof("Updating script %s: %s", s.Name, strings.Join(describeChanges(s.Changes), "; "))
+	}
+	summary.Updated = run(metrics.OperationUpdate, cp.actions.ToUpdate, func(s *script.Script) error {
+		return r.client.UpdateDataRetentionScript(ctx, cp.ClusterId, s.ScriptId, s.Name, s.Description, s.FrequencyS, s.Script)
+	})
+
+	for _, s := range cp.actions.ToCreate {
+		log.Debugf("Creating script %s", s.Name)
+	}
+	summary.Created = run(metrics.OperationCreate, cp.actions.ToCreate, func(s *script.Script) error {
+		return r.client.AddDataRetentionScript(ctx, cp.ClusterId, s.Name, s.Description, s.FrequencyS, s.Script)
+	})
+
+	for _, s := range cp.actions.Failed {
+		log.WithError(s.Err).Errorf("Leaving script %s unchanged", s.Name)
+		errs = append(errs, fmt.Errorf("%s: %w", s.Name, s.Err))
+	}
+
+	summary.Failed = len(errs)
+	summary.Scripts = cp.managed - summary.Deleted + summary.Created
+	if len(errs) > 0 {
+		return summary, fmt.Errorf("errors while setting up data retention scripts: %v", errs)
+	}
+	return summary, nil
+}
+
+// Plan performs only read calls against Pixie and returns the changes a reconcile pass would apply.
+// Errors which only affect a single cluster are recorded in the plan of that cluster.
+func (r *Reconciler) Plan(ctx context.Context) (*Plan, error) {
+	plan := &Plan{}
+	if err := r.checkPlugin(ctx, plan); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Getting the data retention scripts")
+	scripts, err := r.client.GetRetentionScripts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data retention scripts: %w", err)
+	}
+
+	log.Debug("Getting preset script from the Pixie plugin")
+	defsFromPixie, err := r.client.GetPresetScripts(ctx, scripts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preset scripts: %w", err)
+	}
+
+	definitions, err := r.withCustomScripts(defsFromPixie)
+	if err != nil {
+		return nil, err
+	}
+	warnUnknownOverrides(definitions, r.cfg.Worker().ScriptOverrides())
+	r.warnPresetScripts(definitions)
+
+	for _, cluster := range r.cfg.Worker().Clusters() {
+		cp := &ClusterPlan{
+			ClusterId:   cluster.ID(),
+			ClusterName: cluster.Name(),
+		}
+		plan.Clusters = append(plan.Clusters, cp)
+
+		log.Debugf("Getting current scripts for cluster %s", cluster.Name())
+		currentScripts, err := r.client.GetClusterScripts(ctx, scripts, cluster.ID(), cluster.Name())
+		if err != nil {
+			cp.setError(fmt.Errorf("failed to get data retention scripts: %w", err))
+			continue
+		}
+
+		cp.setActions(script.GetActions(definitions, currentScripts, ScriptConfig(r.cfg.Worker(), cluster)), currentScripts)
+	}
+	return plan, nil
+}
+
+// ScriptConfig returns the config the scripts of the cluster are templated with.
+func ScriptConfig(worker config.Worker, cluster config.Cluster) script.ScriptConfig {
+	return script.ScriptConfig{
+		ClusterName:        cluster.Name(),
+		ClusterId:          cluster.ID(),
+		HttpSpanLimit:      cluster.HttpSpanLimit(),
+		DbSpanLimit:        cluster.DbSpanLimit(),
+		SpanLimits:         cluster.SpanLimits(),
+		DefaultSpanLimit:   cluster.DefaultSpanLimit(),
+		LimitMode:          worker.SpanLimitMode(),
+		SamplePercent:      worker.SamplePercent(),
+		CollectInterval:    worker.CollectInterval(),
+		Filters:            cluster.Filters(),
+		Overrides:          worker.ScriptOverrides(),
+		Variables:          cluster.ScriptVariables(),
+		Env:                worker.ScriptEnv(),
+		ResourceAttributes: cluster.ResourceAttributes(),
+	}
+}
+
+// Definitions returns the preset scripts of the Pixie plugin followed by the custom scripts
+// of the script directory.
+func (r *Reconciler) Definitions(ctx context.Context) ([]*script.ScriptDefinition, error) {
+	scripts, err := r.client.GetRetentionScripts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data retention scripts: %w", err)
+	}
+	presets, err := r.client.GetPresetScripts(ctx, scripts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preset scripts: %w", err)
+	}
+	return r.withCustomScripts(presets)
+}
+
+func (r *Reconciler) withCustomScripts(presets []*script.ScriptDefinition) ([]*script.ScriptDefinition, error) {
+	log.Debugf("Getting script definitions from %s", r.cfg.Worker().ScriptDir())
+	custom, err := config.ReadScriptDefinitions(r.cfg.Worker().ScriptDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script definitions from %s: %w", r.cfg.Worker().ScriptDir(), err)
+	}
+	return append(presets, custom...), nil
+}
+
+// warnPresetScripts logs the diagnostics of the preset scripts as templated for every
+// cluster, once. They can't be fixed here, so the scripts are registered anyway. The custom
+// scripts with diagnostics fail for their cluster only, see script.GetActions.
+func (r *Reconciler) warnPresetScripts(definitions []*script.ScriptDefinition) {
+	seen := make(map[string]bool)
+	for _, cluster := range r.cfg.Worker().Clusters() {
+		scriptConfig := ScriptConfig(r.cfg.Worker(), cluster)
+		for _, definition := range definitions {
+			if !definition.IsPreset {
+				continue
+			}
+			for _, diagnostic := range script.Validate(definition, scriptConfig) {
+				message := diagnostic.String()
+				if !seen[message] {
+					seen[message] = true
+					log.Warnf("Preset script %s", message)
+				}
+			}
+		}
+	}
+}
+
+func warnUnknownOverrides(definitions []*script.ScriptDefinition, overrides map[string]script.ScriptOverride) {
+	for name := range overrides {
+		found := false
+		for _, definition := range definitions {
+			if definition.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("Script override %s doesn't match any preset or custom script", name)
+		}
+	}
+}
+
+func (r *Reconciler) checkPlugin(ctx context.Context, plan *Plan) error {
+	log.Debug("Checking the current New Relic plugin configuration")
+	plugin, err := r.client.GetNewRelicPlugin(ctx)
+	if err != nil {
+		return fmt.Errorf("getting data retention plugins failed: %w", err)
+	}
+	plan.PluginVersion = plugin.LatestVersion
+
+	if !plugin.RetentionEnabled {
+		plan.EnablePlugin = true
+		plan.EnablePluginReason = reasonPluginDisabled
+		return nil
+	}
+
+	pluginConfig, err := r.client.GetNewRelicPluginConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("getting New Relic plugin config failed: %w", err)
+	}
+	if pluginConfig.ExportUrl != r.cfg.Exporter().Endpoint() {
+		return fmt.Errorf("the New Relic plugin is already installed with a different export URL")
+	}
+	if pluginConfig.LicenseKey != r.cfg.Exporter().LicenseKey() {
+		plan.EnablePlugin = true
+		plan.EnablePluginReason = reasonLicenseKeyChange
+	}
+	return nil
+}
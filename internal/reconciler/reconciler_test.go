@@ -0,0 +1,447 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"px.dev/pxapi/proto/cloudpb"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/config"
+	"github.com/newrelic/newrelic-pixie-integration/internal/metrics"
+	"github.com/newrelic/newrelic-pixie-integration/internal/pixie"
+	"github.com/newrelic/newrelic-pixie-integration/internal/script"
+)
+
+const (
+	testClusterId  = "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"
+	testLicenseKey = "eu01xxlicense"
+	testEndpoint   = "otlp.eu01.nr-data.net:443"
+	// testPreset has the namespace column filtered on by other-cluster.
+	testPreset = "df.namespace = df.ctx['namespace']\npx.export(df)"
+)
+
+type fakeClient struct {
+	mu             sync.Mutex
+	plugin         *cloudpb.Plugin
+	pluginConfig   *pixie.NewRelicPluginConfig
+	presets        []*script.ScriptDefinition
+	current        map[string][]*script.Script
+	listing        []*cloudpb.RetentionScript
+	failClusters   map[string]bool
+	failUpdate     bool
+	enabledVersion string
+	disabled       bool
+	listings       int
+	created        []string
+	updated        []string
+	deleted        []string
+	// registered holds the frequency and the PxL of the created and updated scripts by name.
+	registered map[string]*script.ScriptDefinition
+}
+
+func (f *fakeClient) register(scriptName string, frequencyS int64, contents string) {
+	if f.registered == nil {
+		f.registered = make(map[string]*script.ScriptDefinition)
+	}
+	f.registered[scriptName] = &script.ScriptDefinition{Name: scriptName, FrequencyS: frequencyS, Script: contents}
+}
+
+func (f *fakeClient) GetNewRelicPlugin(_ context.Context) (*cloudpb.Plugin, error) {
+	return f.plugin, nil
+}
+
+func (f *fakeClient) GetNewRelicPluginConfig(_ context.Context) (*pixie.NewRelicPluginConfig, error) {
+	return f.pluginConfig, nil
+}
+
+func (f *fakeClient) EnableNewRelicPlugin(_ context.Context, _ *pixie.NewRelicPluginConfig, version string) error {
+	f.enabledVersion = version
+	return nil
+}
+
+func (f *fakeClient) DisableNewRelicPlugin(_ context.Context) error {
+	f.disabled = true
+	return nil
+}
+
+func (f *fakeClient) GetRetentionScripts(_ context.Context) ([]*cloudpb.RetentionScript, error) {
+	f.listings++
+	return f.listing, nil
+}
+
+func (f *fakeClient) GetPresetScripts(_ context.Context, _ []*cloudpb.RetentionScript) ([]*script.ScriptDefinition, error) {
+	return f.presets, nil
+}
+
+func (f *fakeClient) GetClusterScripts(_ context.Context, _ []*cloudpb.RetentionScript, _, clusterName string) ([]*script.Script, error) {
+	if f.failClusters[clusterName] {
+		return nil, fmt.Errorf("cluster %s is unavailable", clusterName)
+	}
+	return f.current[clusterName], nil
+}
+
+func (f *fakeClient) AddDataRetentionScript(_ context.Context, _ string, scriptName string, _ string, frequencyS int64, contents string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, scriptName)
+	f.register(scriptName, frequencyS, contents)
+	return nil
+}
+
+func (f *fakeClient) UpdateDataRetentionScript(_ context.Context, _ string, _ string, scriptName string, _ string, frequencyS int64, contents string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failUpdate {
+		return fmt.Errorf("update of %s failed", scriptName)
+	}
+	f.updated = append(f.updated, scriptName)
+	f.register(scriptName, frequencyS, contents)
+	return nil
+}
+
+func (f *fakeClient) DeleteDataRetentionScript(_ context.Context, scriptId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, scriptId)
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	os.Setenv("CONFIG_FILE", "testdata/config.yaml")
+	os.Exit(m.Run())
+}
+
+func getTestConfig(t *testing.T) config.Config {
+	cfg, err := config.GetConfig()
+	assert.NoError(t, err)
+	return cfg
+}
+
+// workerConfig replaces the worker configuration of the test config.
+type workerConfig struct {
+	config.Config
+	worker config.Worker
+}
+
+func (c *workerConfig) Worker() config.Worker {
+	return c.worker
+}
+
+// getTestWorkerConfig returns the test config with the worker configuration of the file.
+func getTestWorkerConfig(t *testing.T, path string) config.Config {
+	cfg := getTestConfig(t)
+	t.Setenv("CONFIG_FILE", path)
+	worker, err := config.GetWorkerConfig()
+	assert.NoError(t, err)
+	return &workerConfig{Config: cfg, worker: worker}
+}
+
+func TestReconcile(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "HTTP Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+			{Name: "JVM Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-JVM Metrics-test-cluster", FrequencyS: 20}, ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", ClusterIds: testClusterId},
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-Old Script-test-cluster"}, ScriptId: "06906e7e-c684-4858-9fa1-e0bf552b40a6", ClusterIds: testClusterId},
+			},
+		},
+	}
+	summary, err := New(getTestConfig(t), client).Reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Summary{Created: 3, Updated: 1, Deleted: 1, PluginVersion: "0.0.3", Scripts: 4}, summary)
+	assert.Equal(t, "0.0.3", client.enabledVersion)
+	assert.Equal(t, 1, client.listings)
+	assert.ElementsMatch(t, []string{"nri-HTTP Metrics-test-cluster", "nri-HTTP Metrics-other-cluster", "nri-JVM Metrics-other-cluster"}, client.created)
+	assert.Equal(t, []string{"nri-JVM Metrics-test-cluster"}, client.updated)
+	assert.Equal(t, []string{"06906e7e-c684-4858-9fa1-e0bf552b40a6"}, client.deleted)
+}
+
+// testSpanPreset is a span preset with namespace, latency and resp_status columns.
+const testSpanPreset = `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.namespace = df.ctx['namespace']
+px.export(df, px.otel.Data(
+  resource={'k8s.namespace.name': df.namespace},
+  data=[px.otel.trace.Span(name=df.req_path, start_time=df.time_ - df.latency, end_time=df.time_, attributes={'http.status_code': df.resp_status})],
+))`
+
+func TestReconcileOverrides(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "HTTP Spans", FrequencyS: 10, Script: testSpanPreset, IsPreset: true},
+			{Name: "MySQL Spans", FrequencyS: 10, Script: testSpanPreset, IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-MySQL Spans-test-cluster", FrequencyS: 10}, ScriptId: "06906e7e-c684-4858-9fa1-e0bf552b40a6", ClusterIds: testClusterId},
+			},
+		},
+	}
+	_, err := New(getTestWorkerConfig(t, "testdata/overrides.yaml"), client).Reconcile(context.Background())
+	assert.NoError(t, err)
+
+	// the disabled script is removed, the other one registered with the overridden settings
+	assert.Equal(t, []string{"06906e7e-c684-4858-9fa1-e0bf552b40a6"}, client.deleted)
+	assert.Equal(t, []string{"nri-HTTP Spans-test-cluster"}, client.created)
+	registered := client.registered["nri-HTTP Spans-test-cluster"]
+	assert.Equal(t, int64(60), registered.FrequencyS)
+	assert.Contains(t, registered.Script, strings.Join([]string{
+		"# New Relic integration filtering",
+		"df = df[px.regex_match('shop', df.namespace)]",
+		"df = df.head(5)",
+	}, "\n"))
+}
+
+func TestReconcileSpanLimits(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "Redis Spans", FrequencyS: 10, Script: testSpanPreset, IsPreset: true},
+			{Name: "DNS Spans", FrequencyS: 10, Script: testSpanPreset, IsPreset: true},
+		},
+	}
+	_, err := New(getTestWorkerConfig(t, "testdata/span-limits.yaml"), client).Reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, client.registered["nri-Redis Spans-test-cluster"].Script, "df = df.head(7)\n")
+	assert.Contains(t, client.registered["nri-Redis Spans-other-cluster"].Script, "df = df.head(9)\n")
+	assert.Contains(t, client.registered["nri-DNS Spans-test-cluster"].Script, "df = df.head(3)\n")
+}
+
+func TestReconcileSampling(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "HTTP Spans", FrequencyS: 10, Script: testSpanPreset, IsPreset: true},
+		},
+	}
+	_, err := New(getTestWorkerConfig(t, "testdata/sampling.yaml"), client).Reconcile(context.Background())
+	assert.NoError(t, err)
+	registered := client.registered["nri-HTTP Spans-test-cluster"].Script
+	assert.Contains(t, registered, "df.nr_keep = (df.resp_status < 200 or df.resp_status >= 300) or df.latency >= df.nr_latency_threshold\n")
+	assert.Contains(t, registered, "nr_sampled_df = nr_sampled_df[(px.hash(nr_sampled_df.time_) % 100 + 100) % 100 < 5]\n")
+	assert.Contains(t, registered, "df = nr_kept_df.append(nr_sampled_df).head(20)\n")
+	assert.NotContains(t, registered, "df = df.head(")
+}
+
+func TestReconcileInvalidCustomScript(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "HTTP Metrics", FrequencyS: 10, Script: "df.pod = df.ctx['pod']\n" + testPreset, IsPreset: true},
+		},
+	}
+	r := New(getTestWorkerConfig(t, "testdata/custom-scripts.yaml"), client)
+	plan, err := r.Plan(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Clusters[0].Failed)
+	assert.Len(t, plan.Clusters[1].Failed, 1)
+	assert.Equal(t, "nri-Custom HTTP-other-cluster", plan.Clusters[1].Failed[0].Name)
+	assert.Contains(t, plan.Clusters[1].Failed[0].Error, "filter on pod references the pod column which the script doesn't define")
+	var text strings.Builder
+	assert.NoError(t, plan.WriteText(&text))
+	assert.Contains(t, text.String(), "Scripts left unchanged on errors: 1\n  ! nri-Custom HTTP-other-cluster: invalid script: ")
+
+	// the script only fails for the cluster filtering on pods, the rest is reconciled
+	summary, err := r.Reconcile(context.Background())
+	assert.ErrorContains(t, err, "cluster other-cluster: errors while setting up data retention scripts")
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 3, summary.Created)
+	assert.Contains(t, client.registered, "nri-Custom HTTP-test-cluster")
+	assert.Contains(t, client.registered, "nri-HTTP Metrics-other-cluster")
+	assert.NotContains(t, client.registered, "nri-Custom HTTP-other-cluster")
+}
+
+func TestReconcileAudit(t *testing.T) {
+	client := &fakeClient{
+		plugin:       &cloudpb.Plugin{RetentionEnabled: true, LatestVersion: "0.0.3"},
+		pluginConfig: &pixie.NewRelicPluginConfig{LicenseKey: testLicenseKey, ExportUrl: testEndpoint},
+		presets: []*script.ScriptDefinition{
+			{Name: "JVM Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-JVM Metrics-test-cluster", FrequencyS: 20, Script: "px.export(df)"}, ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", ClusterIds: testClusterId},
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-Old Script-test-cluster", FrequencyS: 10}, ScriptId: "06906e7e-c684-4858-9fa1-e0bf552b40a6", ClusterIds: testClusterId},
+			},
+		},
+		failUpdate: true,
+	}
+	r := New(getTestConfig(t), client)
+	r.auditFile = filepath.Join(t.TempDir(), "audit.log")
+	_, err := r.Reconcile(context.Background())
+	assert.Error(t, err)
+
+	content, err := os.ReadFile(r.auditFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 3)
+	records := make(map[string]ChangeRecord)
+	for _, line := range lines {
+		var record ChangeRecord
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records[record.ScriptName] = record
+	}
+
+	deleted := records["nri-Old Script-test-cluster"]
+	assert.Equal(t, "delete", deleted.Action)
+	assert.Equal(t, "success", deleted.Outcome)
+	assert.Equal(t, "06906e7e-c684-4858-9fa1-e0bf552b40a6", deleted.ScriptId)
+	assert.Equal(t, testClusterId, deleted.ClusterId)
+	assert.Equal(t, []string{script.ReasonOrphaned}, deleted.Reasons)
+	assert.Equal(t, int64(10), *deleted.OldFrequencyS)
+	assert.Nil(t, deleted.NewFrequencyS)
+	assert.Equal(t, "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", deleted.OldContentHash)
+
+	updated := records["nri-JVM Metrics-test-cluster"]
+	assert.Equal(t, "update", updated.Action)
+	assert.Equal(t, "failure", updated.Outcome)
+	assert.Equal(t, "update of nri-JVM Metrics-test-cluster failed", updated.Error)
+	assert.Equal(t, []string{script.ReasonContentChanged, script.ReasonFrequencyChanged}, updated.Reasons)
+	assert.Equal(t, int64(20), *updated.OldFrequencyS)
+	assert.Equal(t, int64(10), *updated.NewFrequencyS)
+	assert.Equal(t, contentHash("px.export(df)"), updated.OldContentHash)
+	assert.NotEqual(t, updated.OldContentHash, updated.NewContentHash)
+
+	created := records["nri-JVM Metrics-other-cluster"]
+	assert.Equal(t, "create", created.Action)
+	assert.Equal(t, []string{script.ReasonNew}, created.Reasons)
+	assert.Equal(t, "b8749d5b-3352-4a0c-92ef-4a1479464b74", created.ClusterId)
+	assert.Nil(t, created.OldFrequencyS)
+}
+
+func TestReconcileClusterFailure(t *testing.T) {
+	client := &fakeClient{
+		plugin: &cloudpb.Plugin{LatestVersion: "0.0.3"},
+		presets: []*script.ScriptDefinition{
+			{Name: "HTTP Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+		},
+		failClusters: map[string]bool{"test-cluster": true},
+	}
+	summary, err := New(getTestConfig(t), client).Reconcile(context.Background())
+	assert.EqualError(t, err, "errors while reconciling clusters: cluster test-cluster: failed to get data retention scripts: cluster test-cluster is unavailable")
+	assert.Equal(t, Summary{Created: 1, PluginVersion: "0.0.3", Scripts: 1}, summary)
+	assert.Equal(t, []string{"nri-HTTP Metrics-other-cluster"}, client.created)
+}
+
+func TestReconcileFailures(t *testing.T) {
+	client := &fakeClient{
+		plugin:       &cloudpb.Plugin{RetentionEnabled: true, LatestVersion: "0.0.3"},
+		pluginConfig: &pixie.NewRelicPluginConfig{LicenseKey: testLicenseKey, ExportUrl: testEndpoint},
+		presets: []*script.ScriptDefinition{
+			{Name: "JVM Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-JVM Metrics-test-cluster", FrequencyS: 20}, ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", ClusterIds: testClusterId},
+			},
+		},
+		failUpdate: true,
+	}
+	summary, err := New(getTestConfig(t), client).Reconcile(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, Summary{Created: 1, Failed: 1, PluginVersion: "0.0.3", Scripts: 2}, summary)
+	assert.Equal(t, "", client.enabledVersion)
+
+	var b strings.Builder
+	assert.NoError(t, metrics.Default.Write(&b))
+	assert.Contains(t, b.String(), `nr_pixie_integration_script_operations_total{cluster="test-cluster",script="nri-JVM Metrics-test-cluster",operation="update",outcome="failure"}`)
+	assert.Contains(t, b.String(), `nr_pixie_integration_script_actions{cluster="test-cluster",operation="update"} 1`)
+	assert.Contains(t, b.String(), `nr_pixie_integration_managed_scripts{cluster="test-cluster"} 1`)
+
+	client.pluginConfig.ExportUrl = "other.endpoint:443"
+	_, err = New(getTestConfig(t), client).Reconcile(context.Background())
+	assert.EqualError(t, err, "the New Relic plugin is already installed with a different export URL")
+}
+
+// cancellingClient cancels the reconcile pass once the plan is computed.
+type cancellingClient struct {
+	*fakeClient
+	cancel context.CancelFunc
+}
+
+func (c *cancellingClient) GetClusterScripts(ctx context.Context, scripts []*cloudpb.RetentionScript, clusterId, clusterName string) ([]*script.Script, error) {
+	defer c.cancel()
+	return c.fakeClient.GetClusterScripts(ctx, scripts, clusterId, clusterName)
+}
+
+func TestReconcileCancelled(t *testing.T) {
+	client := &fakeClient{
+		plugin:       &cloudpb.Plugin{RetentionEnabled: true, LatestVersion: "0.0.3"},
+		pluginConfig: &pixie.NewRelicPluginConfig{LicenseKey: testLicenseKey, ExportUrl: testEndpoint},
+		presets: []*script.ScriptDefinition{
+			{Name: "JVM Metrics", FrequencyS: 10, Script: testPreset, IsPreset: true},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := New(getTestConfig(t), &cancellingClient{fakeClient: client, cancel: cancel})
+	summary, err := r.Reconcile(ctx)
+	assert.ErrorContains(t, err, "skipped: context canceled")
+	assert.Equal(t, Summary{Failed: 2, PluginVersion: "0.0.3"}, summary)
+	assert.Empty(t, client.created)
+}
+
+func TestPlan(t *testing.T) {
+	client := &fakeClient{
+		plugin:       &cloudpb.Plugin{RetentionEnabled: true, LatestVersion: "0.0.3"},
+		pluginConfig: &pixie.NewRelicPluginConfig{LicenseKey: "another-key", ExportUrl: testEndpoint},
+		presets: []*script.ScriptDefinition{
+			{Name: "JVM Metrics", FrequencyS: 10, Script: "import px\npx.export(df)", IsPreset: true},
+		},
+		current: map[string][]*script.Script{
+			"test-cluster": {
+				{ScriptDefinition: script.ScriptDefinition{Name: "nri-JVM Metrics-test-cluster", FrequencyS: 10, Script: "import px\npx.export(df)"}, ScriptId: "4e4e51b2-86a8-4d57-a2a9-6771d15afcae", ClusterIds: testClusterId},
+			},
+		},
+		failClusters: map[string]bool{"other-cluster": true},
+	}
+	plan, err := New(getTestConfig(t), client).Plan(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, plan.EnablePlugin)
+	assert.Equal(t, reasonLicenseKeyChange, plan.EnablePluginReason)
+	assert.Equal(t, 2, len(plan.Clusters))
+	assert.Equal(t, "failed to get data retention scripts: cluster other-cluster is unavailable", plan.Clusters[1].Error)
+
+	cp := plan.Clusters[0]
+	assert.Equal(t, testClusterId, cp.ClusterId)
+	assert.Equal(t, 0, len(cp.ToCreate))
+	assert.Equal(t, 0, len(cp.ToDelete))
+	assert.Equal(t, 1, len(cp.ToUpdate))
+	assert.Equal(t, `--- current/nri-JVM Metrics-test-cluster
++++ desired/nri-JVM Metrics-test-cluster
+@@ -1,2 +1,5 @@
+ import px
++# New Relic integration filtering
++
++df.source = 'nr-pixie-integration'
+ px.export(df)
+`, cp.ToUpdate[0].Diff)
+	assert.Equal(t, []string{script.ReasonContentChanged}, cp.ToUpdate[0].Reasons)
+	assert.Equal(t, []string{"content changed: 2 lines (sha256 b35d1941) -> 5 lines (sha256 a66c4a83)"}, cp.ToUpdate[0].Changes)
+	assert.Equal(t, "", client.enabledVersion)
+	assert.Nil(t, client.updated)
+
+	var b strings.Builder
+	assert.NoError(t, plan.WriteText(&b))
+	assert.Contains(t, b.String(), "  ~ nri-JVM Metrics-test-cluster [4e4e51b2-86a8-4d57-a2a9-6771d15afcae] (every 10s)\n    content changed: 2 lines")
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	assert.Equal(t, "", unifiedDiff("a", "b", "same\ntext", "same\ntext"))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,1 +1,1 @@\n-old\n+new\n", unifiedDiff("a", "b", "old", "new"))
+
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12"
+	b := "1\nx\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny"
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n 4\n 5\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n", unifiedDiff("a", "b", a, b))
+}
@@ -0,0 +1,76 @@
+package script
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reasons of the script actions.
+const (
+	ReasonNew               = "new"
+	ReasonContentChanged    = "content changed"
+	ReasonFrequencyChanged  = "frequency changed"
+	ReasonClusterIdsChanged = "cluster IDs changed"
+	ReasonOrphaned          = "orphaned"
+	ReasonCleanup           = "cleanup"
+)
+
+// Fields of a script which can change.
+const (
+	FieldScript     = "script"
+	FieldFrequencyS = "frequencyS"
+	FieldClusterIds = "clusterIds"
+)
+
+// Change is a field which differs between the current and the desired script.
+type Change struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// String describes the change. The PxL of content changes is summarized by its number of
+// lines and hash, use a diff to see the actual changes.
+func (c Change) String() string {
+	if c.Field == FieldScript {
+		return fmt.Sprintf("%s: %s -> %s", c.Reason, summarize(c.Before), summarize(c.After))
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Reason, c.Before, c.After)
+}
+
+func summarize(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%d lines (sha256 %s)", strings.Count(content, "\n")+1, hex.EncodeToString(sum[:4]))
+}
+
+// Reasons returns the reasons of the changes.
+func Reasons(changes []Change) []string {
+	reasons := make([]string, 0, len(changes))
+	for _, c := range changes {
+		reasons = append(reasons, c.Reason)
+	}
+	return reasons
+}
+
+func getChanges(current, desired *Script) []Change {
+	var changes []Change
+	if current.Script != desired.Script {
+		changes = append(changes, Change{Field: FieldScript, Reason: ReasonContentChanged, Before: current.Script, After: desired.Script})
+	}
+	if current.FrequencyS != desired.FrequencyS {
+		changes = append(changes, Change{
+			Field:  FieldFrequencyS,
+			Reason: ReasonFrequencyChanged,
+			Before: strconv.FormatInt(current.FrequencyS, 10),
+			After:  strconv.FormatInt(desired.FrequencyS, 10),
+		})
+	}
+	if current.ClusterIds != desired.ClusterIds {
+		changes = append(changes, Change{Field: FieldClusterIds, Reason: ReasonClusterIdsChanged, Before: current.ClusterIds, After: desired.ClusterIds})
+	}
+	return changes
+}
@@ -0,0 +1,343 @@
+package script
+
+import "github.com/newrelic/newrelic-pixie-integration/internal/pxl"
+
+// columns is the set of columns of a dataframe. An open dataframe still has the columns of
+// its table, which are only known once the script reads them, eg. df.latency. A grouped
+// dataframe is the result of groupby, whose names are the group keys.
+type columns struct {
+	names   map[string]bool
+	open    bool
+	grouped bool
+}
+
+func newColumns(open bool, names ...string) *columns {
+	c := &columns{names: make(map[string]bool), open: open}
+	for _, name := range names {
+		c.names[name] = true
+	}
+	return c
+}
+
+func (c *columns) copy() *columns {
+	if c == nil {
+		return nil
+	}
+	copied := newColumns(c.open)
+	copied.grouped = c.grouped
+	for name := range c.names {
+		copied.names[name] = true
+	}
+	return copied
+}
+
+// has returns whether the dataframe has the column. It is false for the dataframes which
+// aren't known.
+func (c *columns) has(name string) bool {
+	return c != nil && c.names[name]
+}
+
+// columnScope holds the columns of the dataframe variables, and the columns of the
+// dataframes returned by the functions of the script.
+type columnScope struct {
+	vars      map[string]*columns
+	functions map[string]*columns
+	// exports holds the columns of the dataframe exported by each px.export call.
+	exports map[pxl.Stmt]*columns
+	// returned is the dataframe returned by the function being analyzed.
+	returned *columns
+}
+
+// exportColumns returns the columns of the dataframe of each px.export call of the script.
+// The statements are followed in the order of the script, whatever their control flow:
+// a column is defined by an assignment, eg. df.pod = df.ctx['pod'], a group key, an
+// aggregate, a projection, eg. df[['pod']], or a merge, and dropped by groupby, agg, a
+// projection and drop.
+func exportColumns(file *pxl.File) map[pxl.Stmt]*columns {
+	s := &columnScope{
+		vars:      make(map[string]*columns),
+		functions: make(map[string]*columns),
+		exports:   make(map[pxl.Stmt]*columns),
+	}
+	s.stmts(file.Stmts)
+	return s.exports
+}
+
+func (s *columnScope) stmts(stmts []pxl.Stmt) {
+	for _, stmt := range stmts {
+		s.stmt(stmt)
+	}
+}
+
+func (s *columnScope) stmt(stmt pxl.Stmt) {
+	switch stmt := stmt.(type) {
+	case *pxl.Assign:
+		s.read(stmt.Value)
+		for _, target := range stmt.Targets {
+			s.readTarget(target)
+		}
+		if stmt.Op.Text != "=" {
+			return
+		}
+		for _, target := range stmt.Targets {
+			s.assign(target, s.columns(stmt.Value))
+		}
+	case *pxl.ExprStmt:
+		s.read(stmt.X)
+		if call, ok := pxl.IsCall(stmt.X, "px.export"); ok && len(call.Args) > 0 && call.Args[0].Keyword == nil {
+			s.exports[stmt] = s.columns(call.Args[0].Value)
+		}
+	case *pxl.SimpleStmt:
+		for _, x := range stmt.Exprs {
+			s.read(x)
+		}
+		if stmt.Keyword.Text == "return" && len(stmt.Exprs) > 0 {
+			s.returned = s.columns(stmt.Exprs[0])
+		}
+	case *pxl.Compound:
+		for _, clause := range stmt.Clauses {
+			if clause.Keyword.Text == "def" {
+				s.function(clause)
+				continue
+			}
+			for _, x := range clause.Exprs {
+				s.read(x)
+			}
+			s.stmts(clause.Body)
+		}
+	}
+}
+
+// function records the dataframe returned by the function. Its parameters are unknown.
+func (s *columnScope) function(clause *pxl.Clause) {
+	body := &columnScope{
+		vars:      make(map[string]*columns),
+		functions: s.functions,
+		exports:   s.exports,
+	}
+	for name, c := range s.vars {
+		body.vars[name] = c.copy()
+	}
+	if name, ok := clause.Exprs[0].(*pxl.Name); ok {
+		body.stmts(clause.Body)
+		s.functions[name.Tok.Text] = body.returned
+	}
+}
+
+// assign binds the dataframe to the target: a variable, or a column of a dataframe.
+func (s *columnScope) assign(target pxl.Node, c *columns) {
+	switch target := target.(type) {
+	case *pxl.Name:
+		if c == nil {
+			delete(s.vars, target.Tok.Text)
+			return
+		}
+		s.vars[target.Tok.Text] = c
+	case *pxl.Attribute:
+		s.define(target.X, target.Name.Text)
+	case *pxl.Subscript:
+		if column, ok := stringLiteral(target.Index); ok {
+			s.define(target.X, column)
+		}
+	case *pxl.Expr:
+		for _, child := range target.Children {
+			s.assign(child, nil)
+		}
+	}
+}
+
+// define adds the column to the dataframe variable.
+func (s *columnScope) define(x pxl.Node, column string) {
+	name, ok := x.(*pxl.Name)
+	if !ok {
+		return
+	}
+	c := s.vars[name.Tok.Text]
+	if c == nil {
+		c = newColumns(true)
+		s.vars[name.Tok.Text] = c
+	}
+	c.names[column] = true
+}
+
+// read records the columns the expression reads from the open dataframes, eg. latency for
+// df.latency, as they are columns of their table. The assignment expressions bind their
+// variable.
+func (s *columnScope) read(x pxl.Node) {
+	methods := make(map[pxl.Node]bool)
+	pxl.Inspect([]pxl.Stmt{&pxl.ExprStmt{X: x}}, func(n pxl.Node) bool {
+		switch n := n.(type) {
+		case *pxl.Call:
+			methods[n.Func] = true
+		case *pxl.Attribute:
+			if !methods[n] && n.Name.Text != "ctx" {
+				s.readColumn(n.X, n.Name.Text)
+			}
+		case *pxl.Subscript:
+			if column, ok := stringLiteral(n.Index); ok {
+				s.readColumn(n.X, column)
+			}
+		case *pxl.NamedExpr:
+			s.assign(n.Name, s.columns(n.Value))
+		}
+		return true
+	})
+}
+
+// readTarget records the columns read by the target of an assignment, eg. df for
+// df[df.latency > 0].x = 1, but not the assigned column.
+func (s *columnScope) readTarget(target pxl.Node) {
+	switch target := target.(type) {
+	case *pxl.Attribute:
+		s.read(target.X)
+	case *pxl.Subscript:
+		s.read(target.X)
+		if _, ok := stringLiteral(target.Index); !ok {
+			s.read(target.Index)
+		}
+	case *pxl.Expr:
+		for _, child := range target.Children {
+			s.readTarget(child)
+		}
+	}
+}
+
+func (s *columnScope) readColumn(x pxl.Node, column string) {
+	if name, ok := x.(*pxl.Name); ok {
+		if c := s.vars[name.Tok.Text]; c != nil && c.open {
+			c.names[column] = true
+		}
+	}
+}
+
+// columns returns the columns of the dataframe the expression evaluates to, or nil when it
+// isn't a known dataframe.
+func (s *columnScope) columns(x pxl.Node) *columns {
+	switch x := x.(type) {
+	case *pxl.Name:
+		return s.vars[x.Tok.Text]
+	case *pxl.NamedExpr:
+		return s.columns(x.Value)
+	case *pxl.Subscript:
+		c := s.columns(x.X)
+		if c == nil {
+			return nil
+		}
+		if names, ok := stringList(x.Index); ok {
+			return newColumns(false, names...)
+		}
+		if _, ok := stringLiteral(x.Index); ok {
+			// A single column.
+			return nil
+		}
+		// A filter keeps the columns.
+		return c.copy()
+	case *pxl.Call:
+		return s.callColumns(x)
+	}
+	return nil
+}
+
+func (s *columnScope) callColumns(call *pxl.Call) *columns {
+	if _, ok := pxl.IsCall(call, "px.DataFrame"); ok {
+		if names, ok := stringList(call.Keyword("select")); ok {
+			return newColumns(false, names...)
+		}
+		return newColumns(true)
+	}
+	if name, ok := call.Func.(*pxl.Name); ok {
+		return s.functions[name.Tok.Text].copy()
+	}
+	method, ok := call.Func.(*pxl.Attribute)
+	if !ok {
+		return nil
+	}
+	c := s.columns(method.X)
+	if c == nil {
+		return nil
+	}
+	switch method.Name.Text {
+	case "groupby":
+		keys := positional(call, 0)
+		if keys == nil {
+			keys = call.Keyword("by")
+		}
+		names, _ := stringList(keys)
+		grouped := newColumns(false, names...)
+		grouped.grouped = true
+		return grouped
+	case "agg":
+		aggregated := newColumns(false)
+		if c.grouped {
+			aggregated = c.copy()
+			aggregated.grouped = false
+		}
+		for _, arg := range call.Args {
+			if arg.Keyword != nil {
+				aggregated.names[arg.Keyword.Text] = true
+			}
+		}
+		return aggregated
+	case "merge", "append":
+		merged := c.copy()
+		if other := s.columns(positional(call, 0)); other != nil {
+			merged.open = merged.open || other.open
+			for name := range other.names {
+				merged.names[name] = true
+			}
+		} else {
+			merged.open = true
+		}
+		return merged
+	case "drop":
+		columnsArg := call.Keyword("columns")
+		if columnsArg == nil {
+			columnsArg = positional(call, 0)
+		}
+		dropped := c.copy()
+		names, _ := stringList(columnsArg)
+		for _, name := range names {
+			delete(dropped.names, name)
+		}
+		return dropped
+	}
+	// Other methods, eg. head, keep the columns.
+	return c.copy()
+}
+
+// positional returns the positional argument of the call at the index, nil when there is none.
+func positional(call *pxl.Call, index int) pxl.Node {
+	if index < len(call.Args) && call.Args[index].Keyword == nil {
+		return call.Args[index].Value
+	}
+	return nil
+}
+
+// stringLiteral returns the value of a string literal.
+func stringLiteral(n pxl.Node) (string, bool) {
+	if lit, ok := n.(*pxl.Literal); ok {
+		return lit.StringValue()
+	}
+	return "", false
+}
+
+// stringList returns the values of a string literal or of a list of string literals, eg.
+// ['pod', 'namespace'].
+func stringList(n pxl.Node) ([]string, bool) {
+	if value, ok := stringLiteral(n); ok {
+		return []string{value}, true
+	}
+	list, ok := n.(*pxl.Expr)
+	if !ok || list.First.Text != "[" {
+		return nil, false
+	}
+	var values []string
+	for _, child := range list.Children {
+		value, ok := stringLiteral(child)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
@@ -0,0 +1,96 @@
+package script
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Dimensions which can be filtered on. The dimension is the name of the dataframe column.
+const (
+	FilterNamespace = "namespace"
+	FilterPod       = "pod"
+	FilterService   = "service"
+	FilterNode      = "node"
+	FilterContainer = "container"
+)
+
+// FilterDimensions lists the supported dimensions in the order their filter lines are generated.
+var FilterDimensions = []string{FilterNamespace, FilterPod, FilterService, FilterNode, FilterContainer}
+
+// Filter holds the RE2 regular expressions of a single dimension. When Include is set,
+// only matching rows are kept. When Exclude is set, matching rows are dropped.
+type Filter struct {
+	Include string `yaml:"include" json:"include"`
+	Exclude string `yaml:"exclude" json:"exclude"`
+}
+
+// Filters maps a dimension to its filter.
+type Filters map[string]Filter
+
+// IsFilterDimension returns true if the dimension can be filtered on.
+func IsFilterDimension(dimension string) bool {
+	for _, d := range FilterDimensions {
+		if d == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that every dimension is supported and every regular expression compiles.
+func (f Filters) Validate() error {
+	for dimension, filter := range f {
+		if !IsFilterDimension(dimension) {
+			return fmt.Errorf("unknown filter dimension '%s', must be one of %v", dimension, FilterDimensions)
+		}
+		if _, err := regexp.Compile(filter.Include); err != nil {
+			return fmt.Errorf("invalid include regex for %s: %w", dimension, err)
+		}
+		if _, err := regexp.Compile(filter.Exclude); err != nil {
+			return fmt.Errorf("invalid exclude regex for %s: %w", dimension, err)
+		}
+	}
+	return nil
+}
+
+// getFilters merges the legacy pod and namespace excludes into the filters.
+func getFilters(config ScriptConfig) Filters {
+	filters := make(Filters)
+	for dimension, filter := range config.Filters {
+		filters[dimension] = filter
+	}
+	if config.ExcludeNamespaces != "" {
+		filter := filters[FilterNamespace]
+		filter.Exclude = config.ExcludeNamespaces
+		filters[FilterNamespace] = filter
+	}
+	if config.ExcludePods != "" {
+		filter := filters[FilterPod]
+		filter.Exclude = config.ExcludePods
+		filters[FilterPod] = filter
+	}
+	return filters
+}
+
+// getFilterLines returns the lines filtering the exported dataframe. It fails when a filter
+// applies to a column the dataframe doesn't have, as dropping an include filter would export
+// every row.
+func getFilterLines(definition *ScriptDefinition, e *export, filters Filters) ([]string, error) {
+	var lines []string
+	for _, dimension := range FilterDimensions {
+		filter, ok := filters[dimension]
+		if !ok || (filter.Include == "" && filter.Exclude == "") {
+			continue
+		}
+		if !e.columns.has(dimension) {
+			return nil, fmt.Errorf("filter on %[1]s references the %[1]s column which the script doesn't define", dimension)
+		}
+		if filter.Include != "" {
+			lines = append(lines, fmt.Sprintf("%[1]s = %[1]s[px.regex_match('%[2]s', %[1]s.%[3]s)]", e.dataframe, stringEscaper.Replace(filter.Include), dimension))
+		}
+		if filter.Exclude != "" {
+			lines = append(lines, fmt.Sprintf("%[1]s = %[1]s[not px.regex_match('%[2]s', %[1]s.%[3]s)]", e.dataframe, stringEscaper.Replace(filter.Exclude), dimension))
+		}
+	}
+	return lines, nil
+}
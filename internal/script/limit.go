@@ -0,0 +1,55 @@
+package script
+
+import "strings"
+
+const (
+	spansSuffix      = " Spans"
+	ProtocolHTTP     = "http"
+	ProtocolMySQL    = "mysql"
+	ProtocolPostgres = "postgresql"
+)
+
+// isSpanScript returns true when the span limits apply to the script. Custom scripts opt in
+// with the spanProtocol metadata, as they were never limited. Preset scripts are identified
+// by the metadata, by the "<Protocol> Spans" name or when spans is true, ie. the export has
+// a px.otel.trace.Span payload.
+func isSpanScript(definition *ScriptDefinition, spans bool) bool {
+	if definition.SpanProtocol != "" {
+		return true
+	}
+	return definition.IsPreset && (spans || strings.HasSuffix(definition.Name, spansSuffix))
+}
+
+// getSpanProtocol returns the lowercase protocol of a span script, eg. "redis" for
+// "Redis Spans". An empty string is returned when the protocol is unknown.
+func getSpanProtocol(definition *ScriptDefinition) string {
+	if definition.SpanProtocol != "" {
+		return strings.ToLower(definition.SpanProtocol)
+	}
+	if strings.HasSuffix(definition.Name, spansSuffix) {
+		return strings.ToLower(strings.TrimSuffix(definition.Name, spansSuffix))
+	}
+	return ""
+}
+
+// getSpanLimit returns the limit for the protocol. Protocols without a limit in SpanLimits
+// fall back to HttpSpanLimit (http), DbSpanLimit (mysql and postgresql) or DefaultSpanLimit.
+func getSpanLimit(protocol string, config ScriptConfig) int64 {
+	if limit, ok := config.SpanLimits[protocol]; ok {
+		return limit
+	}
+	switch protocol {
+	case ProtocolHTTP:
+		return config.HttpSpanLimit
+	case ProtocolMySQL, ProtocolPostgres:
+		return config.DbSpanLimit
+	}
+	return config.DefaultSpanLimit
+}
+
+func getLimitLines(definition *ScriptDefinition, e *export, config ScriptConfig) []string {
+	if !isSpanScript(definition, e.spans) {
+		return nil
+	}
+	return getRowLimitLines(definition, e, getSpanLimit(getSpanProtocol(definition), config), getLimitMode(definition, config), config)
+}
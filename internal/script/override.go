@@ -0,0 +1,38 @@
+package script
+
+import "fmt"
+
+// ScriptOverride holds the settings of a single script which replace the global settings.
+// Unset fields keep the global behaviour.
+type ScriptOverride struct {
+	// Enabled set to false disables the script, removing it when it is already registered.
+	Enabled *bool `yaml:"enabled" json:"enabled"`
+	// FrequencyS replaces the frequency of the script definition and the collect interval.
+	FrequencyS *int64 `yaml:"frequencyS" json:"frequencyS"`
+	// Limit sets the maximum number of rows exported per run. Zero or negative disables the limit.
+	Limit *int64 `yaml:"limit" json:"limit"`
+	// LimitMode selects how the limit is applied: head (default) or sample.
+	LimitMode string `yaml:"limitMode" json:"limitMode"`
+	// Filters replace the global filters per dimension.
+	Filters Filters `yaml:"filters" json:"filters"`
+}
+
+// Validate checks the values of the override.
+func (o ScriptOverride) Validate() error {
+	if o.FrequencyS != nil && *o.FrequencyS <= 0 {
+		return fmt.Errorf("frequencyS must be positive, use enabled: false to disable the script")
+	}
+	if o.LimitMode != "" && !IsLimitMode(o.LimitMode) {
+		return fmt.Errorf("limitMode must be either '%s' or '%s'", LimitModeHead, LimitModeSample)
+	}
+	return o.Filters.Validate()
+}
+
+func (o ScriptOverride) isDisabled() bool {
+	return o.Enabled != nil && !*o.Enabled
+}
+
+// hasFiltering returns true when the override adds filtering lines to the script.
+func (o ScriptOverride) hasFiltering() bool {
+	return o.Limit != nil || len(o.Filters) > 0
+}
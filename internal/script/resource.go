@@ -0,0 +1,72 @@
+package script
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/pxl"
+)
+
+// sourceAttributeKey is the resource attribute added by the integration to every export.
+const sourceAttributeKey = "px.source"
+
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`)
+
+// collisionError is the error of a resource attribute of the config which is already set by
+// the resource dict of the script at the line.
+type collisionError struct {
+	line int
+	key  string
+}
+
+func (e *collisionError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.message())
+}
+
+func (e *collisionError) message() string {
+	return fmt.Sprintf("resource attribute '%s' of the config is already set by the script", e.key)
+}
+
+// ValidateResourceAttributes returns an error when a resource attribute has no name or is
+// the attribute set by the integration.
+func ValidateResourceAttributes(attributes map[string]string) error {
+	for key := range attributes {
+		if key == "" {
+			return fmt.Errorf("resource attribute without a name")
+		}
+		if key == sourceAttributeKey {
+			return fmt.Errorf("resource attribute %s is set by the integration", key)
+		}
+	}
+	return nil
+}
+
+// getResourceAttributes returns the attributes added to a resource dict of the script, the
+// px.source attribute of the dataframe followed by the resource attributes of the config
+// sorted by key. It returns a *collisionError when the dict already sets one of the
+// attributes of the config.
+func getResourceAttributes(dict *pxl.Dict, dataframe string, attributes map[string]string) (string, error) {
+	for _, item := range dict.Items {
+		literal, ok := item.Key.(*pxl.Literal)
+		if !ok {
+			continue
+		}
+		if key, ok := literal.StringValue(); ok {
+			if _, ok := attributes[key]; ok {
+				return "", &collisionError{line: literal.Start().Line, key: key}
+			}
+		}
+	}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, sourceAttribute, dataframe)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "'%s': '%s',", stringEscaper.Replace(key), stringEscaper.Replace(attributes[key]))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,109 @@
+package script
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limit modes select how the row limit of a script is applied.
+const (
+	// LimitModeHead keeps the first rows returned by Pixie.
+	LimitModeHead = "head"
+	// LimitModeSample keeps all error and slow spans and samples the remaining spans.
+	LimitModeSample = "sample"
+
+	defSamplePercent = 10
+	slowQuantile     = "p99"
+	latencyColumn    = "latency"
+	statusColumn     = "resp_status"
+	timeColumn       = "time_"
+	mysqlStatusError = 3
+)
+
+// IsLimitMode returns true if the mode is a supported limit mode.
+func IsLimitMode(mode string) bool {
+	return mode == LimitModeHead || mode == LimitModeSample
+}
+
+// errorConditions holds the PxL condition matching error spans per protocol, formatted with
+// the name of the dataframe. The conditions only apply to scripts with a resp_status column.
+// Other protocols, like PostgreSQL whose events have no response status, only keep the slow
+// spans.
+var errorConditions = map[string]string{
+	ProtocolHTTP:  fmt.Sprintf("%%[1]s.%[1]s < 200 or %%[1]s.%[1]s >= 300", statusColumn),
+	ProtocolMySQL: fmt.Sprintf("%%[1]s.%s == %d", statusColumn, mysqlStatusError),
+}
+
+func getLimitMode(definition *ScriptDefinition, config ScriptConfig) string {
+	if mode := config.Overrides[definition.Name].LimitMode; mode != "" {
+		return mode
+	}
+	if config.LimitMode != "" {
+		return config.LimitMode
+	}
+	return LimitModeHead
+}
+
+// getRowLimitLines returns the lines limiting the exported dataframe to limit rows using the
+// given mode. Scripts without error or latency columns fall back to the head mode.
+func getRowLimitLines(definition *ScriptDefinition, e *export, limit int64, mode string, config ScriptConfig) []string {
+	if limit <= 0 {
+		return nil
+	}
+	if mode == LimitModeSample {
+		if lines := getSampleLines(definition, e, limit, config); lines != nil {
+			return lines
+		}
+	}
+	return []string{fmt.Sprintf("%[1]s = %[1]s.head(%[2]v)", e.dataframe, limit)}
+}
+
+// getSampleLines keeps every error span and every span slower than the p99 latency, and
+// samples the remaining spans on the hash of their timestamp, or of their latency when the
+// script doesn't define the time_ column. The kept spans come first and the total is capped
+// to limit. The generated variables are suffixed
+// with the name of the dataframe so that several exports don't share them.
+func getSampleLines(definition *ScriptDefinition, e *export, limit int64, config ScriptConfig) []string {
+	dataframe := e.dataframe
+	var keep []string
+	var lines []string
+	if condition, ok := errorConditions[getSpanProtocol(definition)]; ok && e.columns.has(statusColumn) {
+		keep = append(keep, "("+fmt.Sprintf(condition, dataframe)+")")
+	}
+	hasLatency := e.columns.has(latencyColumn)
+	if hasLatency {
+		latency := "nr_latency_" + dataframe
+		lines = append(lines,
+			fmt.Sprintf("%s = %s.agg(nr_latency_quantiles=('%s', px.quantiles))", latency, dataframe, latencyColumn),
+			fmt.Sprintf("%[1]s.nr_latency_threshold = px.pluck_float64(%[1]s.nr_latency_quantiles, '%[2]s')", latency, slowQuantile),
+			latency+".nr_join = 1",
+			dataframe+".nr_join = 1",
+			fmt.Sprintf("%[1]s = %[1]s.merge(%[2]s, how='inner', left_on=['nr_join'], right_on=['nr_join'], suffixes=['', '_nr_latency'])", dataframe, latency),
+		)
+		keep = append(keep, fmt.Sprintf("%[1]s.%[2]s >= %[1]s.nr_latency_threshold", dataframe, latencyColumn))
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	percent := config.SamplePercent
+	if percent <= 0 {
+		percent = defSamplePercent
+	}
+	kept, sampled := "nr_kept_"+dataframe, "nr_sampled_"+dataframe
+	lines = append(lines,
+		dataframe+".nr_keep = "+strings.Join(keep, " or "),
+		fmt.Sprintf("%[1]s = %[2]s[%[2]s.nr_keep]", kept, dataframe),
+		fmt.Sprintf("%[1]s = %[2]s[not %[2]s.nr_keep]", sampled, dataframe),
+	)
+	column := ""
+	if e.columns.has(timeColumn) {
+		column = timeColumn
+	} else if hasLatency {
+		column = latencyColumn
+	}
+	if percent < 100 && column != "" {
+		// px.hash may be negative, so the remainder is brought back into [0, 100).
+		lines = append(lines, fmt.Sprintf("%[1]s = %[1]s[(px.hash(%[1]s.%[2]s) %% 100 + 100) %% 100 < %[3]d]", sampled, column, percent))
+	}
+	return append(lines, fmt.Sprintf("%s = %s.append(%s).head(%v)", dataframe, kept, sampled, limit))
+}
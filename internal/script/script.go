@@ -2,19 +2,21 @@ package script
 
 import (
 	"fmt"
-	"regexp"
+	"sort"
 	"strings"
-)
 
-const (
-	scriptPrefix          = "nri-"
-	httpMetricsScript     = "HTTP Metrics"
-	httpSpansScript       = "HTTP Spans"
-	jvmMetricsScript      = "JVM Metrics"
-	mysqlSpansScript      = "MySQL Spans"
-	postgresqlSpansScript = "PostgreSQL Spans"
+	"github.com/newrelic/newrelic-pixie-integration/internal/pxl"
 )
 
+const scriptPrefix = "nri-"
+
+// ScriptConfig holds the settings used to template the scripts of a cluster.
+// SpanLimits holds the row limit of span scripts keyed by lowercase protocol (eg. "redis")
+// and DefaultSpanLimit applies to span scripts of protocols without a limit. LimitMode
+// selects how limits are applied (head by default) and SamplePercent the share of spans
+// kept by the sample mode. Overrides holds the per script settings, keyed by the name of
+// the script definition, and Variables the values of the template variables of the custom
+// scripts.
 type ScriptConfig struct {
 	ClusterName       string
 	ClusterId         string
@@ -23,12 +25,26 @@ type ScriptConfig struct {
 	CollectInterval   int64
 	ExcludePods       string
 	ExcludeNamespaces string
+	Filters           Filters
+	Overrides         map[string]ScriptOverride
+	SpanLimits        map[string]int64
+	DefaultSpanLimit  int64
+	LimitMode         string
+	SamplePercent     int64
+	Variables         map[string]string
+	// Env holds the env variables custom scripts can expand.
+	Env map[string]string
+	// ResourceAttributes holds the static attributes added to the resource of every export.
+	ResourceAttributes map[string]string
 }
 
 type Script struct {
 	ScriptDefinition
 	ScriptId   string
 	ClusterIds string
+	// Changes holds the fields which differ from the current script. It is only set for
+	// the scripts to update.
+	Changes []Change
 }
 
 type ScriptDefinition struct {
@@ -38,12 +54,43 @@ type ScriptDefinition struct {
 	Script      string `yaml:"script"`
 	AddExcludes bool   `yaml:"addExcludes,omitempty"`
 	IsPreset    bool   `yaml:"-"`
+	// SpanProtocol marks the script as exporting spans of the given protocol, selecting its row limit.
+	SpanProtocol string `yaml:"spanProtocol,omitempty"`
+	// Source is the file of a custom script and FirstLine the line of the file preceding
+	// the script, used to report the diagnostics of the script.
+	Source    string `yaml:"-"`
+	FirstLine int    `yaml:"-"`
+	// Variables holds the default values of the template variables of a custom script.
+	Variables map[string]string `yaml:"variables,omitempty"`
 }
 
+// ScriptActions holds the changes bringing the scripts of a cluster in-sync. Failed holds the
+// scripts which are left as they are, as they can't be templated for the cluster or, for
+// custom scripts, have diagnostics.
 type ScriptActions struct {
 	ToDelete []*Script
 	ToUpdate []*Script
 	ToCreate []*Script
+	Failed   []*FailedScript
+}
+
+// FailedScript is a script of a cluster which can't be registered in Pixie.
+type FailedScript struct {
+	Name string
+	Err  error
+}
+
+// InvalidScriptError is the error of a custom script with diagnostics.
+type InvalidScriptError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *InvalidScriptError) Error() string {
+	messages := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		messages = append(messages, d.String())
+	}
+	return "invalid script: " + strings.Join(messages, "; ")
 }
 
 func IsNewRelicScript(scriptName string) bool {
@@ -54,29 +101,43 @@ func IsScriptForCluster(scriptName, clusterName string) bool {
 	return IsNewRelicScript(scriptName) && strings.HasSuffix(scriptName, "-"+clusterName)
 }
 
+// GetActions returns the changes bringing the current scripts of the cluster of the config
+// in-sync with the script definitions. Custom scripts are validated first, so that a custom
+// script with diagnostics only fails for the cluster instead of being registered.
 func GetActions(scriptDefinitions []*ScriptDefinition, currentScripts []*Script, config ScriptConfig) ScriptActions {
 	definitions := make(map[string]ScriptDefinition)
+	actions := ScriptActions{}
+	// failed holds the names of the scripts which can't be registered, left as they are.
+	failed := make(map[string]bool)
 	for _, definition := range scriptDefinitions {
-		scriptName := getScriptName(definition.Name, config.ClusterName)
-		frequencyS := getInterval(definition, config)
-		if frequencyS > 0 {
-			definitions[scriptName] = ScriptDefinition{
-				Name:        scriptName,
-				Description: definition.Description,
-				FrequencyS:  frequencyS,
-				Script:      templateScript(definition, config),
-			}
+		var rendered *ScriptDefinition
+		var err error
+		if diagnostics := validateCustom(definition, config); len(diagnostics) > 0 {
+			err = &InvalidScriptError{Diagnostics: diagnostics}
+		} else {
+			rendered, err = Render(definition, config)
+		}
+		if err != nil {
+			name := getScriptName(definition.Name, config.ClusterName)
+			failed[name] = true
+			actions.Failed = append(actions.Failed, &FailedScript{Name: name, Err: err})
+		} else if rendered != nil {
+			definitions[rendered.Name] = *rendered
 		}
 	}
-	actions := ScriptActions{}
 	for _, current := range currentScripts {
+		if failed[current.Name] {
+			continue
+		}
 		if definition, present := definitions[current.Name]; present {
-			if definition.Script != current.Script || definition.FrequencyS != current.FrequencyS || config.ClusterId != current.ClusterIds {
-				actions.ToUpdate = append(actions.ToUpdate, &Script{
-					ScriptDefinition: definition,
-					ScriptId:         current.ScriptId,
-					ClusterIds:       config.ClusterId,
-				})
+			desired := &Script{
+				ScriptDefinition: definition,
+				ScriptId:         current.ScriptId,
+				ClusterIds:       config.ClusterId,
+			}
+			desired.Changes = getChanges(current, desired)
+			if len(desired.Changes) > 0 {
+				actions.ToUpdate = append(actions.ToUpdate, desired)
 			}
 			delete(definitions, current.Name)
 		} else if IsNewRelicScript(current.Name) {
@@ -89,73 +150,362 @@ func GetActions(scriptDefinitions []*ScriptDefinition, currentScripts []*Script,
 			ClusterIds:       config.ClusterId,
 		})
 	}
+	sort.Slice(actions.ToCreate, func(i, j int) bool {
+		return actions.ToCreate[i].Name < actions.ToCreate[j].Name
+	})
 	return actions
 }
 
+// validateCustom returns the diagnostics of a custom script. Preset scripts aren't validated,
+// as their diagnostics can't be fixed in the configuration.
+func validateCustom(definition *ScriptDefinition, config ScriptConfig) []Diagnostic {
+	if definition.IsPreset {
+		return nil
+	}
+	return Validate(definition, config)
+}
+
+// Render returns the script definition as registered in Pixie for the cluster of the config,
+// or nil when the script is disabled for the cluster. It fails when the PxL of the script
+// can't be parsed.
+func Render(definition *ScriptDefinition, config ScriptConfig) (*ScriptDefinition, error) {
+	frequencyS := getInterval(definition, config)
+	if frequencyS <= 0 {
+		return nil, nil
+	}
+	templated, err := templateScript(definition, config)
+	if err != nil {
+		return nil, fmt.Errorf("templating script %s: %w", definition.Name, err)
+	}
+	return &ScriptDefinition{
+		Name:        getScriptName(definition.Name, config.ClusterName),
+		Description: definition.Description,
+		FrequencyS:  frequencyS,
+		Script:      templated,
+	}, nil
+}
+
 func getScriptName(scriptName string, clusterName string) string {
 	return fmt.Sprintf("%s%s-%s", scriptPrefix, scriptName, clusterName)
 }
 
 func getInterval(definition *ScriptDefinition, config ScriptConfig) int64 {
+	override := config.Overrides[definition.Name]
+	if override.isDisabled() {
+		return -1
+	}
+	if override.FrequencyS != nil {
+		return *override.FrequencyS
+	}
 	if definition.FrequencyS == 0 {
 		return config.CollectInterval
 	}
 	return definition.FrequencyS
 }
 
-func templateScript(definition *ScriptDefinition, config ScriptConfig) string {
-	withClusterName := strings.Replace(definition.Script, "px.vizier_name()", "'"+config.ClusterName+"'", -1)
-	lines := strings.Split(withClusterName, "\n")
+// sourceAttribute is the resource attribute holding the px.source column added to the exported
+// data, formatted with the name of the exported dataframe.
+const sourceAttribute = "'px.source': %s.source,"
+
+// export is a px.export call of a script at the line. dataframe is the exported variable,
+// a temporary one assigned from expression right before the call when the call exports an
+// expression, and columns the columns of the exported dataframe.
+type export struct {
+	stmt       pxl.Stmt
+	line       int
+	dataframe  string
+	columns    *columns
+	expression string
+	// removed is the number of lines of the expression removed after its first line, at
+	// exprLine.
+	removed, exprLine int
+	// spans is true when the export has a px.otel.trace.Span payload.
+	spans bool
+}
+
+// templateScript expands the variables of the definition, parses the PxL and templates its
+// syntax tree for the config: px.vizier_name() calls are replaced with the cluster name,
+// and every px.export call gets the px.source attribute and the resource attributes of the
+// config added to its resource dict and the filters, limits and px.source column of its
+// dataframe inserted before it. Row limits only apply to the exports of spans when the
+// script exports both spans and other data.
+func templateScript(definition *ScriptDefinition, config ScriptConfig) (string, error) {
+	t, err := templateTree(definition, config)
+	if err != nil {
+		return "", err
+	}
+	return t.script, nil
+}
+
+// templated is a templated script. inserted holds the blocks of lines inserted before the
+// lines of the script, in order. A negative count is a block of lines removed at the line.
+type templated struct {
+	script   string
+	inserted []insertion
+}
+
+// insertion is a block of count lines inserted before the line of the script.
+type insertion struct {
+	line, count int
+}
 
-	r := regexp.MustCompile(`resource\s*=\s*{`)
-	exportLineNumber := 0
-	for i, line := range lines {
-		if strings.Contains(line, "px.export(") {
-			exportLineNumber = i
+// sourceLine returns the line of the script before it was templated of the line of the
+// templated script. Inserted lines belong to the line they were inserted before.
+func (t *templated) sourceLine(line int) int {
+	offset := 0
+	for _, in := range t.inserted {
+		start := in.line + offset
+		if line < start {
+			break
+		}
+		if line < start+in.count {
+			return in.line
 		}
+		offset += in.count
+	}
+	return line - offset
+}
 
-		if r.MatchString(line) {
-			lines[i] = line + "'px.source': df.source,"
+// templateTree templates the script as described by templateScript, keeping track of the
+// inserted lines.
+func templateTree(definition *ScriptDefinition, config ScriptConfig) (*templated, error) {
+	expanded, err := expandVariables(definition, config)
+	if err != nil {
+		return nil, err
+	}
+	file, err := pxl.Parse(expanded)
+	if err != nil {
+		return nil, err
+	}
+	// assigns holds the assignments binding each variable, including assignment expressions.
+	assigns := make(map[string][]*pxl.Assign)
+	pxl.Inspect(file.Stmts, func(n pxl.Node) bool {
+		if named, ok := n.(*pxl.NamedExpr); ok {
+			assigns[named.Name.Tok.Text] = append(assigns[named.Name.Tok.Text], &pxl.Assign{Targets: []pxl.Node{named.Name}, Op: named.Op, Value: named.Value})
+		}
+		return true
+	})
+	var exports []*export
+	pxl.Walk(file.Stmts, func(s pxl.Stmt) {
+		switch s := s.(type) {
+		case *pxl.Assign:
+			for _, target := range s.Targets {
+				for _, name := range boundNames(target) {
+					assigns[name] = append(assigns[name], s)
+				}
+			}
+		case *pxl.ExprStmt:
+			if _, ok := pxl.IsCall(s.X, "px.export"); ok {
+				exports = append(exports, &export{stmt: s, line: s.Start().Line})
+			}
 		}
+	})
+	if len(exports) == 0 {
+		return nil, fmt.Errorf("missing px.export call")
+	}
+	exportedColumns := exportColumns(file)
+	for _, e := range exports {
+		e.columns = exportedColumns[e.stmt]
 	}
-	var finalLines []string
 
-	finalLines = append(finalLines, lines[:exportLineNumber]...)
+	clusterName := "'" + stringEscaper.Replace(config.ClusterName) + "'"
+	pxl.Inspect(file.Stmts, func(n pxl.Node) bool {
+		if call, ok := pxl.IsCall(n, "px.vizier_name"); ok && len(call.Args) == 0 {
+			file.Replace(call, clusterName)
+			return false
+		}
+		return true
+	})
 
-	if definition.IsPreset || definition.AddExcludes {
-		finalLines = append(finalLines, "# New Relic integration filtering")
-		finalLines = append(finalLines, getExcludeLines(config)...)
-		if definition.IsPreset {
-			finalLines = append(finalLines, getLimitLines(definition.Name, config)...)
+	// sourced holds the dataframe of the resource dicts which got the px.source attribute.
+	sourced := make(map[*pxl.Dict]string)
+	// exported holds the px.otel.Data calls of the px.export calls.
+	exported := make(map[*pxl.Call]bool)
+	spanExports := 0
+	for i, e := range exports {
+		if err := bindExport(file, e, i+1); err != nil {
+			return nil, err
+		}
+		var resourceErr error
+		pxl.Inspect([]pxl.Stmt{e.stmt}, func(n pxl.Node) bool {
+			if _, ok := pxl.IsCall(n, "px.otel.trace.Span"); ok {
+				e.spans = true
+			}
+			if data, ok := pxl.IsCall(n, "px.otel.Data"); ok {
+				exported[data] = true
+				if resourceErr == nil {
+					resourceErr = addResourceAttributes(file, data, e, assigns, sourced, config)
+				}
+			}
+			return true
+		})
+		if resourceErr != nil {
+			return nil, resourceErr
+		}
+		if e.spans {
+			spanExports++
 		}
-		finalLines = append(finalLines, "")
+	}
+	var unboundErr error
+	pxl.Inspect(file.Stmts, func(n pxl.Node) bool {
+		if data, ok := pxl.IsCall(n, "px.otel.Data"); ok && !exported[data] && data.Keyword("resource") != nil && unboundErr == nil {
+			unboundErr = &pxl.Error{Line: data.Start().Line, Msg: "the resource of a px.otel.Data call outside of px.export can't be bound to an exported dataframe"}
+		}
+		return true
+	})
+	if unboundErr != nil {
+		return nil, unboundErr
 	}
 
-	// Add column for px.source.
-	finalLines = append(finalLines, "df.source = 'nr-pixie-integration'")
+	t := &templated{}
+	for _, e := range exports {
+		lines, err := getExportLines(definition, config, e, spanExports == 0 || e.spans)
+		if err != nil {
+			return nil, &pxl.Error{Line: e.line, Msg: err.Error()}
+		}
+		if e.expression != "" {
+			lines = append([]string{e.dataframe + " = " + e.expression}, lines...)
+		}
+		file.InsertBefore(e.stmt, lines)
+		t.inserted = append(t.inserted, insertion{line: e.line, count: strings.Count(strings.Join(lines, "\n"), "\n") + 1})
+		if e.removed > 0 {
+			t.inserted = append(t.inserted, insertion{line: e.exprLine + 1, count: -e.removed})
+		}
+	}
+	t.script = file.String()
+	return t, nil
+}
 
-	finalLines = append(finalLines, lines[exportLineNumber:]...)
+// bindExport sets the exported dataframe of the nth px.export call. An exported expression
+// is replaced with the temporary variable nr_export_<n>. The call must start its line, so
+// that the lines of the dataframe can be inserted before it.
+func bindExport(file *pxl.File, e *export, n int) error {
+	if !file.StartsLine(e.stmt) {
+		return &pxl.Error{Line: e.line, Msg: "px.export call must start its line"}
+	}
+	call, _ := pxl.IsCall(e.stmt.(*pxl.ExprStmt).X, "px.export")
+	if len(call.Args) == 0 || call.Args[0].Keyword != nil {
+		return &pxl.Error{Line: e.line, Msg: "px.export call without a dataframe"}
+	}
+	arg := call.Args[0].Value
+	if name, ok := arg.(*pxl.Name); ok {
+		e.dataframe = name.Tok.Text
+		return nil
+	}
+	e.dataframe = fmt.Sprintf("nr_export_%d", n)
+	e.expression = file.Text(arg)
+	e.removed, e.exprLine = arg.End().Line-arg.Start().Line, arg.Start().Line
+	file.Replace(arg, e.dataframe)
+	return nil
+}
 
-	return strings.Join(finalLines, "\n")
+// addResourceAttributes adds the px.source attribute of the exported dataframe and the
+// resource attributes of the config to the resource dict of the px.otel.Data call of the
+// export. The dict must be provably bound to the dataframe: either written in the call, or
+// assigned once to a variable after the dataframe and not shared with another dataframe.
+func addResourceAttributes(file *pxl.File, data *pxl.Call, e *export, assigns map[string][]*pxl.Assign, sourced map[*pxl.Dict]string, config ScriptConfig) error {
+	resource := data.Keyword("resource")
+	if resource == nil {
+		return nil
+	}
+	var dict *pxl.Dict
+	switch resource := resource.(type) {
+	case *pxl.Dict:
+		dict = resource
+	case *pxl.Name:
+		dict = assignedDict(resource.Tok.Text, e, assigns)
+	}
+	if dict == nil {
+		return &pxl.Error{Line: resource.Start().Line, Msg: fmt.Sprintf("the resource of px.otel.Data can't be bound to the exported dataframe %s: it must be a dict, or a variable assigned a dict once after the dataframe", e.dataframe)}
+	}
+	if dataframe, ok := sourced[dict]; ok {
+		if dataframe != e.dataframe {
+			return &pxl.Error{Line: resource.Start().Line, Msg: fmt.Sprintf("the resource dict is shared by the exports of %s and %s", dataframe, e.dataframe)}
+		}
+		return nil
+	}
+	sourced[dict] = e.dataframe
+	attributes, err := getResourceAttributes(dict, e.dataframe, config.ResourceAttributes)
+	if err != nil {
+		return err
+	}
+	file.InsertAfter(dict.Lbrace, attributes)
+	return nil
 }
 
-func getExcludeLines(config ScriptConfig) []string {
-	var lines []string
-	if config.ExcludeNamespaces != "" {
-		lines = append(lines, fmt.Sprintf("df = df[not px.regex_match('%s', df.namespace)]", config.ExcludeNamespaces))
+// assignedDict returns the dict assigned to the variable when it is its only assignment and
+// the exported dataframe is assigned before it, nil otherwise. Temporary dataframes are only
+// assigned right before the export, so they can't be bound to a variable.
+func assignedDict(name string, e *export, assigns map[string][]*pxl.Assign) *pxl.Dict {
+	if e.expression != "" || len(assigns[name]) != 1 {
+		return nil
+	}
+	assign := assigns[name][0]
+	dict, ok := assign.Value.(*pxl.Dict)
+	if !ok || len(assign.Targets) != 1 || assign.Op.Text != "=" {
+		return nil
 	}
-	if config.ExcludePods != "" {
-		lines = append(lines, fmt.Sprintf("df = df[not px.regex_match('%s', df.pod)]", config.ExcludePods))
+	for _, a := range assigns[e.dataframe] {
+		if a.Start().Line < assign.Start().Line {
+			return dict
+		}
+	}
+	return nil
+}
+
+// boundNames returns the variables bound by the target of an assignment, eg. a and b for
+// a, b = 1, 2, but not df for df.x = 1.
+func boundNames(target pxl.Node) []string {
+	switch target := target.(type) {
+	case *pxl.Name:
+		return []string{target.Tok.Text}
+	case *pxl.Expr:
+		var names []string
+		for _, c := range target.Children {
+			names = append(names, boundNames(c)...)
+		}
+		return names
 	}
-	return lines
+	return nil
 }
 
-func getLimitLines(scriptName string, config ScriptConfig) []string {
+// getExportLines returns the lines inserted before the export of the dataframe: the filters
+// and, when limit is true, the row limits of the script, and the px.source column.
+func getExportLines(definition *ScriptDefinition, config ScriptConfig, e *export, limit bool) ([]string, error) {
 	var lines []string
-	if scriptName == httpSpansScript && config.HttpSpanLimit > 0 {
-		lines = append(lines, fmt.Sprintf("df = df.head(%v)", config.HttpSpanLimit))
-	} else if (scriptName == postgresqlSpansScript || scriptName == mysqlSpansScript) && config.DbSpanLimit > 0 {
-		lines = append(lines, fmt.Sprintf("df = df.head(%v)", config.DbSpanLimit))
+	override := config.Overrides[definition.Name]
+	addFilters := definition.IsPreset || definition.AddExcludes
+	if addFilters || override.hasFiltering() {
+		lines = append(lines, "# New Relic integration filtering")
+		filterLines, err := getFilterLines(definition, e, getScriptFilters(addFilters, override, config))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, filterLines...)
+		switch {
+		case !limit:
+			// Only the exports of spans are limited.
+		case override.Limit != nil:
+			lines = append(lines, getRowLimitLines(definition, e, *override.Limit, getLimitMode(definition, config), config)...)
+		case addFilters:
+			lines = append(lines, getLimitLines(definition, e, config)...)
+		}
+		lines = append(lines, "")
+	}
+
+	// Add column for px.source.
+	return append(lines, e.dataframe+".source = 'nr-pixie-integration'"), nil
+}
+
+// getScriptFilters returns the filters of a script: the global filters when they apply to
+// the script, replaced per dimension by the filters of the override.
+func getScriptFilters(addFilters bool, override ScriptOverride, config ScriptConfig) Filters {
+	filters := make(Filters)
+	if addFilters {
+		filters = getFilters(config)
+	}
+	for dimension, filter := range override.Filters {
+		filters[dimension] = filter
 	}
-	return lines
+	return filters
 }
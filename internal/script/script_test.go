@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/newrelic/newrelic-pixie-integration/internal/pxl"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,9 +14,10 @@ const (
 import px
 df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
 df.namespace = df.ctx['namespace']
+df.pod = df.ctx['pod']
 df.status_code = df.resp_status
 
-df = df.groupby(['status_code', 'namespace']).agg(
+df = df.groupby(['status_code', 'pod', 'namespace']).agg(
     latency_min=('latency', px.min),
     latency_max=('latency', px.max),
     latency_sum=('latency', px.sum),
@@ -60,9 +62,11 @@ df.pixie = 'pixie'
 )
 
 var (
-	testScript    = fmt.Sprintf(testScriptHead, "px.vizier_name()") + fmt.Sprintf(testScriptTail, "", "")
-	sourceColLine = "df.source = 'nr-pixie-integration'\n"
-	sourceAttr    = "'px.source': df.source,"
+	testScript = fmt.Sprintf(testScriptHead, "px.vizier_name()") + fmt.Sprintf(testScriptTail, "", "")
+	// testScriptWithoutPod defines the pod column but drops it when grouping.
+	testScriptWithoutPod = strings.Replace(testScript, "'status_code', 'pod', 'namespace'", "'status_code', 'namespace'", 1)
+	sourceColLine        = "df.source = 'nr-pixie-integration'\n"
+	sourceAttr           = "'px.source': df.source,"
 )
 
 func getTemplatedScript(clusterName string, filter ...string) string {
@@ -117,6 +121,30 @@ func TestGetIntervalPresetScript(t *testing.T) {
 	}))
 }
 
+func TestRender(t *testing.T) {
+	definition := &ScriptDefinition{Name: "JVM Metrics", Description: "JVM", Script: "df.cluster = px.vizier_name()\npx.export(df)"}
+	config := ScriptConfig{ClusterName: "test-cluster", CollectInterval: 10}
+	rendered, err := Render(definition, config)
+	assert.NoError(t, err)
+	assert.Equal(t, &ScriptDefinition{
+		Name:        "nri-JVM Metrics-test-cluster",
+		Description: "JVM",
+		FrequencyS:  10,
+		Script:      "df.cluster = 'test-cluster'\ndf.source = 'nr-pixie-integration'\npx.export(df)",
+	}, rendered)
+
+	disabled := false
+	config.Overrides = map[string]ScriptOverride{"JVM Metrics": {Enabled: &disabled}}
+	rendered, err = Render(definition, config)
+	assert.NoError(t, err)
+	assert.Nil(t, rendered)
+
+	config.Overrides = nil
+	definition.Script = "px.export(df, px.otel.Data(resource={}"
+	_, err = Render(definition, config)
+	assert.EqualError(t, err, "templating script JVM Metrics: line 1: unclosed '('")
+}
+
 func TestGetActions(t *testing.T) {
 	// No definitions, no scripts, nothing to do
 	actions := GetActions([]*ScriptDefinition{}, []*Script{}, ScriptConfig{})
@@ -388,10 +416,18 @@ func TestGetActions(t *testing.T) {
 	assert.Equal(t, getTemplatedScript("test-cluster", ""), customScript.Script)
 }
 
+// mustTemplateScript templates the script, failing the test when it can't be parsed.
+func mustTemplateScript(t *testing.T, definition *ScriptDefinition, config ScriptConfig) string {
+	t.Helper()
+	templated, err := templateScript(definition, config)
+	assert.NoError(t, err)
+	return templated
+}
+
 func TestTemplateScript(t *testing.T) {
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "HTTP Metrics",
 			Description: "This script sends HTTP metrics to New Relic's OTel endpoint.",
 			FrequencyS:  10,
@@ -409,7 +445,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('.*mypod.*', df.pod)]", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "HTTP Metrics",
 			Description: "This script sends HTTP metrics to New Relic's OTel endpoint.",
 			FrequencyS:  10,
@@ -427,7 +463,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('.*mynamespace.*', df.namespace)]", "df = df[not px.regex_match('.*mypod.*', df.pod)]", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "HTTP Metrics",
 			Description: "This script sends HTTP metrics to New Relic's OTel endpoint.",
 			FrequencyS:  10,
@@ -445,7 +481,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('.*mynamespace.*', df.namespace)]", "df = df[not px.regex_match('.*mypod.*', df.pod)]", "df = df.head(100)", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "HTTP Spans",
 			Description: "This script sends HTTP spans to New Relic's OTel endpoint.",
 			FrequencyS:  10,
@@ -463,7 +499,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('.*mynamespace.*', df.namespace)]", "df = df.head(200)", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "MySQL Spans",
 			Description: "This script sends MySQL spans to New Relic's OTel endpoint.",
 			FrequencyS:  10,
@@ -481,7 +517,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "My script",
 			Description: "This is my script.",
 			FrequencyS:  10,
@@ -497,7 +533,7 @@ func TestTemplateScript(t *testing.T) {
 
 	assert.Equal(t,
 		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('.*mynamespace.*', df.namespace)]", ""),
-		templateScript(&ScriptDefinition{
+		mustTemplateScript(t, &ScriptDefinition{
 			Name:        "My script",
 			Description: "This is my script.",
 			FrequencyS:  10,
@@ -511,3 +547,616 @@ func TestTemplateScript(t *testing.T) {
 			ExcludeNamespaces: ".*mynamespace.*",
 		}))
 }
+
+func TestTemplateScriptFilters(t *testing.T) {
+	definition := &ScriptDefinition{
+		Name:       "HTTP Metrics",
+		FrequencyS: 10,
+		Script: strings.NewReplacer(
+			"df.pod = df.ctx['pod']", "df.pod = df.ctx['pod']\ndf.service = df.ctx['service']\ndf.node = df.ctx['node']",
+			"'pod', 'namespace'", "'pod', 'namespace', 'service', 'node'",
+		).Replace(testScript),
+		IsPreset: true,
+	}
+	config := ScriptConfig{
+		ClusterName: "test-cluster",
+		ExcludePods: ".*mypod.*",
+		Filters: Filters{
+			FilterNamespace: {Include: "team-.*"},
+			FilterPod:       {Include: "api-.*", Exclude: "ignored"},
+			FilterService:   {Exclude: ".*/internal-.*"},
+			FilterNode:      {Include: "node-[0-9]+"},
+		},
+	}
+	templated := mustTemplateScript(t, definition, config)
+	assert.Contains(t, templated, strings.Join([]string{
+		"# New Relic integration filtering",
+		"df = df[px.regex_match('team-.*', df.namespace)]",
+		"df = df[px.regex_match('api-.*', df.pod)]",
+		"df = df[not px.regex_match('.*mypod.*', df.pod)]",
+		"df = df[not px.regex_match('.*/internal-.*', df.service)]",
+		"df = df[px.regex_match('node-[0-9]+', df.node)]",
+		"",
+		sourceColLine,
+	}, "\n"))
+
+	// the script has no container column: dropping the filter would export every container
+	config.Filters[FilterContainer] = Filter{Include: "app"}
+	_, err := templateScript(definition, config)
+	assert.EqualError(t, err, "line 24: filter on container references the container column which the script doesn't define")
+
+	config.Filters[FilterContainer] = Filter{}
+	config.Filters[FilterNode] = Filter{Exclude: `node-'\d+'`}
+	assert.Contains(t, mustTemplateScript(t, definition, config), `df = df[not px.regex_match('node-\'\\d+\'', df.node)]`)
+}
+
+func TestTemplateScriptWithoutPod(t *testing.T) {
+	definition := &ScriptDefinition{Name: "HTTP Metrics", FrequencyS: 10, Script: testScriptWithoutPod, IsPreset: true}
+	_, err := templateScript(definition, ScriptConfig{ClusterName: "test-cluster", ExcludePods: ".*mypod.*"})
+	assert.EqualError(t, err, "line 22: filter on pod references the pod column which the script doesn't define")
+
+	templated := mustTemplateScript(t, definition, ScriptConfig{ClusterName: "test-cluster", ExcludeNamespaces: ".*mynamespace.*"})
+	assert.Contains(t, templated, "df = df[not px.regex_match('.*mynamespace.*', df.namespace)]\n")
+}
+
+func TestFiltersValidate(t *testing.T) {
+	assert.NoError(t, Filters{FilterService: {Include: "a.*", Exclude: "b.*"}}.Validate())
+	assert.EqualError(t, Filters{"label": {Exclude: "a"}}.Validate(), "unknown filter dimension 'label', must be one of [namespace pod service node container]")
+	assert.ErrorContains(t, Filters{FilterNode: {Exclude: "a("}}.Validate(), "invalid exclude regex for node")
+}
+
+func TestExportColumns(t *testing.T) {
+	columnsOf := func(script string) *columns {
+		file, err := pxl.Parse(script)
+		assert.NoError(t, err)
+		for _, c := range exportColumns(file) {
+			return c
+		}
+		return nil
+	}
+	assert.True(t, columnsOf(testScript).has("namespace"))
+	assert.True(t, columnsOf(testScript).has("pod"))
+	assert.True(t, columnsOf(testScript).has("latency_min"))
+	assert.False(t, columnsOf(testScript).has("latency"))
+	assert.False(t, columnsOf(testScript).has("service"))
+	assert.True(t, columnsOf("df = px.DataFrame('http_events')\ndf = df.groupby(['service']).agg()\npx.export(df)").has("service"))
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\ndf.pods = df.ctx['pods']\npx.export(df)").has("pod"))
+	assert.True(t, columnsOf("df = px.DataFrame('http_events')\ndf['pod'] = df.ctx['pod']\npx.export(df)").has("pod"))
+	assert.True(t, columnsOf("df = px.DataFrame('http_events')\ndf = df.groupby('pod').agg(\n  count=('latency', px.count),\n)\npx.export(df)").has("count"))
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\nresource = {'pod': df.ctx['pod']}\npx.export(df)").has("pod"))
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\n# df.pod = df.ctx['pod']\npx.export(df)").has("pod"))
+	// a groupby drops the columns which aren't its keys
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\ndf.pod = df.ctx['pod']\ndf = df.groupby('service').agg(count=('latency', px.count))\npx.export(df)").has("pod"))
+	// the columns of another dataframe don't count
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\nother = px.DataFrame('http_events')\nother.pod = other.ctx['pod']\nother = other.groupby(['pod']).agg()\npx.export(df)").has("pod"))
+	// projections, merges, drops, functions and exported expressions
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\ndf.pod = df.ctx['pod']\ndf = df[['latency']]\npx.export(df)").has("pod"))
+	assert.True(t, columnsOf("df = px.DataFrame('http_events', select=['latency'])\nother = px.DataFrame('http_events')\nother.pod = other.ctx['pod']\ndf = df.merge(other, how='inner')\npx.export(df)").has("pod"))
+	assert.False(t, columnsOf("df = px.DataFrame('http_events')\ndf.pod = df.ctx['pod']\ndf = df.drop(['pod'])\npx.export(df)").has("pod"))
+	assert.True(t, columnsOf("def spans():\n    df = px.DataFrame('http_events')\n    df.pod = df.ctx['pod']\n    return df\n\npx.export(spans()[0:10])").has("pod"))
+	assert.Nil(t, columnsOf("px.export(spans())"))
+}
+
+func TestScriptOverrides(t *testing.T) {
+	disabled := false
+	frequency := int64(60)
+	limit := int64(50)
+	noLimit := int64(0)
+	config := ScriptConfig{
+		ClusterName:       "test-cluster",
+		ClusterId:         "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484",
+		HttpSpanLimit:     100,
+		DbSpanLimit:       100,
+		CollectInterval:   10,
+		ExcludeNamespaces: "kube-.*",
+		Overrides: map[string]ScriptOverride{
+			"JVM Metrics":  {FrequencyS: &frequency},
+			"MySQL Spans":  {Enabled: &disabled},
+			"HTTP Spans":   {Limit: &limit, Filters: Filters{FilterNamespace: {Include: "shop"}}},
+			"Custom":       {Limit: &limit},
+			"Redis Spans":  {Limit: &noLimit},
+			"Unknown Name": {Enabled: &disabled},
+		},
+	}
+	assert.Equal(t, int64(60), getInterval(&ScriptDefinition{Name: "JVM Metrics", FrequencyS: 10, IsPreset: true}, config))
+	assert.Equal(t, int64(-1), getInterval(&ScriptDefinition{Name: "MySQL Spans", FrequencyS: 10, IsPreset: true}, config))
+	assert.Equal(t, int64(10), getInterval(&ScriptDefinition{Name: "HTTP Metrics", FrequencyS: 0}, config))
+
+	actions := GetActions([]*ScriptDefinition{
+		{Name: "JVM Metrics", FrequencyS: 10, Script: testScript, IsPreset: true},
+		{Name: "MySQL Spans", FrequencyS: 10, Script: testScript, IsPreset: true},
+	}, []*Script{
+		{ScriptDefinition: ScriptDefinition{Name: "nri-MySQL Spans-test-cluster"}, ScriptId: "cc6455ca-e12e-4a1d-b81c-ecc97a3d44cf", ClusterIds: "91cb2c1d-e6fd-4fb9-9d2f-8358895bf484"},
+	}, config)
+	assert.Equal(t, 1, len(actions.ToDelete))
+	assert.Equal(t, "cc6455ca-e12e-4a1d-b81c-ecc97a3d44cf", actions.ToDelete[0].ScriptId)
+	assert.Equal(t, 1, len(actions.ToCreate))
+	assert.Equal(t, int64(60), actions.ToCreate[0].FrequencyS)
+
+	assert.Equal(t,
+		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[px.regex_match('shop', df.namespace)]", "df = df.head(50)", ""),
+		mustTemplateScript(t, &ScriptDefinition{Name: "HTTP Spans", Script: testScript, IsPreset: true}, config))
+	assert.Equal(t,
+		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df.head(50)", ""),
+		mustTemplateScript(t, &ScriptDefinition{Name: "Custom", Script: testScript}, config))
+	assert.Equal(t,
+		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df[not px.regex_match('kube-.*', df.namespace)]", ""),
+		mustTemplateScript(t, &ScriptDefinition{Name: "Redis Spans", Script: testScript, IsPreset: true}, config))
+}
+
+func TestScriptOverrideValidate(t *testing.T) {
+	frequency := int64(0)
+	assert.NoError(t, ScriptOverride{}.Validate())
+	assert.EqualError(t, ScriptOverride{FrequencyS: &frequency}.Validate(), "frequencyS must be positive, use enabled: false to disable the script")
+	assert.Error(t, ScriptOverride{Filters: Filters{"label": {}}}.Validate())
+}
+
+func TestSpanLimits(t *testing.T) {
+	spanScript := strings.Replace(testScript, "px.otel.metric.Summary(", "px.otel.trace.Span(", 1)
+	config := ScriptConfig{
+		HttpSpanLimit:    100,
+		DbSpanLimit:      50,
+		SpanLimits:       map[string]int64{"redis": 20, "mysql": 10, "kafka": 0},
+		DefaultSpanLimit: 30,
+	}
+	assert.True(t, isSpanScript(&ScriptDefinition{Name: "HTTP Spans", IsPreset: true}, false))
+	assert.True(t, isSpanScript(&ScriptDefinition{Name: "Traces", IsPreset: true}, true))
+	assert.True(t, isSpanScript(&ScriptDefinition{Name: "Custom", SpanProtocol: "AMQP"}, false))
+	assert.False(t, isSpanScript(&ScriptDefinition{Name: "HTTP Metrics", IsPreset: true}, false))
+	// custom scripts were never limited, they opt in with the spanProtocol metadata
+	assert.False(t, isSpanScript(&ScriptDefinition{Name: "Custom Traces"}, true))
+
+	assert.Equal(t, "redis", getSpanProtocol(&ScriptDefinition{Name: "Redis Spans"}))
+	assert.Equal(t, "amqp", getSpanProtocol(&ScriptDefinition{Name: "Redis Spans", SpanProtocol: "AMQP"}))
+	assert.Equal(t, "", getSpanProtocol(&ScriptDefinition{Name: "Traces"}))
+
+	assert.Equal(t, []string{"df = df.head(100)"}, getLimitLines(&ScriptDefinition{Name: "HTTP Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Equal(t, []string{"df = df.head(10)"}, getLimitLines(&ScriptDefinition{Name: "MySQL Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Equal(t, []string{"df = df.head(50)"}, getLimitLines(&ScriptDefinition{Name: "PostgreSQL Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Equal(t, []string{"df = df.head(20)"}, getLimitLines(&ScriptDefinition{Name: "Redis Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Equal(t, []string{"df = df.head(30)"}, getLimitLines(&ScriptDefinition{Name: "DNS Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Equal(t, []string{"df = df.head(30)"}, getLimitLines(&ScriptDefinition{Name: "Traces", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Nil(t, getLimitLines(&ScriptDefinition{Name: "Kafka Spans", IsPreset: true}, &export{dataframe: "df", spans: true}, config))
+	assert.Nil(t, getLimitLines(&ScriptDefinition{Name: "HTTP Metrics", IsPreset: true}, &export{dataframe: "df", spans: false}, config))
+
+	// spans are detected on the syntax tree, not in comments or strings
+	commented := strings.Replace(testScript, "# Unit is not supported yet", "# px.otel.trace.Span( is not used", 1)
+	assert.NotContains(t, mustTemplateScript(t, &ScriptDefinition{Name: "Traces", Script: commented, IsPreset: true}, config), ".head(")
+	assert.Contains(t, mustTemplateScript(t, &ScriptDefinition{Name: "Traces", Script: spanScript, IsPreset: true}, config), "df = df.head(30)")
+	assert.NotContains(t, mustTemplateScript(t, &ScriptDefinition{Name: "Traces", Script: spanScript, AddExcludes: true}, config), ".head(")
+
+	assert.Equal(t,
+		getTemplatedScript("test-cluster", "", "# New Relic integration filtering", "df = df.head(30)", ""),
+		mustTemplateScript(t, &ScriptDefinition{Name: "Custom", Script: testScript, AddExcludes: true, SpanProtocol: "amqp"}, ScriptConfig{
+			ClusterName:      "test-cluster",
+			DefaultSpanLimit: 30,
+		}))
+}
+
+const testSpanScript = `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.namespace = df.ctx['namespace']
+df.start_time = df.time_ - df.latency
+px.export(df, px.otel.Data(
+  resource={'k8s.namespace.name': df.namespace},
+  data=[px.otel.trace.Span(name=df.req_path, start_time=df.start_time, end_time=df.time_, attributes={'http.status_code': df.resp_status})],
+))
+`
+
+func TestTemplateScriptSampling(t *testing.T) {
+	sampleLines := []string{
+		"# New Relic integration filtering",
+		"nr_latency_df = df.agg(nr_latency_quantiles=('latency', px.quantiles))",
+		"nr_latency_df.nr_latency_threshold = px.pluck_float64(nr_latency_df.nr_latency_quantiles, 'p99')",
+		"nr_latency_df.nr_join = 1",
+		"df.nr_join = 1",
+		"df = df.merge(nr_latency_df, how='inner', left_on=['nr_join'], right_on=['nr_join'], suffixes=['', '_nr_latency'])",
+	}
+	assert.Contains(t,
+		mustTemplateScript(t, &ScriptDefinition{Name: "HTTP Spans", Script: testSpanScript, IsPreset: true}, ScriptConfig{
+			ClusterName:   "test-cluster",
+			HttpSpanLimit: 100,
+			LimitMode:     LimitModeSample,
+		}),
+		strings.Join(append(sampleLines,
+			"df.nr_keep = (df.resp_status < 200 or df.resp_status >= 300) or df.latency >= df.nr_latency_threshold",
+			"nr_kept_df = df[df.nr_keep]",
+			"nr_sampled_df = df[not df.nr_keep]",
+			"nr_sampled_df = nr_sampled_df[(px.hash(nr_sampled_df.time_) % 100 + 100) % 100 < 10]",
+			"df = nr_kept_df.append(nr_sampled_df).head(100)",
+			"",
+			sourceColLine,
+		), "\n"))
+
+	// per script mode, PostgreSQL has no error condition and only keeps the slow spans
+	limit := int64(50)
+	assert.Contains(t,
+		mustTemplateScript(t, &ScriptDefinition{Name: "PostgreSQL Spans", Script: testSpanScript, IsPreset: true}, ScriptConfig{
+			ClusterName:   "test-cluster",
+			SamplePercent: 25,
+			Overrides: map[string]ScriptOverride{
+				"PostgreSQL Spans": {Limit: &limit, LimitMode: LimitModeSample},
+			},
+		}),
+		strings.Join(append(sampleLines,
+			"df.nr_keep = df.latency >= df.nr_latency_threshold",
+			"nr_kept_df = df[df.nr_keep]",
+			"nr_sampled_df = df[not df.nr_keep]",
+			"nr_sampled_df = nr_sampled_df[(px.hash(nr_sampled_df.time_) % 100 + 100) % 100 < 25]",
+			"df = nr_kept_df.append(nr_sampled_df).head(50)",
+			"",
+			sourceColLine,
+		), "\n"))
+
+	// the latency is hashed without a time_ column, and two exports don't share variables
+	script := `import px
+a = px.DataFrame(table='http_events')
+a.latency = a.latency
+b = px.DataFrame(table='http_events')
+b.latency = b.latency
+px.export(a, px.otel.Data(data=[px.otel.trace.Span(name=a.req_path)]))
+px.export(b, px.otel.Data(data=[px.otel.trace.Span(name=b.req_path)]))
+`
+	templated := mustTemplateScript(t, &ScriptDefinition{Name: "custom", Script: script, AddExcludes: true, SpanProtocol: ProtocolPostgres}, ScriptConfig{
+		DbSpanLimit: 10,
+		LimitMode:   LimitModeSample,
+	})
+	for _, df := range []string{"a", "b"} {
+		assert.Contains(t, templated, fmt.Sprintf("nr_sampled_%[1]s = nr_sampled_%[1]s[(px.hash(nr_sampled_%[1]s.latency) %% 100 + 100) %% 100 < 10]", df))
+		assert.Contains(t, templated, fmt.Sprintf("%[1]s = nr_kept_%[1]s.append(nr_sampled_%[1]s).head(10)", df))
+	}
+
+	// the kept spans count towards the limit: the total is capped, kept spans first
+	lines := getSampleLines(&ScriptDefinition{Name: "HTTP Spans"}, &export{dataframe: "df", columns: newColumns(true, "resp_status", "latency")}, 5, ScriptConfig{})
+	assert.Equal(t, "df = nr_kept_df.append(nr_sampled_df).head(5)", lines[len(lines)-1])
+	for _, line := range lines[:len(lines)-1] {
+		assert.NotContains(t, line, ".head(")
+	}
+
+	// scripts without latency and error columns fall back to head
+	assert.Equal(t,
+		[]string{"df = df.head(10)"},
+		getRowLimitLines(&ScriptDefinition{Name: "DNS Spans", Script: "px.export(df)"}, &export{dataframe: "df"}, 10, LimitModeSample, ScriptConfig{}))
+
+	assert.EqualError(t, ScriptOverride{LimitMode: "random"}.Validate(), "limitMode must be either 'head' or 'sample'")
+}
+
+func TestGetChanges(t *testing.T) {
+	current := &Script{ScriptDefinition: ScriptDefinition{Name: "nri-HTTP Metrics-test", FrequencyS: 10, Script: "px.export(df)"}, ClusterIds: "a"}
+	desired := *current
+	assert.Empty(t, getChanges(current, &desired))
+
+	desired.Script = "df.source = 'nr-pixie-integration'\npx.export(df)"
+	desired.FrequencyS = 20
+	changes := getChanges(current, &desired)
+	assert.Equal(t, []Change{
+		{Field: FieldScript, Reason: ReasonContentChanged, Before: current.Script, After: desired.Script},
+		{Field: FieldFrequencyS, Reason: ReasonFrequencyChanged, Before: "10", After: "20"},
+	}, changes)
+	assert.Equal(t, []string{ReasonContentChanged, ReasonFrequencyChanged}, Reasons(changes))
+	assert.Equal(t, "content changed: 1 lines (sha256 8b888cfc) -> 2 lines (sha256 ceb13f60)", changes[0].String())
+	assert.Equal(t, "frequency changed: 10 -> 20", changes[1].String())
+
+	desired = *current
+	desired.ClusterIds = "b"
+	changes = getChanges(current, &desired)
+	assert.Equal(t, []string{ReasonClusterIdsChanged}, Reasons(changes))
+	assert.Equal(t, "cluster IDs changed: a -> b", changes[0].String())
+}
+
+func TestValidate(t *testing.T) {
+	valid := `import px
+# px.export(df) in a comment isn't an export
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.namespace = df.ctx['namespace']
+px.export(df, px.otel.Data(
+  resource={'service.name': df.service, 'note': 'unbalanced ( in a string'},
+  data=[px.otel.metric.Gauge(name='http', value=df.latency)],
+))`
+	definition := &ScriptDefinition{Name: "Custom", Script: valid, AddExcludes: true, Source: "scripts/custom.yaml", FirstLine: 5}
+	config := ScriptConfig{ClusterName: "test-cluster", CollectInterval: 10, Filters: Filters{FilterNamespace: {Exclude: "kube-.*"}}}
+	assert.Empty(t, Validate(definition, config))
+
+	definition.Script = "df = px.DataFrame(table='http_events')\n# df.pod = df.ctx['pod']\npx.export(df, px.Data(\n  data=[df.latency],\n)\npx.export(df)"
+	config.Filters[FilterPod] = Filter{Include: "app-.*"}
+	var messages []string
+	for _, d := range Validate(definition, config) {
+		messages = append(messages, d.String())
+	}
+	assert.Equal(t, []string{
+		"scripts/custom.yaml: missing 'import px'",
+		"scripts/custom.yaml:8: px.export call without a px.otel.Data payload",
+		"scripts/custom.yaml:11: px.export call without a px.otel.Data payload",
+		"scripts/custom.yaml:8: unclosed '('",
+	}, messages)
+
+	// the templated script is checked, with the lines of the source
+	delete(config.Filters, FilterPod)
+	definition.Script = `import px
+df = px.DataFrame(table='http_events')
+df.namespace = df.ctx['namespace']
+px.export(df, px.otel.Data(data=[px.otel.metric.Gauge(name='http', value=df.latency)]))
+px.export(df, px.Data(data=[df.latency]))`
+	assert.Equal(t, []Diagnostic{
+		{Source: "scripts/custom.yaml", Line: 10, Message: "px.export call without a px.otel.Data payload"},
+	}, Validate(definition, config))
+
+	disabled := false
+	config.Overrides = map[string]ScriptOverride{"Custom": {Enabled: &disabled}}
+	assert.Empty(t, Validate(definition, config))
+
+	preset := &ScriptDefinition{Name: "HTTP Metrics", Script: "import px\npx.export(df, px.otel.Data(data=[]))]", IsPreset: true}
+	assert.Equal(t, []Diagnostic{{Source: "HTTP Metrics", Line: 2, Message: "unbalanced ']'"}}, Validate(preset, ScriptConfig{CollectInterval: 10}))
+
+	preset.Script = "import px\ndf.a = = 1\npx.export(df, px.otel.Data(data=[]))"
+	assert.Equal(t, []Diagnostic{{Source: "HTTP Metrics", Line: 2, Message: "syntax error: unexpected '='"}}, Validate(preset, ScriptConfig{CollectInterval: 10}))
+}
+
+func TestTemplateScriptSyntax(t *testing.T) {
+	script := `import px
+# Templating ignores comments and strings: px.vizier_name() resource={ px.export(
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.cluster_name = px.vizier_name()
+df.note = 'px.vizier_name() resource={'
+resource = {'k8s.cluster.name': df.cluster_name}
+px.export(df, px.otel.Data(resource=resource, data=[px.otel.metric.Gauge(name='requests', value=df.count)]))
+# px.export(df) is disabled
+`
+	assert.Equal(t, `import px
+# Templating ignores comments and strings: px.vizier_name() resource={ px.export(
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.cluster_name = 'test-cluster'
+df.note = 'px.vizier_name() resource={'
+resource = {'px.source': df.source,'k8s.cluster.name': df.cluster_name}
+df.source = 'nr-pixie-integration'
+px.export(df, px.otel.Data(resource=resource, data=[px.otel.metric.Gauge(name='requests', value=df.count)]))
+# px.export(df) is disabled
+`, mustTemplateScript(t, &ScriptDefinition{Name: "Requests", Script: script}, ScriptConfig{ClusterName: "test-cluster"}))
+
+	_, err := templateScript(&ScriptDefinition{Name: "Requests", Script: "import px\ndf = px.DataFrame('http_events')\n"}, ScriptConfig{})
+	assert.EqualError(t, err, "missing px.export call")
+	_, err = templateScript(&ScriptDefinition{Name: "Requests", Script: "import px\npx.export(df,\n"}, ScriptConfig{})
+	assert.EqualError(t, err, "line 2: unclosed '('")
+}
+
+func TestTemplateScriptResourceBinding(t *testing.T) {
+	config := ScriptConfig{ClusterName: "o'brien"}
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{`import px
+resource = {}
+df = px.DataFrame(table='http_events')
+px.export(df, px.otel.Data(resource=resource, data=[]))
+`, "line 4: the resource of px.otel.Data can't be bound to the exported dataframe df: it must be a dict, or a variable assigned a dict once after the dataframe"},
+		{`import px
+df = px.DataFrame(table='http_events')
+resource = {}
+px.export(df, px.otel.Data(resource=resource, data=[]))
+df2 = px.DataFrame(table='dns_events')
+px.export(df2, px.otel.Data(resource=resource, data=[]))
+`, "line 6: the resource of px.otel.Data can't be bound to the exported dataframe df2: it must be a dict, or a variable assigned a dict once after the dataframe"},
+		{`import px
+df = px.DataFrame(table='http_events')
+df2 = px.DataFrame(table='dns_events')
+resource = {}
+px.export(df, px.otel.Data(resource=resource, data=[]))
+px.export(df2, px.otel.Data(resource=resource, data=[]))
+`, "line 6: the resource dict is shared by the exports of df and df2"},
+		{`import px
+df = px.DataFrame(table='http_events')
+data = px.otel.Data(resource={}, data=[])
+px.export(df, data)
+`, "line 3: the resource of a px.otel.Data call outside of px.export can't be bound to an exported dataframe"},
+		{`import px
+df = px.DataFrame(table='http_events'); px.export(df, px.otel.Data(resource={}, data=[]))
+`, "line 2: px.export call must start its line"},
+		{`import px
+df = px.DataFrame(table='http_events')
+if True: px.export(df, px.otel.Data(resource={}, data=[]))
+`, "line 3: px.export call must start its line"},
+	}
+	for _, test := range tests {
+		_, err := templateScript(&ScriptDefinition{Name: "Requests", Script: test.script}, config)
+		assert.EqualError(t, err, test.err)
+	}
+
+	// the cluster name is escaped
+	assert.Equal(t, `import px
+df = px.DataFrame(table='http_events')
+df.cluster = 'o\'brien'
+df.source = 'nr-pixie-integration'
+px.export(df, px.otel.Data(resource={'px.source': df.source,}, data=[]))
+`, mustTemplateScript(t, &ScriptDefinition{Name: "Requests", Script: `import px
+df = px.DataFrame(table='http_events')
+df.cluster = px.vizier_name()
+px.export(df, px.otel.Data(resource={}, data=[]))
+`}, config))
+}
+
+func TestTemplateScriptNamedExpr(t *testing.T) {
+	script := `import px
+df = px.DataFrame(table='http_events')
+df.cluster = px.vizier_name()
+df = df[(y := 2) > 1]
+if True:
+    px.export(df, px.otel.Data(resource={'k8s.pod.name': df.pod}, data=[]))
+`
+	definition := &ScriptDefinition{Name: "Requests", Script: script}
+	config := ScriptConfig{ClusterName: "o'brien", CollectInterval: 10}
+	assert.Equal(t, `import px
+df = px.DataFrame(table='http_events')
+df.cluster = 'o\'brien'
+df = df[(y := 2) > 1]
+if True:
+    df.source = 'nr-pixie-integration'
+    px.export(df, px.otel.Data(resource={'px.source': df.source,'k8s.pod.name': df.pod}, data=[]))
+`, mustTemplateScript(t, definition, config))
+	assert.Empty(t, Validate(definition, config))
+
+	// an assignment expression rebinds the resource variable
+	definition.Script = `import px
+df = px.DataFrame(table='http_events')
+resource = {'k8s.pod.name': df.pod}
+if (resource := {}) == {}:
+    px.export(df, px.otel.Data(resource=resource, data=[]))
+`
+	_, err := templateScript(definition, config)
+	assert.EqualError(t, err, "line 5: the resource of px.otel.Data can't be bound to the exported dataframe df: it must be a dict, or a variable assigned a dict once after the dataframe")
+	assert.Equal(t, []Diagnostic{{Source: "Requests", Line: 5, Message: "the resource of px.otel.Data can't be bound to the exported dataframe df: it must be a dict, or a variable assigned a dict once after the dataframe"}}, Validate(definition, config))
+}
+
+func TestGetActionsUnparsableScript(t *testing.T) {
+	definitions := []*ScriptDefinition{{Name: "Broken", FrequencyS: 10, Script: "import px\npx.export(df"}}
+	current := []*Script{{ScriptDefinition: ScriptDefinition{Name: "nri-Broken-test-cluster"}, ScriptId: "1"}}
+	actions := GetActions(definitions, current, ScriptConfig{ClusterName: "test-cluster"})
+	assert.Empty(t, actions.ToCreate)
+	assert.Empty(t, actions.ToUpdate)
+	assert.Empty(t, actions.ToDelete)
+}
+
+func TestTemplateScriptMultipleExports(t *testing.T) {
+	script := `import px
+
+metrics = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+metrics.pod = metrics.ctx['pod']
+metrics = metrics.groupby(['pod']).agg(count=('latency', px.count))
+px.export(metrics, px.otel.Data(
+  resource={'k8s.pod.name': metrics.pod},
+  data=[px.otel.metric.Gauge(name='http.requests', value=metrics.count)],
+))
+
+spans = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+spans.pod = spans.ctx['pod']
+resource = {'k8s.pod.name': spans.pod}
+px.export(spans, px.otel.Data(
+  resource=resource,
+  data=[px.otel.trace.Span(name=spans.req_path, start_time=spans.time_, end_time=spans.time_)],
+))
+`
+	definition := &ScriptDefinition{Name: "HTTP", Script: script, AddExcludes: true, SpanProtocol: ProtocolHTTP}
+	config := ScriptConfig{ClusterName: "test-cluster", CollectInterval: 10, HttpSpanLimit: 100, Filters: Filters{FilterPod: {Exclude: "kube-.*"}}}
+	assert.Equal(t, `import px
+
+metrics = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+metrics.pod = metrics.ctx['pod']
+metrics = metrics.groupby(['pod']).agg(count=('latency', px.count))
+# New Relic integration filtering
+metrics = metrics[not px.regex_match('kube-.*', metrics.pod)]
+
+metrics.source = 'nr-pixie-integration'
+px.export(metrics, px.otel.Data(
+  resource={'px.source': metrics.source,'k8s.pod.name': metrics.pod},
+  data=[px.otel.metric.Gauge(name='http.requests', value=metrics.count)],
+))
+
+spans = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+spans.pod = spans.ctx['pod']
+resource = {'px.source': spans.source,'k8s.pod.name': spans.pod}
+# New Relic integration filtering
+spans = spans[not px.regex_match('kube-.*', spans.pod)]
+spans = spans.head(100)
+
+spans.source = 'nr-pixie-integration'
+px.export(spans, px.otel.Data(
+  resource=resource,
+  data=[px.otel.trace.Span(name=spans.req_path, start_time=spans.time_, end_time=spans.time_)],
+))
+`, mustTemplateScript(t, definition, config))
+	assert.Empty(t, Validate(definition, config))
+
+	// the exported expressions are assigned to a dataframe first
+	definition.Script = `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.pod = df.ctx['pod']
+px.export(df[df.pod != ''], px.otel.Data(
+  resource={'k8s.pod.name': df.pod},
+  data=[px.otel.metric.Gauge(name='http.requests', value=df.latency)],
+))
+`
+	assert.Equal(t, `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.pod = df.ctx['pod']
+nr_export_1 = df[df.pod != '']
+# New Relic integration filtering
+nr_export_1 = nr_export_1[not px.regex_match('kube-.*', nr_export_1.pod)]
+nr_export_1 = nr_export_1.head(100)
+
+nr_export_1.source = 'nr-pixie-integration'
+px.export(nr_export_1, px.otel.Data(
+  resource={'px.source': nr_export_1.source,'k8s.pod.name': df.pod},
+  data=[px.otel.metric.Gauge(name='http.requests', value=df.latency)],
+))
+`, mustTemplateScript(t, definition, config))
+	assert.Empty(t, Validate(definition, config))
+}
+
+func TestTemplateScriptVariables(t *testing.T) {
+	t.Setenv("NR_LICENSE_KEY", "secret")
+	script := `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df = df[df.namespace == '{{ .Namespace }}']
+px.export(df, px.otel.Data(
+  resource={'region': '{{ .Env.PXL_REGION }}', 'team': '{{ .Team }}', 'cluster': '{{ .ClusterName }}/{{ .ClusterId }}'},
+  data=[px.otel.metric.Gauge(name='requests', value=df.count)],
+))
+`
+	definition := &ScriptDefinition{Name: "Requests", Script: script, Variables: map[string]string{"Namespace": "shop", "Team": "core"}}
+	config := ScriptConfig{ClusterName: "test-cluster", ClusterId: "a1", CollectInterval: 10, Variables: map[string]string{"Team": "payments"}, Env: map[string]string{"PXL_REGION": "eu"}}
+	assert.Equal(t, `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df = df[df.namespace == 'shop']
+df.source = 'nr-pixie-integration'
+px.export(df, px.otel.Data(
+  resource={'px.source': df.source,'region': 'eu', 'team': 'payments', 'cluster': 'test-cluster/a1'},
+  data=[px.otel.metric.Gauge(name='requests', value=df.count)],
+))
+`, mustTemplateScript(t, definition, config))
+	assert.Empty(t, Validate(definition, config))
+
+	// only the env variables of the config are expanded
+	secret := &ScriptDefinition{Name: "Secret", Script: "import px\ndf.key = '{{ .Env.NR_LICENSE_KEY }}'\npx.export(df)\n"}
+	_, err := templateScript(secret, config)
+	assert.EqualError(t, err, "line 2: undefined variable Env.NR_LICENSE_KEY")
+
+	delete(definition.Variables, "Namespace")
+	_, err = templateScript(definition, config)
+	assert.EqualError(t, err, "line 3: undefined variable Namespace")
+	assert.Equal(t, []Diagnostic{{Source: "Requests", Line: 3, Message: "undefined variable Namespace"}}, Validate(definition, config))
+
+	definition.Variables["ClusterName"] = "other"
+	assert.Equal(t, "variable ClusterName is set by the integration", ValidateVariables(definition.Variables).Error())
+	assert.EqualError(t, ValidateVariables(map[string]string{"team-name": "core"}), "invalid variable name 'team-name'")
+
+	preset := &ScriptDefinition{Name: "Preset", Script: "import px\ndf.a = '{{ .Team }}'\npx.export(df, px.otel.Data(resource={}, data=[]))\n", IsPreset: true}
+	assert.Contains(t, mustTemplateScript(t, preset, config), "df.a = '{{ .Team }}'")
+}
+
+func TestTemplateScriptResourceAttributes(t *testing.T) {
+	script := `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+px.export(df, px.otel.Data(
+  resource={'service.name': df.service},
+  data=[px.otel.metric.Gauge(name='requests', value=df.count)],
+))
+`
+	definition := &ScriptDefinition{Name: "Requests", Script: script}
+	config := ScriptConfig{ClusterName: "test-cluster", CollectInterval: 10, ResourceAttributes: map[string]string{"team": "payments", "environment": "it's prod"}}
+	assert.Equal(t, `import px
+df = px.DataFrame(table='http_events', start_time=px.plugin.start_time)
+df.source = 'nr-pixie-integration'
+px.export(df, px.otel.Data(
+  resource={'px.source': df.source,'environment': 'it\'s prod','team': 'payments','service.name': df.service},
+  data=[px.otel.metric.Gauge(name='requests', value=df.count)],
+))
+`, mustTemplateScript(t, definition, config))
+	assert.Empty(t, Validate(definition, config))
+
+	config.ResourceAttributes["service.name"] = "shop"
+	_, err := templateScript(definition, config)
+	assert.EqualError(t, err, "line 4: resource attribute 'service.name' of the config is already set by the script")
+	assert.Equal(t, []Diagnostic{{Source: "Requests", Line: 4, Message: "resource attribute 'service.name' of the config is already set by the script"}}, Validate(definition, config))
+
+	assert.EqualError(t, ValidateResourceAttributes(map[string]string{"px.source": "x"}), "resource attribute px.source is set by the integration")
+}
@@ -0,0 +1,246 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/pxl"
+)
+
+var (
+	importPxRegex  = regexp.MustCompile(`^\s*import\s+px\s*$`)
+	exportRegex    = regexp.MustCompile(`\bpx\.export\(`)
+	otelDataRegex  = regexp.MustCompile(`\bpx\.otel\.Data\(`)
+	closingBracket = map[rune]rune{')': '(', ']': '[', '}': '{'}
+)
+
+// Diagnostic is a problem found in a script. Line is the line of Source, the file of a custom
+// script or the name of a preset script, or 0 when the problem isn't tied to a line.
+type Diagnostic struct {
+	Source  string
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s", d.Source, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.Source, d.Line, d.Message)
+}
+
+// Validate returns the problems of the PxL of the script definition as templated with the
+// config, at the lines of the script before it was templated. It returns nil for the scripts
+// disabled for the config.
+func Validate(definition *ScriptDefinition, config ScriptConfig) []Diagnostic {
+	if getInterval(definition, config) <= 0 {
+		return nil
+	}
+	v := &validator{definition: definition}
+	if err := ValidateVariables(definition.Variables); err != nil {
+		v.report(0, "%v", err)
+	}
+	script, err := expandVariables(definition, config)
+	if err != nil {
+		v.reportError(err)
+		return v.diagnostics
+	}
+	v.script = script
+	// Syntax errors of the script itself are reported by checkSyntax.
+	if _, err := pxl.Parse(script); err == nil {
+		if t, err := templateTree(definition, config); err != nil {
+			v.reportError(err)
+		} else {
+			v.script, v.templated = t.script, t
+		}
+	}
+	v.lines = scanLines(v.script)
+	v.checkImport()
+	v.checkExports()
+	if v.checkBrackets() && v.templated == nil {
+		v.checkSyntax()
+	}
+	return v.diagnostics
+}
+
+type validator struct {
+	definition *ScriptDefinition
+	// script is the checked script: the templated script, or the script with its variables
+	// expanded when it can't be templated.
+	script      string
+	templated   *templated
+	lines       []scannedLine
+	diagnostics []Diagnostic
+}
+
+// line returns the line of the source of a line of the checked script.
+func (v *validator) line(line int) int {
+	if v.templated == nil || line == 0 {
+		return line
+	}
+	return v.templated.sourceLine(line)
+}
+
+// report adds the diagnostic at the line of the source, unless it was already reported.
+func (v *validator) report(line int, format string, args ...interface{}) {
+	if line > 0 {
+		line += v.definition.FirstLine
+	}
+	source := v.definition.Source
+	if source == "" {
+		source = v.definition.Name
+	}
+	diagnostic := Diagnostic{Source: source, Line: line, Message: fmt.Sprintf(format, args...)}
+	for _, d := range v.diagnostics {
+		if d == diagnostic {
+			return
+		}
+	}
+	v.diagnostics = append(v.diagnostics, diagnostic)
+}
+
+// reportError reports the error expanding or templating the script.
+func (v *validator) reportError(err error) {
+	var collision *collisionError
+	var templateErr *pxl.Error
+	switch {
+	case errors.As(err, &collision):
+		v.report(collision.line, "%s", collision.message())
+	case errors.As(err, &templateErr):
+		v.report(templateErr.Line, "%s", templateErr.Msg)
+	default:
+		v.report(0, "%v", err)
+	}
+}
+
+func (v *validator) checkImport() {
+	for _, l := range v.lines {
+		if importPxRegex.MatchString(l.code) {
+			return
+		}
+	}
+	v.report(0, "missing 'import px'")
+}
+
+// checkExports reports the missing px.export calls and their missing px.otel.Data payloads.
+func (v *validator) checkExports() {
+	var code strings.Builder
+	for i, l := range v.lines {
+		if i > 0 {
+			code.WriteByte('\n')
+		}
+		code.WriteString(l.code)
+	}
+	script := code.String()
+	matches := exportRegex.FindAllStringSubmatchIndex(script, -1)
+	if len(matches) == 0 {
+		v.report(0, "missing px.export call")
+		return
+	}
+	for i, m := range matches {
+		line := v.line(strings.Count(script[:m[0]], "\n") + 1)
+		end := len(script)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		if !otelDataRegex.MatchString(script[m[0]:end]) {
+			v.report(line, "px.export call without a px.otel.Data payload")
+		}
+	}
+}
+
+// checkBrackets returns whether the brackets of the script are balanced.
+func (v *validator) checkBrackets() bool {
+	type opening struct {
+		bracket rune
+		line    int
+	}
+	var stack []opening
+	for i, l := range v.lines {
+		for _, c := range l.code {
+			switch c {
+			case '(', '[', '{':
+				stack = append(stack, opening{c, i + 1})
+			case ')', ']', '}':
+				if len(stack) == 0 || stack[len(stack)-1].bracket != closingBracket[c] {
+					v.report(v.line(i+1), "unbalanced '%c'", c)
+					return false
+				}
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if len(stack) > 0 {
+		v.report(v.line(stack[len(stack)-1].line), "unclosed '%c'", stack[len(stack)-1].bracket)
+		return false
+	}
+	return true
+}
+
+// checkSyntax reports the syntax error preventing the script from being templated.
+func (v *validator) checkSyntax() {
+	var syntaxErr *pxl.Error
+	if _, err := pxl.Parse(v.script); errors.As(err, &syntaxErr) {
+		v.report(v.line(syntaxErr.Line), "syntax error: %s", syntaxErr.Msg)
+	}
+}
+
+// scannedLine is a line of PxL. code has its comment and the content of its string literals
+// blanked with spaces, so that its positions are the ones of the line.
+type scannedLine struct {
+	code string
+}
+
+// scanLines splits the script into lines, blanking comments and the content of string
+// literals, including triple-quoted strings spanning several lines.
+func scanLines(script string) []scannedLine {
+	var lines []scannedLine
+	var code strings.Builder
+	quote := ""
+	rest := script
+	for len(rest) > 0 {
+		c := rest[0]
+		switch {
+		case c == '\n':
+			lines = append(lines, scannedLine{code: code.String()})
+			code.Reset()
+			rest = rest[1:]
+			continue
+		case quote != "":
+			if c == '\\' && len(rest) > 1 && rest[1] != '\n' {
+				code.WriteString("  ")
+				rest = rest[2:]
+				continue
+			}
+			if strings.HasPrefix(rest, quote) {
+				code.WriteString(quote)
+				rest = rest[len(quote):]
+				quote = ""
+				continue
+			}
+			code.WriteByte(' ')
+		case c == '#':
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			code.WriteString(strings.Repeat(" ", end))
+			rest = rest[end:]
+			continue
+		case c == '\'' || c == '"':
+			quote = string(c)
+			if strings.HasPrefix(rest, strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			code.WriteString(quote)
+			rest = rest[len(quote):]
+			continue
+		default:
+			code.WriteByte(c)
+		}
+		rest = rest[1:]
+	}
+	return append(lines, scannedLine{code: code.String()})
+}
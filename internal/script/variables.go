@@ -0,0 +1,92 @@
+package script
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/pxl"
+)
+
+// Template fields set by the integration, eg. {{ .ClusterName }}. Env holds the env
+// variables of the config, eg. {{ .Env.PXL_REGION }}.
+const (
+	VariableClusterName = "ClusterName"
+	VariableClusterId   = "ClusterId"
+	VariableEnv         = "Env"
+)
+
+var (
+	variableNameRegex  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	templateErrorRegex = regexp.MustCompile(`^template: pxl:(\d+):(?:\d+:)? (.*)$`)
+	missingKeyRegex    = regexp.MustCompile(`at <\.([\w.]+)>: map has no entry for key`)
+)
+
+// ValidateVariables returns an error when the name of a variable can't be used in a
+// template or is a field set by the integration.
+func ValidateVariables(variables map[string]string) error {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !variableNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid variable name '%s'", name)
+		}
+		if name == VariableClusterName || name == VariableClusterId || name == VariableEnv {
+			return fmt.Errorf("variable %s is set by the integration", name)
+		}
+	}
+	return nil
+}
+
+// expandVariables returns the script of a custom script definition executed as a Go
+// template. Variables of the config override the defaults of the definition, and an
+// undefined variable is an error. Preset scripts are returned as they are.
+func expandVariables(definition *ScriptDefinition, config ScriptConfig) (string, error) {
+	if definition.IsPreset || !strings.Contains(definition.Script, "{{") {
+		return definition.Script, nil
+	}
+	tmpl, err := template.New("pxl").Option("missingkey=error").Parse(definition.Script)
+	if err != nil {
+		return "", templateError(err)
+	}
+	data := make(map[string]interface{}, len(definition.Variables)+len(config.Variables)+3)
+	for name, value := range definition.Variables {
+		data[name] = value
+	}
+	for name, value := range config.Variables {
+		data[name] = value
+	}
+	env := make(map[string]string, len(config.Env))
+	for name, value := range config.Env {
+		env[name] = value
+	}
+	data[VariableClusterName] = config.ClusterName
+	data[VariableClusterId] = config.ClusterId
+	data[VariableEnv] = env
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", templateError(err)
+	}
+	return b.String(), nil
+}
+
+// templateError returns the error of the template as a *pxl.Error locating it in the script.
+func templateError(err error) error {
+	m := templateErrorRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(m[1])
+	msg := m[2]
+	if missing := missingKeyRegex.FindStringSubmatch(msg); missing != nil {
+		msg = "undefined variable " + missing[1]
+	}
+	return &pxl.Error{Line: line, Msg: msg}
+}
@@ -0,0 +1,88 @@
+package telemetry
+
+import (
+	"strconv"
+	"time"
+)
+
+// The types below are the subset of the OTLP/HTTP JSON encoding used by the integration.
+// Following the protobuf JSON mapping, 64-bit integers are encoded as strings.
+
+type MetricsData struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+type ScopeMetrics struct {
+	Scope   Scope    `json:"scope"`
+	Metrics []Metric `json:"metrics"`
+}
+
+type Metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Gauge       Gauge  `json:"gauge"`
+}
+
+type Gauge struct {
+	DataPoints []DataPoint `json:"dataPoints"`
+}
+
+type DataPoint struct {
+	Attributes   []KeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string     `json:"timeUnixNano"`
+	AsDouble     float64    `json:"asDouble"`
+}
+
+type LogsData struct {
+	ResourceLogs []ResourceLogs `json:"resourceLogs"`
+}
+
+type ResourceLogs struct {
+	Resource  Resource    `json:"resource"`
+	ScopeLogs []ScopeLogs `json:"scopeLogs"`
+}
+
+type ScopeLogs struct {
+	Scope      Scope       `json:"scope"`
+	LogRecords []LogRecord `json:"logRecords"`
+}
+
+type LogRecord struct {
+	TimeUnixNano   string     `json:"timeUnixNano"`
+	SeverityNumber int        `json:"severityNumber"`
+	SeverityText   string     `json:"severityText"`
+	Body           AnyValue   `json:"body"`
+	Attributes     []KeyValue `json:"attributes,omitempty"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type Scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+type AnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttribute(key, value string) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{StringValue: value}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
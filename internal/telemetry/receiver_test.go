@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// receiver is a local OTLP/HTTP JSON endpoint recording the telemetry it receives, for tests.
+type receiver struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	metrics []Metric
+	logs    []LogRecord
+	headers []http.Header
+	status  int
+}
+
+func newReceiver() *receiver {
+	r := &receiver{status: http.StatusOK}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, req *http.Request) {
+		var data MetricsData
+		r.handle(w, req, &data, func() {
+			for _, rm := range data.ResourceMetrics {
+				for _, sm := range rm.ScopeMetrics {
+					r.metrics = append(r.metrics, sm.Metrics...)
+				}
+			}
+		})
+	})
+	mux.HandleFunc(logsPath, func(w http.ResponseWriter, req *http.Request) {
+		var data LogsData
+		r.handle(w, req, &data, func() {
+			for _, rl := range data.ResourceLogs {
+				for _, sl := range rl.ScopeLogs {
+					r.logs = append(r.logs, sl.LogRecords...)
+				}
+			}
+		})
+	})
+	r.server = httptest.NewServer(mux)
+	return r
+}
+
+func (r *receiver) handle(w http.ResponseWriter, req *http.Request, data interface{}, record func()) {
+	if err := json.NewDecoder(req.Body).Decode(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.headers = append(r.headers, req.Header.Clone())
+	if r.status != http.StatusOK {
+		w.WriteHeader(r.status)
+		return
+	}
+	record()
+	w.WriteHeader(http.StatusOK)
+}
+
+// URL returns the base URL of the receiver.
+func (r *receiver) URL() string {
+	return r.server.URL
+}
+
+func (r *receiver) Close() {
+	r.server.Close()
+}
+
+// SetStatus sets the status code of the following responses. Payloads are only recorded
+// with http.StatusOK.
+func (r *receiver) SetStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// Metrics returns the received metrics, in order.
+func (r *receiver) Metrics() []Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Metric(nil), r.metrics...)
+}
+
+// Logs returns the received log records, in order.
+func (r *receiver) Logs() []LogRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogRecord(nil), r.logs...)
+}
+
+// Headers returns the headers of every received request, in order.
+func (r *receiver) Headers() []http.Header {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]http.Header(nil), r.headers...)
+}
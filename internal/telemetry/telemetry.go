@@ -0,0 +1,244 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/reconciler"
+)
+
+const (
+	serviceName    = "newrelic-pixie-integration"
+	metricsPath    = "/v1/metrics"
+	logsPath       = "/v1/logs"
+	licenseHeader  = "api-key"
+	requestTimeout = 10 * time.Second
+	// maxLogRecords bounds the buffered log records, dropping the oldest ones.
+	maxLogRecords = 1000
+)
+
+var severities = map[log.Level]int{
+	log.TraceLevel: 1,
+	log.DebugLevel: 5,
+	log.InfoLevel:  9,
+	log.WarnLevel:  13,
+	log.ErrorLevel: 17,
+	log.FatalLevel: 21,
+	log.PanicLevel: 21,
+}
+
+// Telemetry sends the metrics and logs of the integration itself to an OTLP/HTTP endpoint.
+// It is a logrus hook buffering warnings and errors, which are sent with the telemetry of
+// the next reconcile pass, or by Flush before the integration exits.
+type Telemetry struct {
+	url        string
+	licenseKey func() string
+	userAgent  string
+	version    string
+	resource   Resource
+	client     *http.Client
+
+	mu   sync.Mutex
+	logs []LogRecord
+}
+
+// New creates the telemetry sender for the OTLP/HTTP endpoint at url. The attributes are
+// added to the resource of every metric and log record.
+func New(url string, licenseKey func() string, userAgent, version string, attributes map[string]string) *Telemetry {
+	resource := Resource{Attributes: []KeyValue{
+		stringAttribute("service.name", serviceName),
+		stringAttribute("service.version", version),
+	}}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		resource.Attributes = append(resource.Attributes, stringAttribute(key, attributes[key]))
+	}
+	return &Telemetry{
+		url:        url,
+		licenseKey: licenseKey,
+		userAgent:  userAgent,
+		version:    version,
+		resource:   resource,
+		client:     &http.Client{Timeout: requestTimeout},
+	}
+}
+
+func (t *Telemetry) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (t *Telemetry) Fire(entry *log.Entry) error {
+	record := LogRecord{
+		TimeUnixNano:   unixNano(entry.Time),
+		SeverityNumber: severities[entry.Level],
+		SeverityText:   entry.Level.String(),
+		Body:           AnyValue{StringValue: entry.Message},
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.Attributes = append(record.Attributes, stringAttribute(key, fmt.Sprint(entry.Data[key])))
+	}
+	t.addLog(record)
+	return nil
+}
+
+func (t *Telemetry) addLog(record LogRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logs = append(t.logs, record)
+	if len(t.logs) > maxLogRecords {
+		t.logs = t.logs[len(t.logs)-maxLogRecords:]
+	}
+}
+
+func (t *Telemetry) takeLogs() []LogRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logs := t.logs
+	t.logs = nil
+	return logs
+}
+
+// requeueLogs puts back log records which could not be sent ahead of the newer ones.
+func (t *Telemetry) requeueLogs(logs []LogRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logs = append(logs, t.logs...)
+	if len(t.logs) > maxLogRecords {
+		t.logs = t.logs[len(t.logs)-maxLogRecords:]
+	}
+}
+
+// RecordReconcile sends the metrics of a reconcile pass which started at start, followed by
+// a log record of its outcome and the buffered log records.
+func (t *Telemetry) RecordReconcile(start time.Time, duration time.Duration, summary reconciler.Summary, reconcileErr error) error {
+	now := unixNano(start.Add(duration))
+	var attributes []KeyValue
+	if summary.PluginVersion != "" {
+		attributes = append(attributes, stringAttribute("pixie.plugin.version", summary.PluginVersion))
+	}
+	point := func(value float64, extra ...KeyValue) DataPoint {
+		return DataPoint{
+			Attributes:   append(append([]KeyValue(nil), attributes...), extra...),
+			TimeUnixNano: now,
+			AsDouble:     value,
+		}
+	}
+	failed := 0.0
+	if reconcileErr != nil {
+		failed = 1
+	}
+	metrics := []Metric{
+		{
+			Name:        "pixie_integration.reconcile.duration",
+			Description: "Duration of the reconcile pass.",
+			Unit:        "s",
+			Gauge:       Gauge{DataPoints: []DataPoint{point(duration.Seconds())}},
+		},
+		{
+			Name:        "pixie_integration.reconcile.failed",
+			Description: "1 when the reconcile pass failed, 0 otherwise.",
+			Gauge:       Gauge{DataPoints: []DataPoint{point(failed)}},
+		},
+		{
+			Name:        "pixie_integration.scripts.operations",
+			Description: "Number of script operations of the reconcile pass.",
+			Gauge: Gauge{DataPoints: []DataPoint{
+				point(float64(summary.Created), stringAttribute("operation", "created")),
+				point(float64(summary.Updated), stringAttribute("operation", "updated")),
+				point(float64(summary.Deleted), stringAttribute("operation", "deleted")),
+				point(float64(summary.Failed), stringAttribute("operation", "failed")),
+			}},
+		},
+		{
+			Name:        "pixie_integration.scripts.managed",
+			Description: "Number of nri- data retention scripts after the reconcile pass.",
+			Gauge:       Gauge{DataPoints: []DataPoint{point(float64(summary.Scripts))}},
+		},
+	}
+
+	outcome := LogRecord{
+		TimeUnixNano:   now,
+		SeverityNumber: severities[log.InfoLevel],
+		SeverityText:   log.InfoLevel.String(),
+		Body:           AnyValue{StringValue: fmt.Sprintf("Reconcile finished: %s", summary)},
+		Attributes:     attributes,
+	}
+	if reconcileErr != nil {
+		outcome.SeverityNumber = severities[log.ErrorLevel]
+		outcome.SeverityText = log.ErrorLevel.String()
+		outcome.Body.StringValue = fmt.Sprintf("Reconcile failed: %s: %v", summary, reconcileErr)
+	}
+	t.addLog(outcome)
+
+	metricsErr := t.send(metricsPath, MetricsData{ResourceMetrics: []ResourceMetrics{{
+		Resource:     t.resource,
+		ScopeMetrics: []ScopeMetrics{{Scope: t.scope(), Metrics: metrics}},
+	}}})
+	logsErr := t.Flush()
+	if metricsErr != nil {
+		return metricsErr
+	}
+	return logsErr
+}
+
+// Flush sends the buffered log records, eg. the error logged before the integration exits.
+// The records are buffered again when they can't be sent.
+func (t *Telemetry) Flush() error {
+	logs := t.takeLogs()
+	if len(logs) == 0 {
+		return nil
+	}
+	err := t.send(logsPath, LogsData{ResourceLogs: []ResourceLogs{{
+		Resource:  t.resource,
+		ScopeLogs: []ScopeLogs{{Scope: t.scope(), LogRecords: logs}},
+	}}})
+	if err != nil {
+		t.requeueLogs(logs)
+	}
+	return err
+}
+
+func (t *Telemetry) scope() Scope {
+	return Scope{Name: serviceName, Version: t.version}
+}
+
+func (t *Telemetry) send(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set(licenseHeader, t.licenseKey())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sending %s failed with status %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package telemetry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/newrelic-pixie-integration/internal/reconciler"
+)
+
+func newTestTelemetry(receiver *receiver) *Telemetry {
+	return New(receiver.URL(), func() string { return "eu01xxlicense" }, "pixie/1.2.3", "1.2.3", map[string]string{"pixie.cluster.names": "test-cluster"})
+}
+
+func TestRecordReconcile(t *testing.T) {
+	receiver := newReceiver()
+	defer receiver.Close()
+	telemetry := newTestTelemetry(receiver)
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	summary := reconciler.Summary{Created: 2, Updated: 1, PluginVersion: "0.0.3", Scripts: 5}
+	assert.NoError(t, telemetry.RecordReconcile(start, 1500*time.Millisecond, summary, nil))
+
+	version := stringAttribute("pixie.plugin.version", "0.0.3")
+	timestamp := "1704164646500000000"
+	metrics := receiver.Metrics()
+	assert.Len(t, metrics, 4)
+	assert.Equal(t, "pixie_integration.reconcile.duration", metrics[0].Name)
+	assert.Equal(t, []DataPoint{{Attributes: []KeyValue{version}, TimeUnixNano: timestamp, AsDouble: 1.5}}, metrics[0].Gauge.DataPoints)
+	assert.Equal(t, "pixie_integration.reconcile.failed", metrics[1].Name)
+	assert.Equal(t, 0.0, metrics[1].Gauge.DataPoints[0].AsDouble)
+	assert.Equal(t, "pixie_integration.scripts.operations", metrics[2].Name)
+	assert.Equal(t, DataPoint{Attributes: []KeyValue{version, stringAttribute("operation", "created")}, TimeUnixNano: timestamp, AsDouble: 2}, metrics[2].Gauge.DataPoints[0])
+	assert.Equal(t, "pixie_integration.scripts.managed", metrics[3].Name)
+	assert.Equal(t, 5.0, metrics[3].Gauge.DataPoints[0].AsDouble)
+
+	logs := receiver.Logs()
+	assert.Len(t, logs, 1)
+	assert.Equal(t, "Reconcile finished: 2 created, 1 updated, 0 deleted, 0 failed", logs[0].Body.StringValue)
+	assert.Equal(t, "info", logs[0].SeverityText)
+
+	for _, header := range receiver.Headers() {
+		assert.Equal(t, "eu01xxlicense", header.Get("api-key"))
+		assert.Equal(t, "pixie/1.2.3", header.Get("User-Agent"))
+		assert.Equal(t, "application/json", header.Get("Content-Type"))
+	}
+}
+
+func TestRecordReconcileLogs(t *testing.T) {
+	receiver := newReceiver()
+	defer receiver.Close()
+	telemetry := newTestTelemetry(receiver)
+
+	logger := log.New()
+	logger.AddHook(telemetry)
+	logger.Info("not forwarded")
+	logger.WithError(fmt.Errorf("permission denied")).Warn("error creating Pixie API client")
+
+	receiver.SetStatus(http.StatusServiceUnavailable)
+	err := telemetry.RecordReconcile(time.Now(), time.Second, reconciler.Summary{}, fmt.Errorf("getting data retention plugins failed"))
+	assert.EqualError(t, err, "sending /v1/metrics failed with status 503 Service Unavailable")
+	assert.Empty(t, receiver.Logs())
+
+	receiver.SetStatus(http.StatusOK)
+	assert.NoError(t, telemetry.RecordReconcile(time.Now(), time.Second, reconciler.Summary{PluginVersion: "0.0.3"}, nil))
+	logs := receiver.Logs()
+	assert.Len(t, logs, 3)
+	assert.Equal(t, "error creating Pixie API client", logs[0].Body.StringValue)
+	assert.Equal(t, "warning", logs[0].SeverityText)
+	assert.Equal(t, []KeyValue{stringAttribute("error", "permission denied")}, logs[0].Attributes)
+	assert.Equal(t, "Reconcile failed: 0 created, 0 updated, 0 deleted, 0 failed: getting data retention plugins failed", logs[1].Body.StringValue)
+	assert.Equal(t, 17, logs[1].SeverityNumber)
+	assert.Equal(t, "Reconcile finished: 0 created, 0 updated, 0 deleted, 0 failed", logs[2].Body.StringValue)
+}
+
+func TestFlush(t *testing.T) {
+	receiver := newReceiver()
+	defer receiver.Close()
+	telemetry := newTestTelemetry(receiver)
+
+	assert.NoError(t, telemetry.Flush())
+	assert.Empty(t, receiver.Headers())
+
+	logger := log.New()
+	logger.AddHook(telemetry)
+	logger.ExitFunc = func(int) {}
+	logger.WithError(fmt.Errorf("connection refused")).Fatal("setting up Pixie client failed")
+
+	receiver.SetStatus(http.StatusServiceUnavailable)
+	assert.EqualError(t, telemetry.Flush(), "sending /v1/logs failed with status 503 Service Unavailable")
+	receiver.SetStatus(http.StatusOK)
+	assert.NoError(t, telemetry.Flush())
+	logs := receiver.Logs()
+	assert.Len(t, logs, 1)
+	assert.Equal(t, "setting up Pixie client failed", logs[0].Body.StringValue)
+	assert.Equal(t, "fatal", logs[0].SeverityText)
+	assert.Len(t, receiver.Headers(), 2)
+}